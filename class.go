@@ -0,0 +1,400 @@
+package goforth
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Fields of classes. The body of ": class" declares the fields:
+//
+//	name        a cell
+//	5 name      five cells
+//	f:name      a float, i: and a: declare ints and addresses
+//	sv:name     a reference to an object of the class sv
+//	point o:pos an embedded object of the class point
+//	count=10    a cell with a default value, f:weight=1.5 a float
+//
+// Every class gets the words :print, :equals and :copy, which handle the
+// fields by their types. They may be replaced by own definitions.
+
+// A field of a class.
+type classField struct {
+	name     string
+	offset   int64    // the offset of the cells, of the object if embedded
+	size     int64    // the number of cells
+	t        cellType // the type of the cells
+	class    string   // the class of references and embedded objects
+	embedded bool     // the cells are an object of class
+	value    string   // the default value of the cells
+}
+
+// Parses the field declarations values of clazz. The first field starts
+// at offset.
+func (fc *ForthCompiler) parseFields(clazz string, values []string, offset int64) ([]classField, error) {
+	fields := make([]classField, 0, len(values))
+
+	for i := 0; i < len(values); i++ {
+		f := classField{size: 1, value: "0"}
+		token := values[i]
+
+		if isNumeric(token) {
+			size, err := strconv.ParseInt(token, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+
+			if i++; i == len(values) {
+				return nil, fmt.Errorf("class \"%s\": \"%s\" should be followed by a name", clazz, token)
+			}
+
+			if token = values[i]; isNumeric(token) {
+				return nil, fmt.Errorf("\"%s\" should be a name", token)
+			}
+
+			if size < 1 {
+				return nil, fmt.Errorf("struct member size must be greater than 0. Size was: %d at member: %s", size, token)
+			}
+
+			f.size = size
+		} else if class := fc.embeddedClass(clazz, token); class != "" && i+1 < len(values) && !isNumeric(values[i+1]) {
+			i++
+			f.class, f.embedded, f.t = class, true, typeAddr
+
+			// before embedded objects a class name was the name of a cell
+			var explicit bool
+			if token, explicit = strings.CutPrefix(values[i], "o:"); !explicit {
+				PrintWarning(fmt.Sprintf("class \"%[1]s\": \"%[2]s %[3]s\" is an embedded %[2]s named %[3]s, "+
+					"write \"%[2]s o:%[3]s\" for it or \"1 %[2]s %[3]s\" for two cells", clazz, values[i-1], token))
+			}
+		}
+
+		name, value, hasValue := strings.Cut(token, "=")
+
+		if prefix, rest, ok := strings.Cut(name, ":"); ok && !f.embedded {
+			if f.t = parseCellType(rest + ":" + prefix); f.t == typeUnknown {
+				class := fc.resolveClass(prefix)
+				if _, ok := fc.classes[class]; !ok {
+					return nil, fmt.Errorf("class \"%s\": unknown type \"%s\" of field \"%s\"", clazz, prefix, rest)
+				}
+				f.class, f.t = class, typeAddr
+			}
+			name = rest
+		}
+
+		if !isValidWord(name) || strings.ContainsAny(name, ":.=") || isNumeric(name) {
+			return nil, fmt.Errorf("class \"%s\": invalid field name \"%s\"", clazz, name)
+		}
+
+		if hasValue {
+			switch {
+			case f.embedded || f.class != "":
+				return nil, fmt.Errorf("class \"%s\": field \"%s\" cannot have a default value", clazz, name)
+			case isFloat(value) && (f.t == typeUnknown || f.t == typeFloat):
+				f.t = typeFloat
+			case isNumeric(value) && f.t == typeFloat:
+				value += ".0"
+			case !isNumeric(value):
+				return nil, fmt.Errorf("class \"%s\": invalid default value \"%s\" of field \"%s\"", clazz, value, name)
+			}
+			f.value = value
+		}
+
+		if f.embedded {
+			f.size, _ = fc.classSize(f.class)
+			if fc.isVirtual(f.class) {
+				// the vtable slot is before the object
+				offset++
+				f.size--
+			}
+		}
+
+		f.name = name
+		f.offset = offset
+		offset += f.size
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// Returns the fields of clazz including the fields of its base classes.
+func (fc *ForthCompiler) fieldsOf(clazz string) []classField {
+	if info := fc.classes[clazz]; info != nil {
+		return slices.Clone(info.fields)
+	}
+
+	return nil
+}
+
+// Returns the class token refers to, if the field is an embedded object.
+func (fc *ForthCompiler) embeddedClass(clazz, token string) string {
+	class := fc.resolveClass(token)
+	if _, ok := fc.classes[class]; !ok || class == fc.qualify(clazz) {
+		return ""
+	}
+
+	if _, ok := fc.classSize(class); !ok {
+		return ""
+	}
+
+	return class
+}
+
+// Returns the value of clazz:sizeof.
+func (fc *ForthCompiler) classSize(clazz string) (int64, bool) {
+	def, ok := fc.defs[clazz+":sizeof"]
+	if !ok || def.Len() != 1 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(def.data[0], 10, 64)
+
+	return size, err == nil
+}
+
+// Returns the suffix of the type t in a stack comment.
+func typeSuffix(t cellType) string {
+	switch t {
+	case typeInt:
+		return ":i"
+	case typeFloat:
+		return ":f"
+	case typeAddr:
+		return ":a"
+	default:
+		return ""
+	}
+}
+
+// Returns the name of the getter or setter of a field, e.g. getName.
+func accessorName(prefix, name string) string {
+	return prefix + string(unicode.ToUpper(rune(name[0]))) + name[1:]
+}
+
+// Writes the address word, the getter and the setter of f.
+func writeAccessors(b *strings.Builder, clazz string, f classField) {
+	switch f.offset {
+	case 0:
+		fmt.Fprintf(b, ": %s:%s ;\n", clazz, f.name)
+	case 1:
+		fmt.Fprintf(b, ": %s:%s 1+ ;\n", clazz, f.name)
+	default:
+		fmt.Fprintf(b, ": %s:%s %d + ;\n", clazz, f.name, f.offset)
+	}
+
+	getter, setter := accessorName("get", f.name), accessorName("set", f.name)
+	value := f.name + typeSuffix(f.t)
+
+	switch {
+	case f.embedded:
+		// the embedded object is copied by the setter
+		fmt.Fprintf(b, ": %s:%s ( self -- %s ) %s:%s ;\n", clazz, getter, value, clazz, f.name)
+		fmt.Fprintf(b, ": %s:%s ( %s self -- ) %s:%s %d -rot memcpy ;\n", clazz, setter, value, clazz, f.name, f.size)
+	case f.size == 1:
+		fmt.Fprintf(b, ": %s:%s ( self -- %s ) %s:%s @ ;\n", clazz, getter, value, clazz, f.name)
+		fmt.Fprintf(b, ": %s:%s ( %s self -- ) %s:%s ! ;\n", clazz, setter, value, clazz, f.name)
+	default:
+		fmt.Fprintf(b, ": %s:%s ( idx self -- %s ) %s:%s + @ ;\n", clazz, getter, value, clazz, f.name)
+		fmt.Fprintf(b, ": %s:%s ( %s idx self -- ) %s:%s + ! ;\n", clazz, setter, value, clazz, f.name)
+	}
+}
+
+// Writes the code setting f of the object on the stack to its default.
+func writeFieldInit(b *strings.Builder, clazz string, f classField) {
+	switch {
+	case f.embedded:
+		fmt.Fprintf(b, " dup %s:%s %s:init drop", clazz, f.name, f.class)
+	case f.size > 1:
+		fmt.Fprintf(b, " dup %d %s rot %s:%s memset", f.size, f.value, clazz, f.name)
+	default:
+		fmt.Fprintf(b, " dup %s swap %s:%s !", f.value, clazz, f.name)
+	}
+}
+
+// Returns the code printing a cell of f ( value -- ).
+func printCell(f classField) string {
+	switch {
+	case f.class != "":
+		return fmt.Sprintf("dup if %s:print else . then", f.class)
+	case f.t == typeFloat:
+		return "f."
+	default:
+		return "."
+	}
+}
+
+// Returns the code comparing two cells of f ( value value -- bool ).
+func equalCells(f classField) string {
+	if f.class != "" {
+		return fmt.Sprintf("2dup * 0= if = else %s:equals then", f.class)
+	}
+
+	return "="
+}
+
+// Writes :print, :equals and :copy of clazz with the fields.
+func writeObjectWords(b *strings.Builder, clazz string, fields []classField, virtual bool) {
+	// clazz:print
+	fmt.Fprintf(b, ": %s:print ( self -- ) { self } .\" %s( \"", clazz, clazz)
+	for _, f := range fields {
+		fmt.Fprintf(b, " .\" %s: \"", f.name)
+		switch {
+		case f.embedded:
+			fmt.Fprintf(b, " self %s:%s %s:print", clazz, f.name, f.class)
+		case f.size > 1:
+			fmt.Fprintf(b, " .\" [ \" %d 0 do i self %s:%s %s space loop .\" ]\"", f.size, clazz, accessorName("get", f.name), printCell(f))
+		default:
+			fmt.Fprintf(b, " self %s:%s %s", clazz, accessorName("get", f.name), printCell(f))
+		}
+		b.WriteString(" space")
+	}
+	b.WriteString(" .\" )\" ;\n")
+
+	// clazz:equals
+	fmt.Fprintf(b, ": %s:equals ( self other -- bool ) { other self } true", clazz)
+	for _, f := range fields {
+		switch {
+		case f.embedded:
+			fmt.Fprintf(b, " self %s:%s other %s:%s %s:equals and", clazz, f.name, clazz, f.name, f.class)
+		case f.size > 1:
+			getter := accessorName("get", f.name)
+			fmt.Fprintf(b, " %d 0 do i self %s:%s i other %s:%s %s and loop", f.size, clazz, getter, clazz, getter, equalCells(f))
+		default:
+			getter := accessorName("get", f.name)
+			fmt.Fprintf(b, " self %s:%s other %s:%s %s and", clazz, getter, clazz, getter, equalCells(f))
+		}
+	}
+	b.WriteString(" ;\n")
+
+	// clazz:copy, references are shared
+	fmt.Fprintf(b, ": %s:copy ( self -- obj ) 1 %s:allot { obj self }", clazz, clazz)
+	if virtual {
+		fmt.Fprintf(b, " %s:sizeof self 1- obj 1- memcpy obj ;\n", clazz)
+	} else {
+		fmt.Fprintf(b, " %s:sizeof self obj memcpy obj ;\n", clazz)
+	}
+}
+
+// The types of fields in the metadata of classes, see stdlib/reflect.fs.
+const (
+	fieldCell = iota
+	fieldInt
+	fieldFloat
+	fieldAddr
+	fieldReference
+	fieldObject
+)
+
+// Returns the type of f in the metadata.
+func (f classField) typeCode() int64 {
+	switch {
+	case f.embedded:
+		return fieldObject
+	case f.class != "":
+		return fieldReference
+	case f.t == typeInt:
+		return fieldInt
+	case f.t == typeFloat:
+		return fieldFloat
+	case f.t == typeAddr:
+		return fieldAddr
+	default:
+		return fieldCell
+	}
+}
+
+// Defines clazz>class, which pushes the address of the metadata of clazz.
+// The address is set when the metadata is laid out.
+func (fc *ForthCompiler) compileClassTable(clazz string, info *classInfo, filename string) error {
+	if err := fc.parse(fmt.Sprintf(": %s>class 0 ;\n", clazz), filename); err != nil {
+		return err
+	}
+
+	info.meta = fc.qualify(clazz + ">class")
+
+	return fc.setInlineAttribute("inline", []string{info.meta})
+}
+
+// Places the metadata of the classes used by the program in the data
+// segment. The metadata of a class is
+//
+//	name-addr name-len base sizeof #fields fields...
+//
+// followed by six cells per field
+//
+//	name-addr name-len offset size type class
+//
+// where base and class are the addresses of the metadata of the classes
+// or 0. The names are stored behind the metadata.
+func (fc *ForthCompiler) layoutClassTables() {
+	metas := make(map[string]string, len(fc.classes))
+	for clazz, info := range fc.classes {
+		if info.meta != "" && fc.defs[info.meta] != nil {
+			metas[info.meta] = clazz
+		}
+	}
+
+	// the classes used by main and the classes they refer to
+	var todo []string
+	for word := range fc.reachable("main") {
+		if clazz, ok := metas[word]; ok {
+			todo = append(todo, clazz)
+		}
+	}
+
+	used := make(map[string]bool)
+	for len(todo) > 0 {
+		clazz := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+
+		info := fc.classes[clazz]
+		if used[clazz] || info == nil || info.meta == "" {
+			continue
+		}
+
+		used[clazz] = true
+		todo = append(todo, info.base)
+		for _, f := range info.fields {
+			todo = append(todo, f.class)
+		}
+	}
+
+	classes := slices.Sorted(maps.Keys(used))
+	addrs := make(map[string]int64, len(classes))
+	end := fc.base + int64(len(fc.segment))
+
+	for _, clazz := range classes {
+		addrs[clazz] = end
+		end += 5 + 6*int64(len(fc.classes[clazz].fields))
+	}
+
+	var names []int64
+
+	name := func(text string) []int64 {
+		addr := end + int64(len(names))
+		for _, r := range text {
+			names = append(names, int64(r))
+		}
+		return []int64{addr, int64(len([]rune(text)))}
+	}
+
+	for _, clazz := range classes {
+		info := fc.classes[clazz]
+		size, _ := fc.classSize(clazz)
+
+		fc.defs[info.meta] = &Stack[string]{data: []string{strconv.FormatInt(addrs[clazz], 10)}}
+		fc.segment = append(fc.segment, name(info.name)...)
+		fc.segment = append(fc.segment, addrs[info.base], size, int64(len(info.fields)))
+
+		for _, f := range info.fields {
+			fc.segment = append(fc.segment, name(f.name)...)
+			fc.segment = append(fc.segment, f.offset, f.size, f.typeCode(), addrs[f.class])
+		}
+	}
+
+	fc.segment = append(fc.segment, names...)
+}
@@ -0,0 +1,59 @@
+package goforth
+
+import "testing"
+
+func TestClassMetadata(t *testing.T) {
+	// 0 is the base or the class of a field without a class, so the
+	// metadata of animal must not be stored at 0
+	script := `use reflect
+: class animal legs ;
+: class dog extends animal animal pet ;
+: main
+  animal>class 0= .
+  animal>class class:base .
+  dog>class class:base animal>class = .
+  dog>class class:fields 1- dog>class class:field field-class animal>class = .
+;`
+	want := "0011"
+
+	if got := runVM(t, script); got != want {
+		t.Errorf("VM: got %q, want %q", got, want)
+	}
+
+	if got := runC(t, script); got != want {
+		t.Errorf("C: got %q, want %q", got, want)
+	}
+}
+
+func TestEmbeddedFields(t *testing.T) {
+	script := `: class point x y ;
+: class pair 1 point pos ;
+: class shape point o:pos size ;
+: main pair:sizeof . shape:sizeof . 0 shape:size 0 shape:pos - . ;`
+
+	if got := runVM(t, script); got != "232" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestAllotVirtual(t *testing.T) {
+	// the objects of :allot have a vtable before :init is called
+	script := `: class shape x method area ;
+: shape:area drop 1 ;
+: class square extends shape side ;
+: override square:area drop 4 ;
+: main
+  3 square:allot { s }
+  3 0 do i s square:[] send area . loop
+  shape:new send area .
+;`
+	want := "4441"
+
+	if got := runVM(t, script); got != want {
+		t.Errorf("VM: got %q, want %q", got, want)
+	}
+
+	if got := runC(t, script); got != want {
+		t.Errorf("C: got %q, want %q", got, want)
+	}
+}
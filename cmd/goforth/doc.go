@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/loscoala/goforth"
+)
+
+// goforth doc [-html] [-o dir] [files]
+//
+// Writes the documentation of the files, one page per file, and an index.
+// Without files the stdlib is documented.
+func runDoc(args []string) int {
+	flags := flag.NewFlagSet("doc", flag.ExitOnError)
+	asHTML := flags.Bool("html", false, "Write HTML instead of Markdown")
+	dir := flags.String("o", "doc", "The output directory")
+	flags.Parse(args)
+
+	modules := flags.Args()
+
+	if len(modules) == 0 {
+		entries, err := fs.ReadDir(goforth.Stdlib, "stdlib")
+		if err != nil {
+			goforth.PrintError(err)
+			return 1
+		}
+		for _, entry := range entries {
+			modules = append(modules, strings.TrimSuffix(entry.Name(), ".fs"))
+		}
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		goforth.PrintError(err)
+		return 1
+	}
+
+	ext := ".md"
+	if *asHTML {
+		ext = ".html"
+	}
+
+	var index bytes.Buffer
+
+	if *asHTML {
+		index.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>Modules</title>\n</head>\n<body>\n<h1>Modules</h1>\n<ul>\n")
+	} else {
+		index.WriteString("# Modules\n\n")
+	}
+
+	code := 0
+
+	for _, module := range modules {
+		fc := goforth.NewForthCompiler()
+
+		if err := fc.ParseFile("core"); err != nil {
+			goforth.PrintError(err)
+			return 1
+		}
+
+		if module != "core" {
+			if err := fc.ParseFile(module); err != nil {
+				goforth.PrintError(err)
+				code = 1
+				continue
+			}
+		}
+
+		var page bytes.Buffer
+		var err error
+
+		if *asHTML {
+			err = fc.WriteHTMLDoc(&page, module)
+		} else {
+			err = fc.WriteMarkdownDoc(&page, module)
+		}
+
+		if err != nil {
+			goforth.PrintError(err)
+			code = 1
+			continue
+		}
+
+		name := strings.TrimSuffix(filepath.Base(module), filepath.Ext(module))
+
+		if err := os.WriteFile(filepath.Join(*dir, name+ext), page.Bytes(), 0644); err != nil {
+			goforth.PrintError(err)
+			code = 1
+			continue
+		}
+
+		if *asHTML {
+			fmt.Fprintf(&index, "<li><a href=\"%s%s\">%s</a></li>\n", name, ext, name)
+		} else {
+			fmt.Fprintf(&index, "- [%s](%s%s)\n", name, name, ext)
+		}
+	}
+
+	if *asHTML {
+		index.WriteString("</ul>\n</body>\n</html>\n")
+	}
+
+	if err := os.WriteFile(filepath.Join(*dir, "index"+ext), index.Bytes(), 0644); err != nil {
+		goforth.PrintError(err)
+		code = 1
+	}
+
+	return code
+}
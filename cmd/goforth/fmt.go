@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/loscoala/goforth"
+)
+
+// goforth fmt [-check] [files]
+//
+// Formats the files in place. Without files stdin is formatted to stdout.
+// With -check the files are not changed, but the unformatted files are
+// listed and the exit code is 1.
+func runFmt(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	check := flags.Bool("check", false, "List files which are not formatted instead of rewriting them")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			goforth.PrintError(err)
+			return 2
+		}
+
+		result, err := goforth.FormatSource(string(data))
+		if err != nil {
+			goforth.PrintError(err)
+			return 2
+		}
+
+		if *check {
+			if result != string(data) {
+				fmt.Println("<stdin>")
+				return 1
+			}
+			return 0
+		}
+
+		fmt.Print(result)
+		return 0
+	}
+
+	code := 0
+
+	for _, name := range flags.Args() {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			goforth.PrintError(err)
+			code = 2
+			continue
+		}
+
+		result, err := goforth.FormatSource(string(data))
+		if err != nil {
+			goforth.PrintError(fmt.Errorf("%s: %w", name, err))
+			code = 2
+			continue
+		}
+
+		if result == string(data) {
+			continue
+		}
+
+		if *check {
+			fmt.Println(name)
+			code = max(code, 1)
+			continue
+		}
+
+		if err := os.WriteFile(name, []byte(result), 0644); err != nil {
+			goforth.PrintError(err)
+			code = 2
+		}
+	}
+
+	return code
+}
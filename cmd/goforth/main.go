@@ -1,7 +1,13 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/loscoala/goforth"
 )
@@ -13,21 +19,95 @@ var (
 	outfile string
 )
 
+// A flag which can be repeated, e.g. "-I lib -I ../shared".
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, string(filepath.ListSeparator))
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func initFlags() {
 	flag.StringVar(&fname, "file", "", "Program passed in as a file")
 	flag.BoolVar(&goforth.Colored, "color", true, "Use colors")
 	flag.StringVar(&script, "script", "", "Program passed in as string")
 	flag.BoolVar(&compile, "compile", false, "Compile to C")
+	flag.BoolVar(&goforth.ShowInlining, "why-inline", false, "Report why words are inlined or called")
+	flag.BoolVar(&goforth.StrictStackCheck, "strict", false, "Report stack effect warnings as errors")
+	flag.BoolVar(&goforth.TypeCheck, "typecheck", false, "Report mixed use of int and float cells")
+	flag.BoolVar(&goforth.TraceMacros, "trace-macros", false, "Print the input, registers and output of every macro expansion")
+	flag.Var((*listFlag)(&goforth.IncludePath), "I", "Add a directory to the search path of use (repeatable)")
 	flag.StringVar(&outfile, "o", goforth.CBinaryName, "The name of the generated binary file (-compile flag is required)")
 
 	flag.Parse()
 }
 
+// Runs a subcommand like "goforth lsp". Returns false if there is none.
+func runCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+
+	switch os.Args[1] {
+	case "lsp":
+		// the protocol uses stdout, other output of the compiler goes to stderr
+		out := os.Stdout
+		os.Stdout = os.Stderr
+		goforth.Colored = false
+		if err := goforth.ServeLSP(os.Stdin, out); err != nil {
+			goforth.PrintError(err)
+			os.Exit(1)
+		}
+	case "fmt":
+		os.Exit(runFmt(os.Args[2:]))
+	case "doc":
+		os.Exit(runDoc(os.Args[2:]))
+	case "test":
+		os.Exit(runTest(os.Args[2:]))
+	case "mod":
+		os.Exit(runMod(os.Args[2:]))
+	case "which":
+		os.Exit(runWhich(os.Args[2:]))
+	case "run":
+		// runs the entry of the manifest like -file
+		m, err := goforth.FindManifest(".")
+		if err != nil {
+			goforth.PrintError(err)
+			os.Exit(1)
+		}
+		if m == nil || m.Entry == "" {
+			goforth.PrintError(fmt.Errorf("no entry in %s found", goforth.ManifestName))
+			os.Exit(1)
+		}
+		os.Args = append([]string{os.Args[0], "-file", filepath.Join(m.Dir, m.Entry)}, os.Args[2:]...)
+		return false
+	default:
+		return false
+	}
+
+	return true
+}
+
 func main() {
+	if runCommand() {
+		return
+	}
+
 	initFlags()
 
 	fc := goforth.NewForthCompiler()
 
+	// remote modules are read with the manifest of the project
+	if m, err := goforth.FindManifest("."); err != nil {
+		goforth.PrintError(err)
+	} else {
+		fc.Manifest = m
+	}
+
 	// custom sys func
 	//fc.Fvm.Sysfunc = func(fvm *goforth.ForthVM, syscall int64) {
 	//	switch syscall {
@@ -49,27 +129,42 @@ func main() {
 		goforth.CCurrentDir = true
 	}
 
+	var err error
+
 	if len(script) > 0 {
 		if compile {
-			if err := fc.CompileScript(script); err != nil {
-				goforth.PrintError(err)
-			}
+			err = fc.CompileScript(script)
 		} else {
-			if err := fc.Run(script); err != nil {
-				goforth.PrintError(err)
-			}
+			err = fc.Run(script)
 		}
 	} else if len(fname) > 0 {
 		if compile {
-			if err := fc.CompileFile(fname); err != nil {
-				goforth.PrintError(err)
-			}
+			err = fc.CompileFile(fname)
 		} else {
-			if err := fc.RunFile(fname); err != nil {
-				goforth.PrintError(err)
-			}
+			err = fc.RunFile(fname)
 		}
 	} else {
 		fc.StartREPL()
+		return
 	}
+
+	if err != nil {
+		goforth.PrintError(err)
+		os.Exit(exitStatus(err))
+	}
+
+	// the program stopped with e.g. "1 quit"
+	if fc.Fvm.ExitStatus != 0 {
+		os.Exit(fc.Fvm.ExitStatus)
+	}
+}
+
+// Returns the exit status for err, which is the one of the C binary, if it failed.
+func exitStatus(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+
+	return 1
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/loscoala/goforth"
+)
+
+// goforth mod init [entry] | download | verify | vendor
+//
+// init creates goforth.mod in the current directory. download fetches the
+// required modules into the cache and locks their hashes in goforth.sum,
+// verify checks the cached or vendored modules against goforth.sum and
+// vendor copies them into the vendor directory.
+func runMod(args []string) int {
+	if len(args) == 0 {
+		fmt.Println("usage: goforth mod init [entry] | download | verify | vendor")
+		return 2
+	}
+
+	if args[0] == "init" {
+		entry := "main.fs"
+		if len(args) > 1 {
+			entry = args[1]
+		}
+
+		if goforth.IsFile(goforth.ManifestName) {
+			goforth.PrintError(fmt.Errorf("%s already exists", goforth.ManifestName))
+			return 1
+		}
+
+		if err := os.WriteFile(goforth.ManifestName, []byte("entry "+entry+"\n"), 0644); err != nil {
+			goforth.PrintError(err)
+			return 1
+		}
+
+		return 0
+	}
+
+	m, err := goforth.FindManifest(".")
+	if err != nil {
+		goforth.PrintError(err)
+		return 1
+	}
+
+	if m == nil {
+		goforth.PrintError(fmt.Errorf("no %s found", goforth.ManifestName))
+		return 1
+	}
+
+	switch args[0] {
+	case "download":
+		err = m.Download()
+	case "verify":
+		errs := m.Verify()
+		for _, err := range errs {
+			goforth.PrintError(err)
+		}
+		if len(errs) > 0 {
+			return 1
+		}
+		fmt.Println("all modules verified")
+	case "vendor":
+		err = m.Vendor()
+	default:
+		err = fmt.Errorf("unknown command \"mod %s\"", args[0])
+	}
+
+	if err != nil {
+		goforth.PrintError(err)
+		return 1
+	}
+
+	return 0
+}
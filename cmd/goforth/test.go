@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/loscoala/goforth"
+)
+
+// goforth test [-format tap|junit] [-run regexp] [files or directories]
+//
+// Runs the words starting with "test:" of the files ending in "_test.fs",
+// each in a fresh VM. Without arguments the current directory is searched.
+// The exit code is 1 if a test failed.
+func runTest(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ExitOnError)
+	format := flags.String("format", "tap", "The output format: tap or junit")
+	pattern := flags.String("run", "", "Run only the tests matching the regular expression")
+	flags.Parse(args)
+
+	// the report uses stdout, other output of the compiler goes to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() {
+		os.Stdout = out
+	}()
+
+	var run *regexp.Regexp
+
+	if *pattern != "" {
+		re, err := regexp.Compile(*pattern)
+		if err != nil {
+			goforth.PrintError(err)
+			return 2
+		}
+		run = re
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+
+	files, err := goforth.FindTestFiles(paths)
+	if err != nil {
+		goforth.PrintError(err)
+		return 2
+	}
+
+	results := make([]goforth.TestResult, 0, 50)
+
+	for _, file := range files {
+		fileResults, err := goforth.RunTestFile(file, run)
+		if err != nil {
+			// a file which can not be compiled is a failed test
+			fileResults = []goforth.TestResult{{
+				File:     file,
+				Name:     file,
+				Location: goforth.SourceLocation{File: file},
+				Failures: []goforth.TestFailure{{Location: goforth.SourceLocation{File: file}, Message: err.Error()}},
+			}}
+		}
+		results = append(results, fileResults...)
+	}
+
+	switch *format {
+	case "tap":
+		err = goforth.WriteTAP(out, results)
+	case "junit":
+		err = goforth.WriteJUnit(out, results)
+	default:
+		goforth.PrintError(fmt.Errorf("unknown format %q", *format))
+		return 2
+	}
+
+	if err != nil {
+		goforth.PrintError(err)
+		return 2
+	}
+
+	for _, result := range results {
+		if !result.Passed() {
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/loscoala/goforth"
+)
+
+// goforth which [-I dir] names
+//
+// Prints the file loaded by "use name" for each name. Files of the stdlib
+// are embedded in the binary.
+func runWhich(args []string) int {
+	flags := flag.NewFlagSet("which", flag.ExitOnError)
+	flags.Var((*listFlag)(&goforth.IncludePath), "I", "Add a directory to the search path of use (repeatable)")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Println("usage: goforth which [-I dir] names")
+		return 2
+	}
+
+	fc := goforth.NewForthCompiler()
+	code := 0
+
+	for _, name := range flags.Args() {
+		fsys, path, err := fc.FindFile(name)
+
+		switch {
+		case err != nil:
+			goforth.PrintError(err)
+			code = 1
+		case fsys != nil:
+			fmt.Printf("%s (embedded)\n", path)
+		default:
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+			fmt.Println(path)
+		}
+	}
+
+	return code
+}
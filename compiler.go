@@ -2,18 +2,16 @@ package goforth
 
 import (
 	"fmt"
-	"io"
 	"io/fs"
-	"iter"
 	"maps"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
-	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 // This is the public API for ForthCompiler.
@@ -42,8 +40,56 @@ type ForthCompiler struct {
 	inlines map[string]*Stack[string]
 	clean   bool
 	macros  map[string]*Stack[*Mc]
-	output  strings.Builder
-	Fvm     *ForthVM
+	hosts   map[string]MacroFunc // the macros registered by RegisterMacro
+	statics map[string]*staticData
+	base    int64      // the address of the data segment
+	segment []int64    // the cells of the words defined by create
+	inits   []initCode // the code run before main
+
+	literals    map[string]int64 // the addresses of the string literals
+	literalData []int64          // the string literals stored behind the segment
+
+	classes         map[string]*classInfo
+	interfaces      map[string][]string // the methods of the interfaces
+	selectors       map[string]int      // the vtable indexes of the methods
+	implementations map[string][]string // the words called by "send method"
+	vtables         []string            // the code filling the vtables
+	output          strings.Builder
+	Fvm             *ForthVM
+
+	// The manifest of the project. Remote modules are read from its cache.
+	Manifest *Manifest
+
+	// Disables the OS filesystem and URLs for use and template. Only the
+	// filesystems of SetFS and the stdlib are read.
+	RestrictFS bool
+
+	fsys []fs.FS // the filesystems of SetFS
+
+	noComptime bool // compile-time blocks are removed instead of evaluated
+
+	attributes map[string]string // inline or noinline
+	inlining   map[string]*inlineDecision
+	effects    map[string]string // stack comments of words
+	locations  map[string]SourceLocation
+	origin     *SourceLocation // location of the class while its words are generated
+	docs       map[string]string
+	pendingDoc string // doc comment of the definition being parsed
+
+	scopes     []*moduleScope          // the files being parsed
+	wordScopes map[string]*moduleScope // the scope a word is defined in
+	modules    map[string]string       // the files of the modules
+	loaded     map[string]string       // the modules of the loaded files
+	files      map[string]string       // the keys of the loaded files by name
+	loading    []string                // the keys of the files being loaded
+	aliases    map[string]string       // modules by alias outside of modules
+	private    map[string]bool         // words only visible in their module
+	forwards   map[string]string       // words forwarded to a module
+
+	sources map[string][]string      // the parsed definitions of the words
+	lines   map[string][]int         // the source lines of the tokens of the parsed definitions
+	history map[string][]wordVersion // the earlier definitions of the words
+	markers []*dictSnapshot
 }
 
 func NewForthCompiler() *ForthCompiler {
@@ -95,11 +141,33 @@ func NewForthCompiler() *ForthCompiler {
 			"inc":   "INC",
 			"dec":   "DEC",
 		},
-		funcs:   make(map[string]*Stack[string]),
-		defs:    make(map[string]*Stack[string]),
-		inlines: make(map[string]*Stack[string]),
-		macros:  make(map[string]*Stack[*Mc]),
-		Fvm:     NewForthVM(),
+		funcs:           make(map[string]*Stack[string]),
+		defs:            make(map[string]*Stack[string]),
+		inlines:         make(map[string]*Stack[string]),
+		macros:          make(map[string]*Stack[*Mc]),
+		hosts:           make(map[string]MacroFunc),
+		statics:         make(map[string]*staticData),
+		literals:        make(map[string]int64),
+		classes:         make(map[string]*classInfo),
+		interfaces:      make(map[string][]string),
+		selectors:       make(map[string]int),
+		implementations: make(map[string][]string),
+		Fvm:             NewForthVM(),
+
+		attributes: make(map[string]string),
+		effects:    make(map[string]string),
+		locations:  make(map[string]SourceLocation),
+		docs:       make(map[string]string),
+		wordScopes: make(map[string]*moduleScope),
+		modules:    make(map[string]string),
+		loaded:     make(map[string]string),
+		files:      make(map[string]string),
+		sources:    make(map[string][]string),
+		lines:      make(map[string][]int),
+		history:    make(map[string][]wordVersion),
+		aliases:    make(map[string]string),
+		private:    make(map[string]bool),
+		forwards:   make(map[string]string),
 	}
 }
 
@@ -116,11 +184,42 @@ func (fc *ForthCompiler) Compile() error {
 	fc.output.Reset()
 	fc.label.Reset()
 	fc.blocks.Reset()
+	fc.resetControlStacks()
+	clear(fc.literals)
+	fc.literalData = fc.literalData[:0]
 
-	if err := fc.compileWord("main", result); err != nil {
+	if StackCheck || StrictStackCheck {
+		warnings := fc.CheckStackEffects()
+
+		if StrictStackCheck && len(warnings) > 0 {
+			return fmt.Errorf("stack effect check failed:\n%s", strings.Join(warnings, "\n"))
+		}
+
+		for _, warning := range warnings {
+			PrintWarning(warning)
+		}
+	}
+
+	if TypeCheck {
+		for _, warning := range fc.CheckTypes() {
+			PrintWarning(warning)
+		}
+	}
+
+	fc.planInlining()
+
+	// the startup code stores the string literals found in main
+	code := NewStack[string]()
+	if err := fc.compileWord("main", code); err != nil {
 		return err
 	}
 
+	if err := fc.compileStartup(result); err != nil {
+		return err
+	}
+
+	result.data = append(result.data, code.data...)
+
 	result.Push("L 0")
 	result.Push("STP")
 
@@ -146,14 +245,30 @@ func (fc *ForthCompiler) Compile() error {
 
 // Parses the given Forth code and adds the word to the dictionary of the compiler.
 func (fc *ForthCompiler) Parse(str, filename string) error {
+	scope := &moduleScope{file: filename, key: fc.fileKey(filename)}
+	if IsFile(filename) {
+		scope.dir = filepath.Dir(filename)
+	}
+
+	return fc.parseScope(str, scope)
+}
+
+// Parses str in the scope of the file being parsed, e.g. the words generated by a class.
+func (fc *ForthCompiler) parse(str, filename string) error {
 	var (
 		state   int
 		counter int
 		word    string
+		effect  string
+		defLine int
 		def     *Stack[string]
+		lines   []int // the line of each token of def
 	)
 
 	buffer := make([]rune, 0, 100)
+	comment := make([]rune, 0, 50)
+	doc := make([]string, 0, 5) // "\" comment lines before a definition
+	blank := true
 	line := 1
 	pos := 0
 
@@ -164,64 +279,123 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 			switch i {
 			case ':':
 				state = 1
+				effect = ""
+				defLine = line
 				def = NewStack[string]()
+				lines = nil
+				fc.pendingDoc = strings.Join(doc, "\n")
+				doc = doc[:0]
 			case '\\':
 				state = 4
+				comment = comment[:0]
 			case '(':
 				state = 5
 			case '\r', '\t', ' ':
 			case '\n':
 				line++
 				pos = 1
+				// a blank line ends the doc comment
+				if blank {
+					doc = doc[:0]
+				}
+				blank = true
 			default:
 				state = 6
 				buffer = append(buffer, i)
+				doc = doc[:0]
 			}
 		case 1:
 			switch i {
 			case '(':
 				state = 3
+				comment = comment[:0]
 			case '\\':
 				state = 2
 			case ';':
 				switch word {
 				case "class":
-					if err := fc.compileClass(def, filename); err != nil {
+					// the generated words are located at the class
+					origin := fc.origin
+					if origin == nil {
+						fc.origin = &SourceLocation{File: filename, Line: defLine}
+					}
+					if len(def.data) > 0 {
+						fc.setLocation(fc.qualify(def.data[0]), filename, defLine)
+						fc.setDoc(fc.qualify(def.data[0]))
+					}
+					err := fc.compileClass(def, filename)
+					fc.origin = origin
+					if err != nil {
 						return fmt.Errorf("%s Line %d at %d: %s", filename, line, pos, err.Error())
 					}
 				case "inline":
-					word = def.data[0]
+					word = fc.qualify(def.data[0])
+					fc.unforward(word)
 					if _, ok := fc.defs[word]; ok {
 						return fmt.Errorf("unable to define inline. \"%s\" is already defined as word", word)
 					}
 					tmp := &Stack[string]{data: def.data[1:]}
+					if _, err := fc.macroCompiler().Compile(tmp); err != nil {
+						return fmt.Errorf("%s Line %d at %d: macro \"%s\": %s", filename, line, pos, word, err.Error())
+					}
+					fc.redefine(word, tmp, true)
 					fc.inlines[word] = tmp
 					fc.clean = false
+					fc.setEffect(word, effect)
+					fc.setLocation(word, filename, defLine)
+					fc.setDoc(word)
+					fc.scope().words = append(fc.scope().words, word)
+				case "interface":
+					if err := fc.defineInterface(def); err != nil {
+						return fmt.Errorf("%s Line %d at %d: %s", filename, line, pos, err.Error())
+					}
+				case "override":
+					if len(def.data) == 0 {
+						return fmt.Errorf("%s Line %d at %d: override: missing name", filename, line, pos)
+					}
+					if err := fc.checkOverride(def.data[0]); err != nil {
+						return fmt.Errorf("%s Line %d at %d: %s", filename, line, pos, err.Error())
+					}
+					word = def.data[0]
+					def = &Stack[string]{data: def.data[1:]}
+					lines = lines[1:]
+					fallthrough
 				default:
+					word = fc.qualify(word)
+					fc.unforward(word)
 					if _, ok := fc.inlines[word]; ok {
 						return fmt.Errorf("unable to define word. \"%s\" is already defined as inline", word)
 					}
+					fc.redefine(word, def, false)
 					fc.defs[word] = def
+					fc.lines[word] = lines
+					fc.setEffect(word, effect)
+					fc.setLocation(word, filename, defLine)
+					fc.setDoc(word)
+					fc.wordScopes[word] = fc.scope()
+					fc.scope().words = append(fc.scope().words, word)
 				}
 
 				counter = 0
 				state = 0
+				blank = false
 			case '\n', '\r', '\t', ' ':
-				if i == '\n' {
-					line++
-					pos = 1
-				}
 				if len(buffer) > 0 {
 					if counter == 0 {
 						word = string(buffer)
 					} else {
 						def.Push(string(buffer))
+						lines = append(lines, line)
 					}
 
 					counter++
 					buffer = buffer[:0]
 				}
-			case '.', 'a', 'g':
+				if i == '\n' {
+					line++
+					pos = 1
+				}
+			case '.', 'a', 'g', 's':
 				if index+1 == len(str) {
 					break
 				}
@@ -245,18 +419,38 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 				pos = 1
 			}
 		case 3:
+			if i == '\n' {
+				line++
+				pos = 1
+			}
 			if i == ')' {
 				state = 1
+				// a stack comment directly after the name of the word
+				if (counter == 1 || (word == "inline" || word == "override") && counter == 2) && effect == "" {
+					effect = strings.TrimSpace(string(comment))
+				}
+			} else {
+				comment = append(comment, i)
 			}
 		case 4:
 			if i == '\n' {
 				state = 0
 				line++
 				pos = 1
+				// lines like "\ -----" are no documentation
+				if text := strings.TrimSpace(string(comment)); strings.ContainsFunc(text, unicode.IsLetter) {
+					doc = append(doc, text)
+				}
+				blank = true
+			} else {
+				comment = append(comment, i)
 			}
 		case 5:
 			if i == ')' {
 				state = 0
+			} else if i == '\n' {
+				line++
+				pos = 1
 			}
 		case 6:
 			if i == '\n' {
@@ -266,9 +460,19 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 				if meta == "__END__" {
 					return nil
 				}
-				if err := fc.handleMeta(meta); err != nil {
+				// the words defined by the meta command are located at it
+				origin := fc.origin
+				if origin == nil && isDefiningMeta(meta) {
+					fc.origin = &SourceLocation{File: filename, Line: line}
+				}
+				err := fc.handleMeta(meta)
+				fc.origin = origin
+				if err != nil {
 					return fmt.Errorf("%s Line %d at %d: %s", filename, line, pos, err.Error())
 				}
+				if cmd, name, ok := strings.Cut(meta, " "); ok && cmd == "variable" {
+					fc.setLocation(fc.qualify(name), filename, line)
+				}
 				line++
 				buffer = buffer[:0]
 			} else if i != '\r' {
@@ -284,6 +488,11 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 				break
 			}
 
+			if i == '\n' {
+				line++
+				pos = 1
+			}
+
 			if i == '\\' && str[index+1] == 'n' {
 				buffer = append(buffer, '\n')
 				// consume n
@@ -298,6 +507,7 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 				state = 7
 			} else if i == '"' {
 				def.Push(string(buffer))
+				lines = append(lines, line)
 				buffer = buffer[:0]
 				state = 1
 			}
@@ -311,6 +521,11 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 				break
 			}
 
+			if i == '\n' {
+				line++
+				pos = 1
+			}
+
 			if i == '\\' && str[index+1] == 'n' {
 				buffer = append(buffer, '\n')
 				// consume n
@@ -325,6 +540,7 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 				state = 9
 			} else if i == ')' {
 				def.Push(string(buffer))
+				lines = append(lines, line)
 				buffer = buffer[:0]
 				state = 1
 			}
@@ -355,16 +571,65 @@ func (fc *ForthCompiler) Parse(str, filename string) error {
 	return nil
 }
 
+// The position of a definition in the source code.
+type SourceLocation struct {
+	File string
+	Line int
+}
+
+// Stores where word is defined. Words generated by a class are located at the class.
+func (fc *ForthCompiler) setLocation(word, filename string, line int) {
+	if fc.origin != nil {
+		fc.locations[word] = *fc.origin
+	} else {
+		fc.locations[word] = SourceLocation{File: filename, Line: line}
+	}
+}
+
+// Stores the doc comment read before the definition of word.
+// Words generated by a class keep the doc comment they have.
+func (fc *ForthCompiler) setDoc(word string) {
+	if fc.pendingDoc != "" {
+		fc.docs[word] = fc.pendingDoc
+	} else if fc.origin == nil {
+		delete(fc.docs, word)
+	}
+}
+
+// Stores the stack comment of a word. Comments without "--" are ignored.
+func (fc *ForthCompiler) setEffect(word, effect string) {
+	if strings.Contains(effect, "--") {
+		fc.effects[word] = effect
+	} else {
+		delete(fc.effects, word)
+	}
+}
+
 func (fc *ForthCompiler) evaluateMacro(wordName string, mvm *MacroVM) (*Stack[string], error) {
 	result := NewStack[string]()
 	skip := false
 
-	for word := range fc.defs[wordName].Values() {
-		if _, ok := fc.inlines[word]; ok && !skip {
+	for i, word := range fc.defs[wordName].All() {
+		if fc.isMacro(word) && !skip {
 			// we have found a macro
+			var input []string
+			if TraceMacros {
+				input = slices.Clone(result.data)
+			}
+
+			var err error
+			if _, ok := fc.inlines[word]; ok {
+				err = mvm.Run(fc.macros[word], result)
+			} else {
+				err = mvm.RunFunc(fc.hosts[word], result)
+			}
 
-			if err := mvm.Run(fc.macros[word], result); err != nil {
-				return nil, err
+			if err != nil {
+				return nil, fmt.Errorf("word \"%s\": macro \"%s\" at token %d: %s", wordName, word, i+1, err.Error())
+			}
+
+			if TraceMacros {
+				traceMacro(wordName, word, i+1, input[mvm.rest:], mvm.bindings, result.data[mvm.rest:])
 			}
 
 			skip = true
@@ -377,17 +642,88 @@ func (fc *ForthCompiler) evaluateMacro(wordName string, mvm *MacroVM) (*Stack[st
 	return result, nil
 }
 
-func (fc *ForthCompiler) compileMacros(macroNames []string) {
+// Prints an expansion of macro in word for -trace-macros.
+func traceMacro(word, macro string, token int, input []string, registers map[string]*Stack[string], output []string) {
+	bindings := make([]string, 0, len(registers))
+
+	for _, name := range slices.Sorted(maps.Keys(registers)) {
+		bindings = append(bindings, fmt.Sprintf("%s = %s", name, strings.Join(registers[name].data, " ")))
+	}
+
+	fmt.Printf("macro %s in %s at token %d\n", macro, word, token)
+	fmt.Printf("  input:     %s\n", strings.Join(input, " "))
+	fmt.Printf("  registers: %s\n", strings.Join(bindings, ", "))
+	fmt.Printf("  output:    %s\n", strings.Join(output, " "))
+}
+
+// Expands the macros in the definition of word until none is left. step is
+// called after every expansion, if it is not nil.
+func (fc *ForthCompiler) expandMacros(word string, macroNames []string, mvm *MacroVM, step func()) error {
+	for n := 0; fc.defs[word].ContainsAny(macroNames); n++ {
+		if n == MaxMacroExpansions {
+			next := fc.defs[word].data[slices.IndexFunc(fc.defs[word].data, fc.isMacro)]
+			return fmt.Errorf("word \"%s\": macro expansion does not terminate after %d expansions, next macro \"%s\"", word, n, next)
+		}
+
+		result, err := fc.evaluateMacro(word, mvm)
+		if err != nil {
+			return err
+		}
+
+		fc.defs[word] = result
+
+		if step != nil {
+			step()
+		}
+	}
+
+	return nil
+}
+
+// Registers the Go function f as the macro name. It is expanded by
+// Preprocess like an inline definition: f takes its arguments from the
+// tokens before the macro and returns the tokens replacing them. Inline
+// definitions of the same name take precedence.
+func (fc *ForthCompiler) RegisterMacro(name string, f func(args MacroArgs) ([]string, error)) {
+	fc.hosts[name] = f
+}
+
+// Reports whether word is an inline definition or a registered macro.
+func (fc *ForthCompiler) isMacro(word string) bool {
+	_, ok := fc.inlines[word]
+	return ok || fc.hosts[word] != nil
+}
+
+// Returns the names of the inline definitions and the registered macros.
+func (fc *ForthCompiler) macroNames() []string {
+	return slices.AppendSeq(slices.Collect(maps.Keys(fc.inlines)), maps.Keys(fc.hosts))
+}
+
+// Returns a compiler for macros, which accepts the words of the dictionary starting with @.
+func (fc *ForthCompiler) macroCompiler() *MacroCompiler {
+	return &MacroCompiler{isWord: func(word string) bool {
+		_, ok := fc.data[word]
+		return ok || fc.isDefined(word)
+	}}
+}
+
+func (fc *ForthCompiler) compileMacros(macroNames []string) error {
 	if fc.clean {
-		return
+		return nil
 	}
 
-	var mc MacroCompiler
+	mc := fc.macroCompiler()
 	for _, macro := range macroNames {
-		fc.macros[macro] = mc.Compile(fc.inlines[macro])
+		code, err := mc.Compile(fc.inlines[macro])
+		if err != nil {
+			return fmt.Errorf("macro \"%s\": %s", macro, err.Error())
+		}
+		fc.macros[macro] = code
 	}
 
 	fc.clean = true
+
+	return nil
 }
 
 // Preprocess the definitions of all words
@@ -396,21 +732,32 @@ func (fc *ForthCompiler) Preprocess() error {
 	//   while w contains a macro in its definition:
 	//      evaluate the macro from left to right
 
-	macroNames := slices.Collect(maps.Keys(fc.inlines))
-	fc.compileMacros(macroNames)
+	if err := fc.compileMacros(slices.Collect(maps.Keys(fc.inlines))); err != nil {
+		return err
+	}
+	macroNames := fc.macroNames()
 	mvm := NewMacroVM()
 
-	for word := range fc.defs {
-		for fc.defs[word].ContainsAny(macroNames) {
-			if result, err := fc.evaluateMacro(word, mvm); err != nil {
-				return err
-			} else {
-				fc.defs[word] = result
-			}
+	for _, word := range slices.Sorted(maps.Keys(fc.defs)) {
+		if err := fc.expandMacros(word, macroNames, mvm, nil); err != nil {
+			loc := fc.locations[word]
+			return fmt.Errorf("%s Line %d: %s", loc.File, loc.Line, err.Error())
 		}
 	}
 
-	return nil
+	if err := fc.resolveModuleWords(); err != nil {
+		return err
+	}
+
+	if err := fc.layoutClasses(); err != nil {
+		return err
+	}
+
+	if err := fc.evaluateComptime(); err != nil {
+		return err
+	}
+
+	return fc.layoutStatics()
 }
 
 func (fc *ForthCompiler) ParseTemplate(entry, str, filename string) error {
@@ -422,7 +769,7 @@ func (fc *ForthCompiler) ParseTemplate(entry, str, filename string) error {
 	buffer.Grow(len(str) + len(entry) + 50)
 	buffer.WriteString(": ")
 	buffer.WriteString(entry)
-	buffer.WriteString(" g( ")
+	buffer.WriteString(" s( ")
 
 	gEnd := fmt.Sprintf(") %s:print", entry)
 
@@ -452,7 +799,7 @@ func (fc *ForthCompiler) ParseTemplate(entry, str, filename string) error {
 					i += 1
 				}
 				state = 0
-				buffer.WriteString("g( ")
+				buffer.WriteString("s( ")
 				continue
 			}
 
@@ -465,17 +812,18 @@ func (fc *ForthCompiler) ParseTemplate(entry, str, filename string) error {
 	}
 
 	buffer.WriteString("\n;\n")
-	buffer.WriteString(fmt.Sprintf(": %s:print print ;\n", entry))
+	buffer.WriteString(fmt.Sprintf(": %s:print type ;\n", entry))
 
-	return fc.Parse(buffer.String(), filename)
+	return fc.parse(buffer.String(), filename)
 }
 
+// compile ." ABCDEFGHIJ" to s" ABCDEFGHIJ" type, short strings are emitted
 func compile_s(s *Stack[string], str []rune) {
-	if len(str) > 9 {
-		compile_g(s, str)
-		s.Push("print")
+	if text := str[3 : len(str)-1]; len(text) > 9 {
+		s.Push("s" + string(str[1:]))
+		s.Push("type")
 	} else {
-		for _, i := range str {
+		for _, i := range text {
 			s.Push(fmt.Sprintf("%d", int(i)))
 			s.Push("emit")
 		}
@@ -497,10 +845,10 @@ func reverse(s []rune) []rune {
 	return r
 }
 
-// compile a( ABC) to g( ABC) sv:fromS
+// compile a( ABC) to s( ABC) sv:fromMem
 func compile_a(s *Stack[string], str []rune) {
-	compile_g(s, str)
-	s.Push("sv:fromS")
+	s.Push("s" + string(str[1:]))
+	s.Push("sv:fromMem")
 }
 
 // Loads a forth string onto the stack and terminates it with zero.
@@ -519,9 +867,9 @@ func compile_g(s *Stack[string], str []rune) {
 func handleForthString(s *Stack[string], str []rune) {
 	switch str[0] {
 	case '.':
-		compile_s(s, str[3:len(str)-1])
+		compile_s(s, str)
 	case 'a':
-		compile_a(s, str[3:len(str)-1])
+		compile_a(s, str)
 	case 'g':
 		compile_g(s, str[3:len(str)-1])
 	}
@@ -548,40 +896,27 @@ func ListFiles(dir, ext string) ([]string, error) {
 }
 
 func (fc *ForthCompiler) ReadFile(filename string) ([]byte, error) {
-	if strings.Index(filename, "http://") == 0 ||
-		strings.Index(filename, "https://") == 0 {
-		client := http.Client{
-			Timeout: 5 * time.Second,
+	if isURL(filename) {
+		if fc.RestrictFS {
+			return nil, fmt.Errorf("access to \"%s\" is disabled", filename)
 		}
-		resp, err := client.Get(filename)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-		if resp.ContentLength > 10<<20 { // 10 MiB
-			return nil, fmt.Errorf("file from \"%s\" too large (> 10 MiB)", filename)
+		if fc.Manifest != nil {
+			return fc.Manifest.Fetch(filename)
 		}
 
-		return io.ReadAll(resp.Body)
+		return download(filename)
 	}
 
-	if !IsFile(filename) {
-		if filepath.Ext(filename) == "" {
-			filename += ".fs"
-		}
-
-		if IsFile(filename) {
-			return os.ReadFile(filename)
-		}
+	fsys, path, err := fc.FindFile(filename)
+	if err != nil {
+		return nil, err
+	}
 
-		if data, err := Stdlib.ReadFile("stdlib/" + filename); err != nil {
-			return nil, err
-		} else {
-			return data, nil
-		}
+	if fsys != nil {
+		return fs.ReadFile(fsys, path)
 	}
 
-	return os.ReadFile(filename)
+	return os.ReadFile(path)
 }
 
 func (fc *ForthCompiler) ParseFile(filename string) error {
@@ -591,7 +926,29 @@ func (fc *ForthCompiler) ParseFile(filename string) error {
 		return err
 	}
 
-	return fc.Parse(string(data), filename)
+	scope := &moduleScope{file: filename, key: fc.fileKey(filename)}
+	if layer, file, err := fc.findFile(filename); err == nil {
+		switch layer {
+		case osLayer:
+			scope.dir = filepath.Dir(file)
+		case stdlibLayer:
+		default:
+			scope.layer, scope.dir = layer, path.Dir(file)
+		}
+	}
+
+	fc.loading = append(fc.loading, scope.key)
+	err = fc.parseScope(string(data), scope)
+	fc.loading = fc.loading[:len(fc.loading)-1]
+
+	if err != nil {
+		return err
+	}
+
+	fc.loaded[scope.key] = scope.module
+	fc.files[filename] = scope.key
+
+	return nil
 }
 
 func (fc *ForthCompiler) ParseTemplateFile(entry, filename string) error {
@@ -604,19 +961,51 @@ func (fc *ForthCompiler) ParseTemplateFile(entry, filename string) error {
 	return fc.ParseTemplate(entry, string(data), filename)
 }
 
+// Reports whether the meta command defines words, like constant, create,
+// defer or a defining word. The words loaded by use or template are not.
+func isDefiningMeta(meta string) bool {
+	switch cmd, _, _ := strings.Cut(meta, " "); cmd {
+	case "use", "template", "module", "private", "variable", "inline", "noinline":
+		return false
+	}
+
+	return true
+}
+
 func (fc *ForthCompiler) handleMeta(meta string) error {
 	cmd := strings.Split(meta, " ")
 
 	switch cmd[0] {
 	case "use":
-		return fc.ParseFile(cmd[1])
+		if len(cmd) == 4 && cmd[2] == "as" {
+			return fc.use(cmd[1], cmd[3])
+		}
+		return fc.use(cmd[1], "")
+	case "module":
+		return fc.declareModule(cmd[1])
+	case "private":
+		return fc.declarePrivate(cmd[1:])
 	case "variable":
-		if !fc.vars.Contains(cmd[1]) {
-			fc.vars.Push(cmd[1])
+		name := fc.qualify(cmd[1])
+		if !fc.vars.Contains(name) {
+			fc.vars.Push(name)
 		}
+	case "create":
+		return fc.create(strings.Fields(meta)[1:])
+	case "defer":
+		return fc.deferWord(cmd[1])
 	case "template":
 		return fc.ParseTemplateFile(cmd[1], cmd[2])
+	case "inline", "noinline":
+		words := make([]string, len(cmd)-1)
+		for i, word := range cmd[1:] {
+			words[i] = fc.qualify(word)
+		}
+		return fc.setInlineAttribute(cmd[0], words)
 	default:
+		if ok, err := fc.define(strings.Fields(meta)); ok {
+			return err
+		}
 		return fmt.Errorf("unknown meta command \"%s\"", cmd[0])
 	}
 
@@ -629,26 +1018,51 @@ func (fc *ForthCompiler) compileClass(def *Stack[string], filename string) error
 	}
 
 	clazz := def.data[0]
+	info := &classInfo{name: clazz}
+	values := def.data[1:]
 
-	if def.data[1] == "extends" {
-		base := def.data[2]
+	if def.data[1] == "extends" && len(def.data) > 2 {
+		info.base = fc.resolveClass(def.data[2])
+		values = def.data[3:]
 
-		if _, ok := fc.defs[base+":sizeof"]; !ok {
-			return fmt.Errorf("no base class \"%s\" found", base)
+		if _, ok := fc.defs[info.base+":sizeof"]; !ok {
+			return fmt.Errorf("no base class \"%s\" found", info.base)
 		}
+	}
+
+	values, err := fc.classMembers(clazz, info, values)
+	if err != nil {
+		return err
+	}
+
+	fc.classes[fc.qualify(clazz)] = info
 
-		if err := fc.compileExtendedClass(clazz, base, filename); err != nil {
+	if info.base != "" {
+		if err := fc.compileExtendedClass(clazz, info.base, filename); err != nil {
 			return err
 		}
 
-		if len(def.data) > 3 {
-			return fc.compileBasicClass(clazz, base, filename, def.data[3:])
+		// a class with a vtable needs its own :init
+		if len(values) > 0 || info.virtual {
+			if err := fc.compileBasicClass(clazz, info.base, filename, values); err != nil {
+				return err
+			}
+		} else {
+			info.fields = fc.fieldsOf(info.base)
 		}
 
-		return nil
+		return fc.compileClassTable(clazz, info, filename)
+	}
+
+	if len(values) == 0 && !info.virtual {
+		return fmt.Errorf("a class must have at least one property")
+	}
+
+	if err := fc.compileBasicClass(clazz, "", filename, values); err != nil {
+		return err
 	}
 
-	return fc.compileBasicClass(clazz, "", filename, def.data[1:])
+	return fc.compileClassTable(clazz, info, filename)
 }
 
 // class moo extends foo <1 a 1 b ...>
@@ -663,53 +1077,7 @@ func (fc *ForthCompiler) compileExtendedClass(clazz, base, filename string) erro
 		}
 	}
 
-	return fc.Parse(builder.String(), filename)
-}
-
-type ClazzProperties struct {
-	err error
-}
-
-func (p *ClazzProperties) Err() error {
-	return p.err
-}
-
-func (p *ClazzProperties) Values(values []string) iter.Seq2[int64, string] {
-	return func(yield func(int64, string) bool) {
-		var (
-			size, state int64
-			err         error
-		)
-
-		for value := range slices.Values(values) {
-			switch state {
-			case 0:
-				if isNumeric(value) {
-					state = 1
-					size, err = strconv.ParseInt(value, 10, 64)
-					if err != nil {
-						p.err = err
-						return
-					}
-				} else {
-					size = 1
-					if !yield(size, value) {
-						return
-					}
-				}
-			case 1:
-				if !isNumeric(value) {
-					state = 0
-					if !yield(size, value) {
-						return
-					}
-				} else {
-					p.err = fmt.Errorf("\"%s\" should be a name", value)
-					return
-				}
-			}
-		}
-	}
+	return fc.parse(builder.String(), filename)
 }
 
 // class foo a <b 5 c>
@@ -717,79 +1085,76 @@ func (fc *ForthCompiler) compileBasicClass(clazz, base, filename string, values
 	var (
 		builder strings.Builder
 		offset  int64
-		names   []string
-		sizes   []int64
 	)
 
-	if def, ok := fc.defs[base+":sizeof"]; len(base) > 0 && ok {
-		var err error
+	if size, ok := fc.classSize(base); len(base) > 0 && ok {
+		offset = size
 
-		if offset, err = strconv.ParseInt(def.data[0], 10, 64); err != nil {
-			return err
+		// the vtable slot of the base class is before its fields
+		if fc.isVirtual(base) {
+			offset--
 		}
 	}
 
-	names = make([]string, 0, 10)
-	sizes = make([]int64, 0, 10)
-	props := &ClazzProperties{}
-
-	for size, name := range props.Values(values) {
-		names = append(names, name)
-		sizes = append(sizes, size)
-
-		if size < 1 {
-			return fmt.Errorf("struct member size must be greater than 0. Size was: %d at member: %s", size, name)
-		}
-
-		if offset > 0 {
-			if offset == 1 {
-				fmt.Fprintf(&builder, ": %s:%s 1+ ;\n", clazz, name)
-			} else {
-				fmt.Fprintf(&builder, ": %s:%s %d + ;\n", clazz, name, offset)
-			}
-		} else {
-			fmt.Fprintf(&builder, ": %s:%s ;\n", clazz, name)
-		}
-
-		offset += size
-
-		if size == 1 {
-			// getter
-			fmt.Fprintf(&builder, ": %s:%s %s:%s @ ;\n", clazz, "get"+string(unicode.ToUpper(rune(name[0])))+name[1:], clazz, name)
-			// setter
-			fmt.Fprintf(&builder, ": %s:%s %s:%s ! ;\n", clazz, "set"+string(unicode.ToUpper(rune(name[0])))+name[1:], clazz, name)
-		} else {
-			// getter
-			fmt.Fprintf(&builder, ": %s:%s { self idx value } value self %s:%s idx + @ ;\n", clazz, "get"+string(unicode.ToUpper(rune(name[0])))+name[1:], clazz, name)
-			// setter
-			fmt.Fprintf(&builder, ": %s:%s { self idx value } value self %s:%s idx + ! ;\n", clazz, "set"+string(unicode.ToUpper(rune(name[0])))+name[1:], clazz, name)
-		}
+	fields, err := fc.parseFields(clazz, values, offset)
+	if err != nil {
+		return err
 	}
 
-	if err := props.Err(); err != nil {
-		return err
+	for _, f := range fields {
+		writeAccessors(&builder, clazz, f)
+		offset = f.offset + f.size
 	}
 
 	// clazz:init
 	fmt.Fprintf(&builder, ": %s:init ", clazz)
-	for i, n := range names {
-		if sizes[i] > 1 {
-			fmt.Fprintf(&builder, " dup %d 0 rot %s:%s memset", sizes[i], clazz, n)
-		} else {
-			fmt.Fprintf(&builder, " dup 0 swap %s:%s !", clazz, n)
-		}
+	for _, f := range fields {
+		writeFieldInit(&builder, clazz, f)
 	}
 	if len(base) > 0 {
 		fmt.Fprintf(&builder, " %s:init", base)
 	}
+
+	info := fc.classes[fc.qualify(clazz)]
+	virtual := info != nil && info.virtual
+
+	if virtual {
+		// the vtable slot is the cell before the object
+		fmt.Fprintf(&builder, " dup %s>vtable swap 1- !", clazz)
+		offset++
+	}
 	builder.WriteString(" ;\n")
 
 	// basic methods
 	fmt.Fprintf(&builder, ": %s:sizeof %d ;\n", clazz, offset)
-	fmt.Fprintf(&builder, ": %s:allot %s:sizeof * allot ;\n", clazz, clazz)
+	if virtual {
+		// the vtable slots are set, so send works before :init
+		fmt.Fprintf(&builder, ": %[1]s:allot dup %[1]s:sizeof * allot 1+ swap 0 ?do i over %[1]s:[] %[1]s>vtable swap 1- ! loop ;\n", clazz)
+	} else {
+		fmt.Fprintf(&builder, ": %s:allot %s:sizeof * allot ;\n", clazz, clazz)
+	}
 	fmt.Fprintf(&builder, ": %s:new 1 %s:allot %s:init ;\n", clazz, clazz, clazz)
 	fmt.Fprintf(&builder, ": %s:[] swap %s:sizeof * + ;\n", clazz, clazz)
-	return fc.Parse(builder.String(), filename)
+	if virtual {
+		// the address is set when the vtables are laid out
+		fmt.Fprintf(&builder, ": %s>vtable 0 ;\n", clazz)
+	}
+
+	if info != nil {
+		info.fields = append(fc.fieldsOf(base), fields...)
+		writeObjectWords(&builder, clazz, info.fields, virtual)
+	}
+
+	if err := fc.parse(builder.String(), filename); err != nil {
+		return err
+	}
+
+	if virtual {
+		info.table = fc.qualify(clazz + ">vtable")
+		return fc.setInlineAttribute("inline", []string{info.table})
+	}
+
+	return nil
 }
 
 func (fc *ForthCompiler) compileLocals(iter *StackIter[string], result *Stack[string]) {
@@ -838,21 +1203,82 @@ func (fc *ForthCompiler) compileBlock(iter *StackIter[string], result *Stack[str
 		fc.defs[blockName].Push(word)
 	}
 
-	blockDef := NewStack[string]()
-	blockDef.Push("SUB " + blockName)
-	if err := fc.compileWordWithLocals(blockName, fc.defs[blockName], blockDef); err != nil {
+	if err := fc.compileFunc(blockName, fc.defs[blockName]); err != nil {
 		return err
 	}
-	blockDef.Push("END")
-	fc.funcs[blockName] = blockDef
 	result.Push("REF " + blockName)
 
 	return nil
 }
 
+// Compiles wordDef into a subroutine "SUB word ... END" and stores it in fc.funcs.
+func (fc *ForthCompiler) compileFunc(word string, wordDef *Stack[string]) error {
+	funcDef := NewStack[string]()
+	funcDef.Push("SUB " + word)
+	if err := fc.compileWordWithLocals(word, wordDef, funcDef); err != nil {
+		return err
+	}
+	funcDef.Push("END")
+	optimizeTailCalls(word, funcDef)
+	fc.funcs[word] = funcDef
+	return nil
+}
+
+// Replaces every CALL in tail position with a TAIL jump.
+// A CALL is in tail position if it is followed only by NOPs and LCLRs until END.
+// If the local context has to be cleared, the LCLRs are emitted before the jump.
+// This is only done for self recursion without blocks, since blocks and
+// called words may access the locals of the caller.
+func optimizeTailCalls(word string, funcDef *Stack[string]) {
+	hasBlocks := slices.ContainsFunc(funcDef.data, func(cmd string) bool {
+		return strings.HasPrefix(cmd, "REF ")
+	})
+
+	for i := len(funcDef.data) - 2; i > 0; i-- {
+		callee, ok := strings.CutPrefix(funcDef.data[i], "CALL ")
+		if !ok {
+			continue
+		}
+
+		var (
+			numLclr int
+			tail    bool
+		)
+
+	scan:
+		for _, cmd := range funcDef.data[i+1:] {
+			switch {
+			case cmd == "END":
+				tail = true
+				break scan
+			case cmd == "LCLR":
+				numLclr++
+			case strings.HasPrefix(cmd, "NOP "):
+			default:
+				break scan
+			}
+		}
+
+		if !tail || (numLclr > 0 && (callee != word || hasBlocks)) {
+			continue
+		}
+
+		tcall := make([]string, 0, numLclr+1)
+		for range numLclr {
+			tcall = append(tcall, "LCLR")
+		}
+		tcall = append(tcall, "TAIL "+callee)
+		funcDef.data = slices.Replace(funcDef.data, i, i+1, tcall...)
+	}
+}
+
 func (fc *ForthCompiler) compileWordWithLocals(word string, wordDef *Stack[string], result *Stack[string]) error {
 	var localCounter int
 
+	if err := checkControlFlow(word, wordDef.data, 0); err != nil {
+		return fc.locateControlFlow(err, wordDef.data)
+	}
+
 	for iter := wordDef.Iter(); iter.Next(); {
 		word2 := iter.Get()
 
@@ -863,6 +1289,18 @@ func (fc *ForthCompiler) compileWordWithLocals(word string, wordDef *Stack[strin
 			if err := fc.compileBlock(iter, result); err != nil {
 				return err
 			}
+		} else if word2 == "is" {
+			iter.Next()
+			word2 = iter.Get()
+			if !fc.isDeferred(word2) {
+				return fmt.Errorf("unable to set word \"%s\": not a deferred word", word2)
+			}
+			if _, ok := fc.funcs[word2+">xt"]; !ok {
+				gdef := NewStack[string]()
+				gdef.Push("GDEF " + word2 + ">xt")
+				fc.funcs[word2+">xt"] = gdef
+			}
+			result.Push("GSET " + word2 + ">xt")
 		} else if word2 == "to" {
 			iter.Next()
 			word2 = iter.Get()
@@ -879,13 +1317,27 @@ func (fc *ForthCompiler) compileWordWithLocals(word string, wordDef *Stack[strin
 				return fmt.Errorf("unable to assign word \"%s\": not in local context", word2)
 			}
 			result.Push("LSET " + word2)
+		} else if word2 == "send" || word2 == "super" {
+			if !iter.Next() {
+				return fmt.Errorf("%s: missing method", word2)
+			}
+			tokens, err := fc.methodTokens(word, word2, iter.Get())
+			if err != nil {
+				return err
+			}
+			for _, token := range tokens {
+				if err := fc.compileWord(token, result); err != nil {
+					return err
+				}
+			}
 		} else if word2 == "char" {
 			iter.Next()
 			word2 = iter.Get()
-			if len(word2) > 1 {
+			r, size := utf8.DecodeRuneInString(word2)
+			if size < len(word2) || r == utf8.RuneError {
 				return fmt.Errorf("unable to get code point: \"%s\" is not a one-character", word2)
 			}
-			result.Push(fmt.Sprintf("L %d", int(word2[0])))
+			result.Push(fmt.Sprintf("L %d", r))
 		} else if word2 == "done" {
 			localCounter--
 			fc.locals.ExPop()
@@ -907,6 +1359,165 @@ func (fc *ForthCompiler) compileWordWithLocals(word string, wordDef *Stack[strin
 	return nil
 }
 
+// Clears the state left by a previous compilation which failed.
+func (fc *ForthCompiler) resetControlStacks() {
+	fc.labels.Reset()
+	fc.leaves.Reset()
+	fc.whiles.Reset()
+	fc.dos.Reset()
+	fc.cases.Reset()
+	fc.locals.Reset()
+}
+
+// The words which close a control structure and the words they need to be open.
+var controlClosers = map[string][]string{
+	"else":    {"if"},
+	"then":    {"if", "else"},
+	"of":      {"case"},
+	"?of":     {"case"},
+	"endof":   {"of"},
+	"endcase": {"case"},
+	"while":   {"begin"},
+	"repeat":  {"begin", "while"},
+	"until":   {"begin"},
+	"again":   {"begin"},
+	"loop":    {"do"},
+	"+loop":   {"do"},
+	"-loop":   {"do"},
+}
+
+// An unbalanced control structure at the token pos of the definition of word.
+type controlFlowError struct {
+	word    string
+	message string
+	pos     int
+}
+
+func (e *controlFlowError) Error() string {
+	return fmt.Sprintf("word \"%s\": %s", e.word, e.message)
+}
+
+// Adds the file and the line of the token to the control flow error err
+// found in tokens. Definitions changed by macros are located at their start.
+func (fc *ForthCompiler) locateControlFlow(err *controlFlowError, tokens []string) error {
+	loc, ok := fc.locations[err.word]
+	if !ok {
+		return err
+	}
+
+	if lines := fc.lines[err.word]; len(lines) == len(tokens) {
+		loc.Line = lines[err.pos]
+	}
+
+	return fmt.Errorf("%s Line %d: %s", loc.File, loc.Line, err.Error())
+}
+
+// Checks the nesting of the control structures in the definition of word.
+// Blocks are checked on their own. offset is the position of tokens in the definition.
+func checkControlFlow(word string, tokens []string, offset int) *controlFlowError {
+	type open struct {
+		word string
+		pos  int
+	}
+
+	var (
+		opened []open
+		locals int
+		loops  int
+	)
+
+	errorf := func(pos int, format string, args ...any) *controlFlowError {
+		return &controlFlowError{word, fmt.Sprintf(format, args...), offset + pos}
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		w := tokens[i]
+
+		switch w {
+		case "if", "case", "begin":
+			opened = append(opened, open{w, i})
+		case "do", "?do":
+			opened = append(opened, open{"do", i})
+			loops++
+		case "to", "char":
+			i++
+		case "{":
+			locals++
+			for i++; i < len(tokens) && tokens[i] != "}"; i++ {
+			}
+			if i == len(tokens) {
+				return errorf(i-1, "\"{\" without \"}\"")
+			}
+		case "done":
+			if locals == 0 {
+				return errorf(i, "\"done\" without \"{\"")
+			}
+			locals--
+		case "leave":
+			if loops == 0 {
+				return errorf(i, "\"leave\" outside of a loop")
+			}
+		case "[":
+			depth := 0
+			start := i + 1
+			for i++; i < len(tokens); i++ {
+				if tokens[i] == "[" {
+					depth++
+				} else if tokens[i] == "]" {
+					if depth == 0 {
+						break
+					}
+					depth--
+				}
+			}
+			if i == len(tokens) {
+				return errorf(start-1, "\"[\" without \"]\"")
+			}
+			if err := checkControlFlow(word, tokens[start:i], offset+start); err != nil {
+				return err
+			}
+		case "]":
+			return errorf(i, "\"]\" without \"[\"")
+		default:
+			needed, ok := controlClosers[w]
+			if !ok {
+				continue
+			}
+
+			if len(opened) == 0 || !slices.Contains(needed, opened[len(opened)-1].word) {
+				return errorf(i, "\"%s\" without \"%s\"", w, needed[0])
+			}
+
+			top := &opened[len(opened)-1]
+
+			switch w {
+			case "else", "while":
+				top.word = w
+			case "of", "?of":
+				opened = append(opened, open{"of", i})
+			case "loop", "+loop", "-loop":
+				loops--
+				opened = opened[:len(opened)-1]
+			default:
+				opened = opened[:len(opened)-1]
+			}
+		}
+
+		if w == "begin" {
+			loops++
+		} else if w == "until" || w == "again" || w == "repeat" {
+			loops--
+		}
+	}
+
+	if len(opened) > 0 {
+		last := opened[len(opened)-1]
+		return errorf(last.pos, "\"%s\" is not closed", last.word)
+	}
+
+	return nil
+}
+
 func isFloat(s string) bool {
 	// [-]?[0-9]+[\.][0-9]+?
 	var (
@@ -1007,7 +1618,7 @@ func isString(s string) bool {
 		switch state {
 		case 0:
 			switch i {
-			case '.', 'a', 'g':
+			case '.', 'a', 'g', 's':
 				if index+1 == len(s) {
 					break
 				}
@@ -1042,7 +1653,11 @@ func isString(s string) bool {
 }
 
 func (fc *ForthCompiler) compileWord(word string, result *Stack[string]) error {
-	if isString(word) {
+	if isString(word) && word[0] == 's' {
+		addr, length := fc.literal([]rune(word))
+		result.Push(fmt.Sprintf("L %d", addr))
+		result.Push(fmt.Sprintf("L %d", length))
+	} else if isString(word) {
 		tmp := NewStack[string]()
 		handleForthString(tmp, []rune(word))
 		for value := range tmp.Values() {
@@ -1128,15 +1743,11 @@ func (fc *ForthCompiler) compileWord(word string, result *Stack[string]) error {
 			result.Push(value)
 		}
 	} else if wordDef, ok := fc.defs[word]; ok {
-		if word != "main" && wordDef.Len() > 4 {
+		if word != "main" && !fc.shouldInline(word) {
 			if _, ok := fc.funcs[word]; !ok {
-				funcDef := NewStack[string]()
-				funcDef.Push("SUB " + word)
-				if err := fc.compileWordWithLocals(word, wordDef, funcDef); err != nil {
+				if err := fc.compileFunc(word, wordDef); err != nil {
 					return err
 				}
-				funcDef.Push("END")
-				fc.funcs[word] = funcDef
 			}
 
 			result.Push("CALL " + word)
@@ -1149,13 +1760,9 @@ func (fc *ForthCompiler) compileWord(word string, result *Stack[string]) error {
 		realWord := word[1:]
 		if wordDef, ok := fc.defs[realWord]; ok {
 			if _, ok := fc.funcs[realWord]; !ok {
-				funcDef := NewStack[string]()
-				funcDef.Push("SUB " + realWord)
-				if err := fc.compileWordWithLocals(realWord, wordDef, funcDef); err != nil {
+				if err := fc.compileFunc(realWord, wordDef); err != nil {
 					return err
 				}
-				funcDef.Push("END")
-				fc.funcs[realWord] = funcDef
 			}
 		} else {
 			return fmt.Errorf("unable to reference word \"%s\": Unknown word", realWord)
@@ -1256,6 +1863,8 @@ func (fc *ForthCompiler) compileWord(word string, result *Stack[string]) error {
 		if word == "repeat" && fc.whiles.Len() > 0 {
 			result.Push("NOP #" + fc.whiles.ExPop())
 		}
+	} else if word == "create" || word == "does>" {
+		return fmt.Errorf("\"%s\" is only allowed in defining words used by meta commands", word)
 	} else {
 		return fmt.Errorf("word \"%s\" unknown", word)
 	}
@@ -0,0 +1,184 @@
+package goforth
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Compile-time evaluation. The code between "[[" and "]]" in a definition
+// is run by Preprocess on a scratch ForthVM, after the macros are expanded:
+//
+//	: table [[ 0 10 0 do i i * + loop ]] ;
+//
+// The block is replaced by the output of the code split at whitespace,
+// followed by the cells left on the stack as integer literals. So it may
+// compute constants or generate code. The code is an own definition, the
+// locals of the enclosing word are not visible in it.
+
+// An error of the compile-time blocks of word.
+type comptimeError struct {
+	word string
+	err  error
+}
+
+func (e *comptimeError) Error() string {
+	return e.err.Error()
+}
+
+// Evaluates the compile-time blocks of the definitions reachable from main.
+// Errors are located at the word whose block failed.
+func (fc *ForthCompiler) evaluateComptime() error {
+	words := make([]string, 0, 10)
+
+	for word := range fc.reachable("main") {
+		if def := fc.defs[word]; def != nil && def.Contains("[[") {
+			words = append(words, word)
+		}
+	}
+
+	slices.Sort(words)
+	pending := make(map[string]bool)
+
+	for _, word := range words {
+		if err := fc.comptime(word, pending); err != nil {
+			if e, ok := err.(*comptimeError); ok {
+				loc := fc.locations[e.word]
+				return fmt.Errorf("%s Line %d: %s", loc.File, loc.Line, e.Error())
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replaces the compile-time blocks of word by their results. The words
+// used by a block are evaluated first. pending holds the words being
+// evaluated to detect cycles.
+func (fc *ForthCompiler) comptime(word string, pending map[string]bool) error {
+	def := fc.defs[word]
+	if def == nil || !def.Contains("[[") {
+		return nil
+	}
+
+	if pending[word] {
+		return fmt.Errorf("word \"%s\": compile-time evaluation depends on itself", word)
+	}
+
+	pending[word] = true
+	defer delete(pending, word)
+
+	result := NewStack[string]()
+
+	for i := 0; i < len(def.data); i++ {
+		if def.data[i] != "[[" {
+			if def.data[i] == "]]" {
+				return fmt.Errorf("word \"%s\": \"]]\" without \"[[\"", word)
+			}
+			result.Push(def.data[i])
+			continue
+		}
+
+		end := slices.Index(def.data[i+1:], "]]")
+		if end < 0 {
+			return fmt.Errorf("word \"%s\": missing \"]]\"", word)
+		}
+
+		code := def.data[i+1 : i+1+end]
+		if slices.Contains(code, "[[") {
+			return fmt.Errorf("word \"%s\": nested \"[[\"", word)
+		}
+
+		if !fc.noComptime {
+			tokens, err := fc.evaluate(word, code, pending)
+			if _, ok := err.(*comptimeError); err != nil && !ok {
+				return &comptimeError{word, err}
+			} else if err != nil {
+				return err
+			}
+			result.data = append(result.data, tokens...)
+		}
+
+		i += end + 1
+	}
+
+	fc.defs[word] = result
+
+	return nil
+}
+
+// Runs code of a block in word as main on a new VM and returns its output
+// and stack as tokens.
+func (fc *ForthCompiler) evaluate(word string, code []string, pending map[string]bool) ([]string, error) {
+	fvm, out, err := fc.runComptime(word, code, pending)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := strings.Fields(out)
+
+	for _, cell := range fvm.Stack {
+		tokens = append(tokens, strconv.FormatInt(cell, 10))
+	}
+
+	return tokens, nil
+}
+
+// Runs code in word as main on a new VM and returns the VM and the output.
+func (fc *ForthCompiler) runComptime(word string, code []string, pending map[string]bool) (*ForthVM, string, error) {
+	realMain, hasMain := fc.defs["main"]
+
+	defer func() {
+		if hasMain {
+			fc.defs["main"] = realMain
+		} else {
+			delete(fc.defs, "main")
+		}
+	}()
+
+	fc.defs["main"] = &Stack[string]{data: slices.Clone(code)}
+
+	for _, callee := range slices.Sorted(maps.Keys(fc.reachable("main"))) {
+		if callee == "main" {
+			continue
+		}
+		if err := fc.comptime(callee, pending); err != nil {
+			return nil, "", err
+		}
+	}
+
+	fail := func(err error) (*ForthVM, string, error) {
+		return nil, "", fmt.Errorf("word \"%s\": compile-time evaluation failed: %s", word, err.Error())
+	}
+
+	// the checks and reports are done when the program is compiled
+	stackCheck, strictStackCheck, typeCheck, showInlining := StackCheck, StrictStackCheck, TypeCheck, ShowInlining
+	StackCheck, StrictStackCheck, TypeCheck, ShowInlining = false, false, false, false
+	err := fc.Compile()
+	StackCheck, StrictStackCheck, TypeCheck, ShowInlining = stackCheck, strictStackCheck, typeCheck, showInlining
+
+	if err != nil {
+		return fail(err)
+	}
+
+	var out bytes.Buffer
+
+	fvm := NewForthVM()
+	fvm.Sysfunc = fc.Fvm.Sysfunc
+	fvm.Out = &out
+	fvm.MaxSteps = MaxComptimeSteps
+
+	if err := runCode(fvm, fc.ByteCode()); err != nil {
+		return fail(err)
+	}
+
+	if fvm.ExitStatus != 0 {
+		return fail(fmt.Errorf("exit status: %d", fvm.ExitStatus))
+	}
+
+	return fvm, out.String(), nil
+}
@@ -0,0 +1,29 @@
+package goforth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestComptimeSteps(t *testing.T) {
+	defer func(max int64) { MaxComptimeSteps = max }(MaxComptimeSteps)
+	MaxComptimeSteps = 100000
+
+	// blocks of words which are not reachable from main are not run
+	if got := runVM(t, ": forever [[ begin 0 until ]] ; : main 1 . ;"); got != "1" {
+		t.Errorf("got %q, want %q", got, "1")
+	}
+
+	fc := NewForthCompiler()
+	if err := fc.ParseFile("core"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := fc.Run(": main forever ;\n: forever [[ begin 0 until ]] ;")
+	if err == nil {
+		t.Fatal("got no error for a block which does not stop")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Line 2:") || !strings.Contains(msg, `word "forever"`) {
+		t.Errorf("got %q, want the location of forever", msg)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"embed"
 	"log"
 	"os"
+	"time"
 )
 
 // Colored output
@@ -18,6 +19,42 @@ var ShowByteCode bool
 // Show execution time in vm.Run
 var ShowExecutionTime bool
 
+// Show the decisions of the inlining policy in Compile
+var ShowInlining bool
+
+// The maximum number of cells of a word to be inlined
+var InlineMaxCost = 8
+
+// The maximum number of cells inlining of a word may add to the program
+var InlineMaxGrowth = 64
+
+// Print the input, the registers and the output of every macro expansion in Preprocess
+var TraceMacros bool
+
+// The maximum number of macro expansions in a definition before Preprocess gives up
+var MaxMacroExpansions = 10000
+
+// The maximum number of VM commands a compile-time block may run
+var MaxComptimeSteps int64 = 10000000
+
+// Check the stack effects of words in Compile and print warnings
+var StackCheck = true
+
+// Stack effect warnings are reported as errors by Compile
+var StrictStackCheck bool
+
+// Check the use of int and float cells in Compile and print warnings
+var TypeCheck bool
+
+// Directories searched by use before GOFORTH_PATH
+var IncludePath []string
+
+// The timeout of downloads of remote modules
+var DownloadTimeout = 5 * time.Second
+
+// The maximum size of a remote module in bytes
+var MaxDownloadSize = 10 << 20
+
 // The name of the C compiler
 var CCompiler = "cc"
 
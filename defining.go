@@ -0,0 +1,382 @@
+package goforth
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Defining words. They are meta commands defining a word by the code
+// before or after them:
+//
+//	10 20 * constant size
+//	0 value counter
+//	create primes 2 , 3 , 5 , 7 ,
+//	defer greet
+//	&hello is greet
+//
+// A constant is an inline word, so its value is folded to a literal. A
+// value is a variable set by its code when the program starts. create
+// places its cells in the data segment at the start of Mem, which is
+// initialized before main runs, and defines a word pushing their address.
+// A definition starting with create is a defining word:
+//
+//	: counter create , does> @ ;
+//	5 counter five
+//
+// Its code up to does> stores the cells of the new word at compile time,
+// with the code before the name of the new word as arguments. The new word
+// pushes the address of its cells and runs the code after does>. A
+// deferred word executes the word stored by is.
+
+// The cells of a word defined by create or a defining word.
+type staticData struct {
+	code    []string // the code storing the cells with "," and "allot"
+	definer string   // the defining word, its code up to does> runs after code
+}
+
+// Code run when the program starts, e.g. the initial value of a value.
+type initCode struct {
+	name string // the variable set by the code
+	code []string
+}
+
+// Handles the meta commands "code constant name", "code value name",
+// "code is name" and "args definer name" of a defining word definer.
+// Returns false if words is none of them.
+func (fc *ForthCompiler) define(words []string) (bool, error) {
+	if len(words) < 2 {
+		return false, nil
+	}
+
+	n := len(words)
+	cmd, name, code := words[n-2], words[n-1], words[:n-2]
+
+	switch {
+	case cmd == "constant", cmd == "value", cmd == "is":
+		if len(code) == 0 {
+			return true, fmt.Errorf("%s \"%s\" needs a value", cmd, name)
+		}
+	case fc.isDefiningWord(fc.resolveWord(cmd)):
+		cmd = fc.resolveWord(cmd)
+	default:
+		return false, nil
+	}
+
+	if !isValidWord(name) {
+		return true, fmt.Errorf("%s: invalid name \"%s\"", cmd, name)
+	}
+
+	switch cmd {
+	case "constant":
+		if err := fc.parse(fmt.Sprintf(": %s %s ;", name, strings.Join(code, " ")), fc.scope().file); err != nil {
+			return true, err
+		}
+		return true, fc.setInlineAttribute("inline", []string{fc.qualify(name)})
+	case "value":
+		if err := fc.handleMeta("variable " + name); err != nil {
+			return true, err
+		}
+		fc.setInit(fc.qualify(name), code)
+		if fc.origin != nil {
+			fc.setLocation(fc.qualify(name), "", 0)
+		}
+		return true, nil
+	case "is":
+		word := fc.resolveWord(name)
+		if !fc.isDeferred(word) {
+			return true, fmt.Errorf("is: \"%s\" is not a deferred word", name)
+		}
+		fc.setInit(word+">xt", code)
+		return true, nil
+	default:
+		return true, fc.createWord(name, &staticData{code: code, definer: cmd})
+	}
+}
+
+// Handles the meta command "create name code".
+func (fc *ForthCompiler) create(words []string) error {
+	if len(words) == 0 || !isValidWord(words[0]) {
+		return fmt.Errorf("create: missing name")
+	}
+
+	return fc.createWord(words[0], &staticData{code: words[1:]})
+}
+
+// Defines name as a word pushing the address of its cells. Its definition
+// is completed when the data segment is laid out by Preprocess.
+func (fc *ForthCompiler) createWord(name string, data *staticData) error {
+	if err := fc.parse(fmt.Sprintf(": %s 0 ;", name), fc.scope().file); err != nil {
+		return err
+	}
+
+	word := fc.qualify(name)
+	fc.statics[word] = data
+
+	if data.definer == "" || !slices.Contains(fc.defs[data.definer].data, "does>") {
+		return fc.setInlineAttribute("inline", []string{word})
+	}
+
+	delete(fc.attributes, word)
+
+	return nil
+}
+
+// Handles the meta command "defer name".
+func (fc *ForthCompiler) deferWord(name string) error {
+	if !isValidWord(name) {
+		return fmt.Errorf("defer: missing name")
+	}
+
+	if err := fc.handleMeta("variable " + name + ">xt"); err != nil {
+		return err
+	}
+
+	// -1 is no address of a word, the first word may be at 0
+	fc.setInit(fc.qualify(name)+">xt", []string{"-1"})
+
+	return fc.parse(fmt.Sprintf(": %[1]s %[1]s>xt dup -1 = if drop .\" deferred word %[1]s is not set\" 10 emit 1 quit else exec then ;", name), fc.scope().file)
+}
+
+// Reports whether text is a meta command of a defining word, e.g. in the REPL.
+func (fc *ForthCompiler) isDefinition(text string) bool {
+	words := strings.Fields(text)
+
+	if len(words) > 1 && (words[0] == "create" || words[0] == "defer") {
+		return true
+	}
+
+	if len(words) < 3 {
+		return false
+	}
+
+	cmd := words[len(words)-2]
+
+	return cmd == "constant" || cmd == "value" || cmd == "is" || fc.isDefiningWord(fc.resolveWord(cmd))
+}
+
+// Reports whether word is defined by defer.
+func (fc *ForthCompiler) isDeferred(word string) bool {
+	return fc.defs[word] != nil && fc.vars.Contains(word+">xt")
+}
+
+// Reports whether word is a definition starting with create.
+func (fc *ForthCompiler) isDefiningWord(word string) bool {
+	def := fc.defs[word]
+	return def != nil && def.Len() > 0 && def.data[0] == "create"
+}
+
+// Returns the word name refers to in the current scope, or name.
+func (fc *ForthCompiler) resolveWord(name string) string {
+	if word, err := fc.resolveUnqualified(fc.scope(), name); err == nil && word != "" {
+		return word
+	}
+
+	return name
+}
+
+// Sets the code run when the program starts to set the variable name.
+func (fc *ForthCompiler) setInit(name string, code []string) {
+	init := initCode{name: name, code: slices.Clone(code)}
+
+	if i := slices.IndexFunc(fc.inits, func(c initCode) bool { return c.name == name }); i >= 0 {
+		fc.inits[i] = init
+	} else {
+		fc.inits = append(fc.inits, init)
+	}
+}
+
+// Lays out the cells of the words defined by create in the data segment
+// behind the vtables and completes their definitions with their addresses.
+func (fc *ForthCompiler) layoutStatics() error {
+	for _, word := range slices.Sorted(maps.Keys(fc.statics)) {
+		data := fc.statics[word]
+		addr := fc.base + int64(len(fc.segment))
+		code := slices.Clone(data.code)
+		def := &Stack[string]{data: []string{strconv.FormatInt(addr, 10)}}
+
+		if data.definer != "" {
+			definer := fc.defs[data.definer]
+			if definer == nil || definer.Len() == 0 || definer.data[0] != "create" {
+				return fmt.Errorf("word \"%s\": the defining word \"%s\" is unknown", word, data.definer)
+			}
+			end := slices.Index(definer.data, "does>")
+			if end < 0 {
+				end = definer.Len()
+			} else {
+				def.data = append(def.data, definer.data[end+1:]...)
+			}
+			code = append(code, definer.data[1:end]...)
+		}
+
+		fc.defs[word] = def
+
+		cells, err := fc.staticCells(word, addr, code)
+		if err != nil {
+			loc := fc.locations[word]
+			return fmt.Errorf("%s Line %d: %s", loc.File, loc.Line, err.Error())
+		}
+
+		fc.segment = append(fc.segment, cells...)
+	}
+
+	return nil
+}
+
+// Returns the cells stored by code for word at addr. Numbers stored by ","
+// or "n allot" are read directly, other code is run at compile time.
+func (fc *ForthCompiler) staticCells(word string, addr int64, code []string) ([]int64, error) {
+	if cells, ok := literalCells(code); ok {
+		return cells, nil
+	}
+
+	if fc.noComptime {
+		return nil, nil
+	}
+
+	if !fc.vars.Contains("here") {
+		return nil, fmt.Errorf("word \"%s\": only numbers can be stored without the core words", word)
+	}
+
+	main := append([]string{strconv.FormatInt(addr, 10), "to", "here"}, code...)
+
+	fvm, _, err := fc.runComptime(word, main, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	here := fvm.Vars["here"]
+	if here < addr || here > int64(len(fvm.Mem)) {
+		return nil, fmt.Errorf("word \"%s\": here is outside of the cells stored", word)
+	}
+
+	return slices.Clone(fvm.Mem[addr:here]), nil
+}
+
+// Returns the cells of code consisting of "n ," and "n allot" only.
+func literalCells(code []string) ([]int64, bool) {
+	cells := make([]int64, 0, len(code)/2)
+
+	for i := 0; i < len(code); i += 2 {
+		if i+1 == len(code) {
+			return nil, false
+		}
+
+		switch value, op := code[i], code[i+1]; {
+		case op == "," && isNumeric(value):
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			cells = append(cells, n)
+		case op == "," && isFloat(value):
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, false
+			}
+			cells = append(cells, int64(math.Float64bits(f)))
+		case op == "allot" && isNumeric(value):
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			cells = append(cells, make([]int64, n)...)
+		default:
+			return nil, false
+		}
+	}
+
+	return cells, true
+}
+
+// Returns the address and length of the string literal s" text" or
+// s( text). Each literal is stored once behind the data segment, one code
+// point per cell.
+func (fc *ForthCompiler) literal(word []rune) (int64, int64) {
+	text := string(word[3 : len(word)-1])
+	length := int64(len(word) - 4)
+
+	addr, ok := fc.literals[text]
+	if !ok {
+		addr = fc.base + int64(len(fc.segment)+len(fc.literalData))
+		fc.literals[text] = addr
+		for _, r := range text {
+			fc.literalData = append(fc.literalData, int64(r))
+		}
+	}
+
+	return addr, length
+}
+
+// Returns the address of the data segment. Cell 0 is left out, so 0 is no
+// address of a vtable, the metadata of a class or a word defined by create.
+// The VM of the REPL keeps its memory between runs, so the segment is
+// placed behind the cells allotted and the heap of the runs before.
+func (fc *ForthCompiler) segmentBase() int64 {
+	return max(1, fc.Fvm.Vars["here"], fc.Fvm.heapEnd())
+}
+
+// Compiles the code run before main: the data segment and the string
+// literals are stored at its base, here is moved behind them and the values
+// are initialized.
+func (fc *ForthCompiler) compileStartup(result *Stack[string]) error {
+	// the literals of the initializations are stored with the others
+	inits := NewStack[string]()
+
+	if len(fc.vtables) > 0 {
+		code := &Stack[string]{data: slices.Clone(fc.vtables)}
+		if err := fc.compileWordWithLocals("", code, inits); err != nil {
+			return fmt.Errorf("vtables: %s", err.Error())
+		}
+	}
+
+	for _, init := range fc.inits {
+		code := &Stack[string]{data: append(slices.Clone(init.code), "to", init.name)}
+		if err := fc.compileWordWithLocals("", code, inits); err != nil {
+			return fmt.Errorf("initialization of \"%s\": %s", strings.TrimSuffix(init.name, ">xt"), err.Error())
+		}
+	}
+
+	segment := append(slices.Clone(fc.segment), fc.literalData...)
+
+	if len(segment) > 0 {
+		end := fc.base + int64(len(segment))
+		// allocate the data segment, if Mem is smaller
+		lbl := fc.label.CreateNewLabel()
+		result.Push("L 11")
+		result.Push("SYS")
+		result.Push(fmt.Sprintf("L %d", end))
+		result.Push("LSI")
+		result.Push("JIN #" + lbl)
+		result.Push(fmt.Sprintf("L %d", end))
+		result.Push("L 10")
+		result.Push("SYS")
+		result.Push("NOP #" + lbl)
+
+		for addr, cell := range segment {
+			result.Push(fmt.Sprintf("L %d", cell))
+			result.Push(fmt.Sprintf("L %d", fc.base+int64(addr)))
+			result.Push("STR")
+		}
+
+		if fc.vars.Contains("here") {
+			lbl := fc.label.CreateNewLabel()
+			if err := fc.compileWord("here", result); err != nil {
+				return err
+			}
+			result.Push(fmt.Sprintf("L %d", end))
+			result.Push("LSI")
+			result.Push("JIN #" + lbl)
+			result.Push(fmt.Sprintf("L %d", end))
+			result.Push("GSET here")
+			result.Push("NOP #" + lbl)
+		}
+	}
+
+	result.data = append(result.data, inits.data...)
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package goforth
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Runs the programs one after another in the same VM like the REPL and
+// returns the output of each program.
+func runSession(t *testing.T, progs ...string) []string {
+	t.Helper()
+
+	fc := NewForthCompiler()
+	if err := fc.ParseFile("core"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	fc.Fvm.Out = &out
+	outputs := make([]string, 0, len(progs))
+
+	for _, prog := range progs {
+		out.Reset()
+		if err := fc.Run(prog); err != nil {
+			t.Fatalf("%s: %v", prog, err)
+		}
+		outputs = append(outputs, out.String())
+	}
+
+	return outputs
+}
+
+func TestSegmentAcrossRuns(t *testing.T) {
+	// the data segment of a run must not overwrite the cells allotted by
+	// the runs before
+	got := runSession(t,
+		"variable h\n"+`: main 4 allot to h 42 h ! 43 h 1+ ! ;`,
+		`: main s" abcdef" type h @ . h 1+ @ . ;`,
+		"create c 7 ,\n"+`: main c @ . s" xyz" type h @ . h 1+ @ . ;`,
+	)
+	want := []string{"", "abcdef4243", "7xyz4243"}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: got %q, want %q", i+1, got[i], want[i])
+		}
+	}
+}
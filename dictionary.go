@@ -0,0 +1,299 @@
+package goforth
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Dictionary management. "marker name" takes a snapshot of the dictionary
+// and the REPL command "name" rolls back to it. "forget word" removes a
+// word. Every redefinition keeps the previous version of the word in its
+// history, which "% name" shows and "restore name n" brings back.
+
+// An earlier definition of a word.
+type wordVersion struct {
+	def      *Stack[string] // the definition as compiled
+	source   []string       // the definition as parsed
+	inline   bool
+	effect   string
+	doc      string
+	location SourceLocation
+}
+
+// A snapshot of the dictionary taken by "marker name".
+type dictSnapshot struct {
+	name       string
+	defs       map[string]*Stack[string]
+	inlines    map[string]*Stack[string]
+	macros     map[string]*Stack[*Mc]
+	vars       []string
+	attributes map[string]string
+	effects    map[string]string
+	locations  map[string]SourceLocation
+	docs       map[string]string
+	sources    map[string][]string
+	lines      map[string][]int
+	history    map[string][]wordVersion
+	wordScopes map[string]*moduleScope
+	modules    map[string]string
+	loaded     map[string]string
+	files      map[string]string
+	aliases    map[string]string
+	private    map[string]bool
+	forwards   map[string]string
+	statics    map[string]*staticData
+	inits      []initCode
+	classes    map[string]*classInfo
+	interfaces map[string][]string
+}
+
+// Records that word is defined as def. The current definition is kept in
+// the history of word, if it is different. Words using word are reported,
+// because they are changed, too.
+func (fc *ForthCompiler) redefine(word string, def *Stack[string], inline bool) {
+	source := slices.Clone(def.data)
+	old, ok := fc.sources[word]
+	fc.sources[word] = source
+
+	if !ok || word == "main" || slices.Equal(old, source) {
+		return
+	}
+
+	fc.history[word] = append(fc.history[word], fc.currentVersion(word, old))
+
+	// A class redefines all its generated words, e.g. :print, at once and
+	// the user may replace them, so neither is reported.
+	if fc.origin != nil || fc.isClassMember(word) {
+		return
+	}
+
+	// the words of a class are redefined together with the class
+	users := fc.usersOf(word)
+	if clazz := fc.classOf(word); clazz != "" {
+		users = slices.DeleteFunc(users, func(user string) bool { return fc.classOf(user) == clazz })
+	}
+
+	if len(users) > 0 {
+		PrintWarning(fmt.Sprintf("redefinition of \"%s\" changes %s", word, strings.Join(users, ", ")))
+	}
+}
+
+// Returns the current definition of word.
+func (fc *ForthCompiler) currentVersion(word string, source []string) wordVersion {
+	v := wordVersion{
+		source:   source,
+		effect:   fc.effects[word],
+		doc:      fc.docs[word],
+		location: fc.locations[word],
+	}
+
+	if def, ok := fc.inlines[word]; ok {
+		v.def, v.inline = def, true
+	} else {
+		v.def = fc.defs[word]
+	}
+
+	return v
+}
+
+// Returns the words using word in their definitions, except main.
+func (fc *ForthCompiler) usersOf(word string) []string {
+	users := make([]string, 0, 10)
+
+	for _, dict := range []map[string]*Stack[string]{fc.defs, fc.inlines} {
+		for name, def := range dict {
+			if name == word || name == "main" || slices.Contains(users, name) {
+				continue
+			}
+			if def.Contains(word) || def.Contains("&"+word) {
+				users = append(users, name)
+			}
+		}
+	}
+
+	slices.Sort(users)
+
+	return users
+}
+
+// Removes word from the dictionary. A word used by other words is kept.
+func (fc *ForthCompiler) forget(word string) error {
+	if fc.defs[word] == nil && fc.inlines[word] == nil && !fc.vars.Contains(word) {
+		return fmt.Errorf("unknown word \"%s\"", word)
+	}
+
+	if users := fc.usersOf(word); len(users) > 0 {
+		return fmt.Errorf("\"%s\" is used by %s", word, strings.Join(users, ", "))
+	}
+
+	fc.vars.data = slices.DeleteFunc(fc.vars.data, func(name string) bool { return name == word })
+
+	for _, m := range []map[string]*Stack[string]{fc.defs, fc.inlines} {
+		delete(m, word)
+	}
+
+	for _, m := range []map[string]string{fc.attributes, fc.effects, fc.docs, fc.forwards} {
+		delete(m, word)
+	}
+
+	delete(fc.macros, word)
+	delete(fc.locations, word)
+	delete(fc.sources, word)
+	delete(fc.lines, word)
+	delete(fc.history, word)
+	delete(fc.wordScopes, word)
+	delete(fc.private, word)
+	delete(fc.statics, word)
+	fc.inits = slices.DeleteFunc(fc.inits, func(c initCode) bool { return c.name == word || c.name == word+">xt" })
+	fc.clean = false
+
+	return nil
+}
+
+// Makes the n-th earlier definition of word the current one. The current
+// definition is kept in the history.
+func (fc *ForthCompiler) restore(word string, n int) error {
+	history := fc.history[word]
+
+	if len(history) == 0 {
+		return fmt.Errorf("\"%s\" has no earlier definitions", word)
+	}
+
+	if n < 1 || n > len(history) {
+		return fmt.Errorf("\"%s\" has no earlier definition %d", word, n)
+	}
+
+	v := history[n-1]
+	history = slices.Delete(history, n-1, n)
+	fc.history[word] = append(history, fc.currentVersion(word, fc.sources[word]))
+
+	delete(fc.defs, word)
+	delete(fc.inlines, word)
+
+	if v.inline {
+		fc.inlines[word] = v.def
+	} else {
+		fc.defs[word] = v.def
+	}
+
+	fc.sources[word] = v.source
+	fc.locations[word] = v.location
+	delete(fc.lines, word)
+	fc.setEffect(word, v.effect)
+
+	if v.doc != "" {
+		fc.docs[word] = v.doc
+	} else {
+		delete(fc.docs, word)
+	}
+
+	fc.clean = false
+
+	if users := fc.usersOf(word); len(users) > 0 {
+		PrintWarning(fmt.Sprintf("restoring \"%s\" changes %s", word, strings.Join(users, ", ")))
+	}
+
+	return nil
+}
+
+// Takes a snapshot of the dictionary named name.
+func (fc *ForthCompiler) marker(name string) error {
+	if !isValidWord(name) {
+		return fmt.Errorf("invalid marker name \"%s\"", name)
+	}
+
+	fc.markers = slices.DeleteFunc(fc.markers, func(s *dictSnapshot) bool { return s.name == name })
+	fc.markers = append(fc.markers, &dictSnapshot{
+		name:       name,
+		defs:       maps.Clone(fc.defs),
+		inlines:    maps.Clone(fc.inlines),
+		macros:     maps.Clone(fc.macros),
+		vars:       slices.Clone(fc.vars.data),
+		attributes: maps.Clone(fc.attributes),
+		effects:    maps.Clone(fc.effects),
+		locations:  maps.Clone(fc.locations),
+		docs:       maps.Clone(fc.docs),
+		sources:    maps.Clone(fc.sources),
+		lines:      maps.Clone(fc.lines),
+		history:    cloneHistory(fc.history),
+		wordScopes: maps.Clone(fc.wordScopes),
+		modules:    maps.Clone(fc.modules),
+		loaded:     maps.Clone(fc.loaded),
+		files:      maps.Clone(fc.files),
+		aliases:    maps.Clone(fc.aliases),
+		private:    maps.Clone(fc.private),
+		forwards:   maps.Clone(fc.forwards),
+		statics:    maps.Clone(fc.statics),
+		classes:    maps.Clone(fc.classes),
+		interfaces: maps.Clone(fc.interfaces),
+		inits:      slices.Clone(fc.inits),
+	})
+
+	return nil
+}
+
+func cloneHistory(history map[string][]wordVersion) map[string][]wordVersion {
+	result := make(map[string][]wordVersion, len(history))
+
+	for word, versions := range history {
+		result[word] = slices.Clone(versions)
+	}
+
+	return result
+}
+
+// Returns true if name is a marker.
+func (fc *ForthCompiler) isMarker(name string) bool {
+	return slices.ContainsFunc(fc.markers, func(s *dictSnapshot) bool { return s.name == name })
+}
+
+// Rolls the dictionary back to the marker name. The marker and the markers
+// taken after it are removed.
+func (fc *ForthCompiler) rollback(name string) error {
+	i := slices.IndexFunc(fc.markers, func(s *dictSnapshot) bool { return s.name == name })
+	if i < 0 {
+		return fmt.Errorf("unknown marker \"%s\"", name)
+	}
+
+	s := fc.markers[i]
+	fc.markers = fc.markers[:i]
+
+	fc.defs = s.defs
+	fc.inlines = s.inlines
+	fc.macros = s.macros
+	fc.vars.data = s.vars
+	fc.attributes = s.attributes
+	fc.effects = s.effects
+	fc.locations = s.locations
+	fc.docs = s.docs
+	fc.sources = s.sources
+	fc.lines = s.lines
+	fc.history = s.history
+	fc.wordScopes = s.wordScopes
+	fc.modules = s.modules
+	fc.loaded = s.loaded
+	fc.files = s.files
+	fc.aliases = s.aliases
+	fc.private = s.private
+	fc.forwards = s.forwards
+	fc.statics = s.statics
+	fc.classes = s.classes
+	fc.interfaces = s.interfaces
+	fc.inits = s.inits
+	fc.clean = false
+
+	return nil
+}
+
+// Forgets the history and the markers, e.g. before the core words are loaded again.
+func (fc *ForthCompiler) resetHistory() {
+	clear(fc.sources)
+	clear(fc.history)
+	fc.markers = fc.markers[:0]
+}
+
+func isValidWord(name string) bool {
+	return name != "" && !strings.ContainsFunc(name, func(r rune) bool { return r <= ' ' })
+}
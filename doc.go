@@ -0,0 +1,281 @@
+package goforth
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The documentation of a word collected from its stack comment and the
+// "\" comment lines directly before its definition.
+type WordDoc struct {
+	Name     string
+	Kind     string // "word", "macro", "class" or "variable"
+	Effect   string
+	Comment  string
+	Members  []string // words generated by a class
+	Uses     []string // words used by the definition
+	Location SourceLocation
+}
+
+// Returns the documentation of word.
+func (fc *ForthCompiler) Doc(word string) (WordDoc, bool) {
+	loc, ok := fc.locations[word]
+	if !ok {
+		return WordDoc{}, false
+	}
+
+	doc := WordDoc{
+		Name:     word,
+		Effect:   fc.effects[word],
+		Comment:  fc.docs[word],
+		Location: loc,
+	}
+
+	switch {
+	case fc.inlines[word] != nil:
+		doc.Kind = "macro"
+	case fc.defs[word] != nil:
+		doc.Kind = "word"
+		for callee := range fc.callees(word, true) {
+			doc.Uses = append(doc.Uses, callee)
+		}
+		sort.Strings(doc.Uses)
+	case fc.vars.Contains(word):
+		doc.Kind = "variable"
+	case fc.defs[word+":sizeof"] != nil:
+		doc.Kind = "class"
+		for name, l := range fc.locations {
+			if l == loc && strings.HasPrefix(name, word+":") {
+				doc.Members = append(doc.Members, name)
+			}
+		}
+		sort.Strings(doc.Members)
+	default:
+		return WordDoc{}, false
+	}
+
+	return doc, true
+}
+
+// Returns the documentation of the words defined in the file module in the
+// order of their definitions. Words generated by a class are members of the class.
+// Words forwarded to a module are documented in the module.
+func (fc *ForthCompiler) ModuleDoc(module string) []WordDoc {
+	docs := make([]WordDoc, 0, 50)
+
+	for word, loc := range fc.locations {
+		if _, ok := fc.forwards[word]; ok || loc.File != module || fc.isClassMember(word) {
+			continue
+		}
+
+		if doc, ok := fc.Doc(word); ok {
+			docs = append(docs, doc)
+		}
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		if docs[i].Location.Line != docs[j].Location.Line {
+			return docs[i].Location.Line < docs[j].Location.Line
+		}
+		return docs[i].Name < docs[j].Name
+	})
+
+	return docs
+}
+
+// Reports whether word was generated by a class.
+func (fc *ForthCompiler) isClassMember(word string) bool {
+	clazz, _, ok := strings.Cut(word, ":")
+	if !ok {
+		// the vtable and the metadata of a class
+		clazz, _, ok = strings.Cut(word, ">")
+		if !ok {
+			return false
+		}
+	}
+
+	loc, ok := fc.locations[clazz]
+	return ok && loc == fc.locations[word] && fc.defs[clazz+":sizeof"] != nil
+}
+
+// Returns the name of the documentation page of a file, e.g. "sv" for "stdlib/sv.fs".
+func moduleName(file string) string {
+	return strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+}
+
+// Returns an id for word usable as HTML id and URL fragment.
+func docAnchor(word string) string {
+	var b strings.Builder
+
+	b.WriteString("w-")
+
+	for _, r := range word {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			fmt.Fprintf(&b, "_%x", r)
+		}
+	}
+
+	return b.String()
+}
+
+// Returns the link to the documentation of word from the page of module.
+func (fc *ForthCompiler) docLink(module, word, ext string) string {
+	loc := fc.locations[word]
+
+	if fc.isClassMember(word) {
+		word, _, _ = strings.Cut(word, ":")
+	}
+
+	if moduleName(loc.File) == moduleName(module) {
+		return "#" + docAnchor(word)
+	}
+
+	return moduleName(loc.File) + ext + "#" + docAnchor(word)
+}
+
+func (doc WordDoc) signature() string {
+	switch doc.Kind {
+	case "macro":
+		if doc.Effect == "" {
+			return ": inline " + doc.Name
+		}
+		return fmt.Sprintf(": inline %s ( %s )", doc.Name, doc.Effect)
+	case "class":
+		return ": class " + doc.Name
+	case "variable":
+		return "variable " + doc.Name
+	}
+
+	if doc.Effect == "" {
+		return doc.Name
+	}
+
+	return fmt.Sprintf("%s ( %s )", doc.Name, doc.Effect)
+}
+
+// Writes the documentation of module as Markdown.
+func (fc *ForthCompiler) WriteMarkdownDoc(w io.Writer, module string) error {
+	docs := fc.ModuleDoc(module)
+
+	fmt.Fprintf(w, "# Module `%s`\n\n", moduleName(module))
+
+	for _, doc := range docs {
+		fmt.Fprintf(w, "- [`%s`](#%s)\n", doc.Name, docAnchor(doc.Name))
+	}
+
+	for _, doc := range docs {
+		fmt.Fprintf(w, "\n<a id=\"%s\"></a>\n\n### `%s`\n\n", docAnchor(doc.Name), doc.Name)
+		fmt.Fprintf(w, "```forth\n%s\n```\n\n", doc.signature())
+
+		if doc.Kind != "word" {
+			fmt.Fprintf(w, "*%s*\n\n", doc.Kind)
+		}
+
+		if doc.Comment != "" {
+			fmt.Fprintf(w, "%s\n\n", doc.Comment)
+		}
+
+		if len(doc.Members) > 0 {
+			fmt.Fprintf(w, "Members: `%s`\n\n", strings.Join(doc.Members, "`, `"))
+		}
+
+		if len(doc.Uses) > 0 {
+			links := make([]string, len(doc.Uses))
+			for i, word := range doc.Uses {
+				links[i] = fmt.Sprintf("[`%s`](%s)", word, fc.docLink(module, word, ".md"))
+			}
+			fmt.Fprintf(w, "Uses: %s\n\n", strings.Join(links, ", "))
+		}
+
+		fmt.Fprintf(w, "Defined in %s line %d\n", doc.Location.File, doc.Location.Line)
+	}
+
+	return nil
+}
+
+// Writes the documentation of module as HTML page.
+func (fc *ForthCompiler) WriteHTMLDoc(w io.Writer, module string) error {
+	docs := fc.ModuleDoc(module)
+	name := html.EscapeString(moduleName(module))
+
+	fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n", name)
+	fmt.Fprint(w, "<style>body{font-family:sans-serif;max-width:50em;margin:auto}pre,code{background:#f4f4f4}</style>\n")
+	fmt.Fprintf(w, "</head>\n<body>\n<h1>Module <code>%s</code></h1>\n<ul>\n", name)
+
+	for _, doc := range docs {
+		fmt.Fprintf(w, "<li><a href=\"#%s\"><code>%s</code></a></li>\n", docAnchor(doc.Name), html.EscapeString(doc.Name))
+	}
+
+	fmt.Fprint(w, "</ul>\n")
+
+	for _, doc := range docs {
+		fmt.Fprintf(w, "<h3 id=\"%s\"><code>%s</code></h3>\n", docAnchor(doc.Name), html.EscapeString(doc.Name))
+		fmt.Fprintf(w, "<pre>%s</pre>\n", html.EscapeString(doc.signature()))
+
+		if doc.Kind != "word" {
+			fmt.Fprintf(w, "<p><em>%s</em></p>\n", doc.Kind)
+		}
+
+		if doc.Comment != "" {
+			fmt.Fprintf(w, "<p>%s</p>\n", strings.ReplaceAll(html.EscapeString(doc.Comment), "\n", "<br>\n"))
+		}
+
+		if len(doc.Members) > 0 {
+			members := make([]string, len(doc.Members))
+			for i, member := range doc.Members {
+				members[i] = "<code>" + html.EscapeString(member) + "</code>"
+			}
+			fmt.Fprintf(w, "<p>Members: %s</p>\n", strings.Join(members, ", "))
+		}
+
+		if len(doc.Uses) > 0 {
+			links := make([]string, len(doc.Uses))
+			for i, word := range doc.Uses {
+				links[i] = fmt.Sprintf("<a href=\"%s\"><code>%s</code></a>",
+					html.EscapeString(fc.docLink(module, word, ".html")), html.EscapeString(word))
+			}
+			fmt.Fprintf(w, "<p>Uses: %s</p>\n", strings.Join(links, ", "))
+		}
+
+		fmt.Fprintf(w, "<p><small>Defined in %s line %d</small></p>\n", html.EscapeString(doc.Location.File), doc.Location.Line)
+	}
+
+	_, err := fmt.Fprint(w, "</body>\n</html>\n")
+	return err
+}
+
+// Prints the documentation of word for the REPL.
+func (fc *ForthCompiler) printDoc(word string) {
+	doc, ok := fc.Doc(word)
+	if !ok {
+		return
+	}
+
+	if doc.Effect != "" {
+		fmt.Printf("( %s )\n", doc.Effect)
+	}
+
+	if doc.Kind != "word" {
+		fmt.Println(doc.Kind)
+	}
+
+	if doc.Comment != "" {
+		fmt.Println(doc.Comment)
+	}
+
+	if len(doc.Members) > 0 {
+		fmt.Printf("Members: %s\n", strings.Join(doc.Members, " "))
+	}
+
+	if len(doc.Uses) > 0 {
+		fmt.Printf("Uses: %s\n", strings.Join(doc.Uses, " "))
+	}
+
+	fmt.Printf("Defined in %s line %d\n", doc.Location.File, doc.Location.Line)
+}
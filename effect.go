@@ -0,0 +1,427 @@
+package goforth
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// StackEffect describes how many cells a word takes from the stack and
+// how many it leaves on the stack.
+type StackEffect struct {
+	In  int
+	Out int
+}
+
+func (se StackEffect) String() string {
+	return fmt.Sprintf("( %d -- %d )", se.In, se.Out)
+}
+
+// Stack effects of the primitives in ForthCompiler.data.
+var primitiveEffects = map[string]StackEffect{
+	"STR": {2, 0}, "LV": {1, 1}, "PRI": {1, 0}, "PRA": {1, 0}, "RDI": {0, 1},
+	"EQI": {2, 1}, "XOR": {2, 1}, "LSI": {2, 1}, "GRI": {2, 1}, "SBI": {2, 1},
+	"ADI": {2, 1}, "DVI": {2, 1}, "MLI": {2, 1}, "ADF": {2, 1}, "SBF": {2, 1},
+	"MLF": {2, 1}, "DVF": {2, 1}, "PRF": {1, 0}, "LSF": {2, 1}, "GRF": {2, 1},
+	"NOT": {1, 1}, "AND": {2, 1}, "OR": {2, 1}, "STP": {1, 0}, "DUP": {1, 2},
+	"TDP": {2, 4}, "OVR": {2, 3}, "TVR": {4, 6}, "DRP": {1, 0}, "SWP": {2, 2},
+	"TWP": {4, 4}, "ROT": {3, 3}, "NRT": {3, 3}, "PCK": {1, 1}, "TR": {1, 0},
+	"FR": {0, 1}, "RF": {0, 1}, "TTR": {2, 0}, "TFR": {0, 2}, "TRF": {0, 2},
+	"INC": {1, 1}, "DEC": {1, 1},
+}
+
+// Stack effects of the syscalls without the number of the syscall.
+// Syscalls pushing strings have no fixed stack effect.
+var syscallEffects = map[int64]StackEffect{
+	0: {0, 1}, 1: {2, 1}, 2: {1, 1}, 3: {1, 1}, 4: {1, 1}, 6: {1, 0},
+	7: {1, 0}, 9: {1, 0}, 10: {1, 0}, 11: {0, 1}, 12: {2, 1}, 13: {1, 0},
+	14: {1, 0}, 15: {1, 1}, 16: {0, 1}, 18: {0, 0}, 20: {2, 0}, 21: {2, 2},
+	22: {1, 0}, 23: {3, 2}, 24: {1, 0}, 25: {1, 0}, 26: {0, 7}, 27: {0, 1},
+}
+
+var (
+	// The body of a word can not be analysed, e.g. because of exec.
+	errUnknownEffect = errors.New("unknown stack effect")
+	// Loops consuming or producing cells are only reported for words with a stack comment.
+	errUnbalancedLoop = errors.New("unbalanced loop")
+)
+
+// Parses a stack comment like "a b -- c".
+// Comments without "--" or with a variable number of cells ("...", "..a") are rejected.
+func ParseStackEffect(comment string) (StackEffect, bool) {
+	var (
+		se     StackEffect
+		output bool
+	)
+
+	fields := strings.Fields(comment)
+
+	if !slices.Contains(fields, "--") {
+		return se, false
+	}
+
+	for _, field := range fields {
+		if field == "--" {
+			if output {
+				return se, false
+			}
+			output = true
+			continue
+		}
+
+		if strings.HasPrefix(field, "..") {
+			return se, false
+		}
+
+		if output {
+			se.Out++
+		} else {
+			se.In++
+		}
+	}
+
+	return se, true
+}
+
+// Returns the declared stack effect of a word.
+func (fc *ForthCompiler) declaredEffect(word string) (StackEffect, bool) {
+	if comment, ok := fc.effects[word]; ok {
+		return ParseStackEffect(comment)
+	}
+
+	return StackEffect{}, false
+}
+
+type effectFrame struct {
+	kind     string
+	start    int   // depth at the beginning of the structure
+	exit     int   // depth at the exit of a loop or of the if branch
+	hasExit  bool  // exit is set
+	branches []int // depths at the end of each of .. endof
+}
+
+type effectChecker struct {
+	fc       *ForthCompiler
+	inferred map[string]StackEffect
+	unknown  map[string]bool
+	pending  map[string]bool
+	warnings []string
+}
+
+func newEffectChecker(fc *ForthCompiler) *effectChecker {
+	return &effectChecker{
+		fc:       fc,
+		inferred: make(map[string]StackEffect),
+		unknown:  make(map[string]bool),
+		pending:  make(map[string]bool),
+	}
+}
+
+func (ec *effectChecker) warn(word, format string, args ...any) {
+	ec.warnings = append(ec.warnings, fmt.Sprintf("word \"%s\": %s", word, fmt.Sprintf(format, args...)))
+}
+
+// Returns the stack effect of word used by callers.
+// A declared stack effect is preferred over the inferred one.
+func (ec *effectChecker) effectOf(word string) (StackEffect, bool) {
+	if se, ok := ec.fc.declaredEffect(word); ok {
+		return se, true
+	}
+
+	return ec.infer(word)
+}
+
+// Infers the stack effect of word from its definition.
+func (ec *effectChecker) infer(word string) (StackEffect, bool) {
+	if se, ok := ec.inferred[word]; ok {
+		return se, true
+	}
+
+	if ec.unknown[word] || ec.pending[word] {
+		return StackEffect{}, false
+	}
+
+	ec.pending[word] = true
+	defer delete(ec.pending, word)
+
+	se, err := ec.simulate(word, ec.fc.defs[word].data)
+
+	if err != nil {
+		_, declared := ec.fc.declaredEffect(word)
+		if err != errUnknownEffect && (declared || !errors.Is(err, errUnbalancedLoop)) {
+			ec.warn(word, "%s", err)
+		}
+		ec.unknown[word] = true
+		return se, false
+	}
+
+	ec.inferred[word] = se
+
+	if declared, ok := ec.fc.declaredEffect(word); ok {
+		if se.In > declared.In {
+			ec.warn(word, "stack underflow: the definition takes %d cells but the stack comment ( %s ) declares %d",
+				se.In, ec.fc.effects[word], declared.In)
+		} else if se.Out-se.In != declared.Out-declared.In {
+			ec.warn(word, "stack comment ( %s ) does not match the definition %s", ec.fc.effects[word], se)
+		}
+	}
+
+	return se, true
+}
+
+// Simulates the stack depth of the tokens of word.
+func (ec *effectChecker) simulate(word string, tokens []string) (StackEffect, error) {
+	var (
+		depth, low int
+		frames     Stack[*effectFrame]
+	)
+
+	locals := make(map[string]bool)
+
+	apply := func(se StackEffect) {
+		depth -= se.In
+		low = min(low, depth)
+		depth += se.Out
+	}
+
+	top := func(kinds ...string) (*effectFrame, error) {
+		frame, ok := frames.Fetch()
+		if !ok || !slices.Contains(kinds, frame.kind) {
+			return nil, errUnknownEffect
+		}
+		return frame, nil
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		w := tokens[i]
+
+		switch {
+		case w == "if":
+			apply(StackEffect{1, 0})
+			frames.Push(&effectFrame{kind: "if", start: depth})
+		case w == "else":
+			frame, err := top("if")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			frame.exit, frame.hasExit = depth, true
+			depth = frame.start
+		case w == "then":
+			frame, err := top("if")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			frames.Pop()
+			if frame.hasExit && frame.exit != depth {
+				return StackEffect{}, fmt.Errorf("unbalanced branches: if leaves %+d cells, else leaves %+d cells",
+					frame.exit-frame.start, depth-frame.start)
+			} else if !frame.hasExit && depth != frame.start {
+				return StackEffect{}, fmt.Errorf("unbalanced branches: if without else leaves %+d cells", depth-frame.start)
+			}
+		case w == "begin":
+			frames.Push(&effectFrame{kind: "begin", start: depth})
+		case w == "while":
+			frame, err := top("begin")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			apply(StackEffect{1, 0})
+			frame.exit, frame.hasExit = depth, true
+		case w == "until" || w == "again" || w == "repeat":
+			frame, err := top("begin")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			frames.Pop()
+			if w == "until" {
+				apply(StackEffect{1, 0})
+			}
+			if depth != frame.start {
+				return StackEffect{}, fmt.Errorf("%w: begin .. %s leaves %+d cells per iteration", errUnbalancedLoop, w, depth-frame.start)
+			}
+			if frame.hasExit {
+				depth = frame.exit
+			}
+		case w == "do" || w == "?do":
+			apply(StackEffect{2, 0})
+			frames.Push(&effectFrame{kind: "do", start: depth})
+		case w == "leave":
+			if _, err := top("do", "begin", "if", "of"); err != nil {
+				return StackEffect{}, err
+			}
+		case w == "loop" || w == "+loop" || w == "-loop":
+			frame, err := top("do")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			frames.Pop()
+			if w != "loop" {
+				apply(StackEffect{1, 0})
+			}
+			if depth != frame.start {
+				return StackEffect{}, fmt.Errorf("%w: do .. %s leaves %+d cells per iteration", errUnbalancedLoop, w, depth-frame.start)
+			}
+		case w == "case":
+			frames.Push(&effectFrame{kind: "case", start: depth})
+		case w == "of" || w == "?of":
+			if _, err := top("case"); err != nil {
+				return StackEffect{}, err
+			}
+			if w == "of" {
+				apply(StackEffect{2, 3})
+				apply(StackEffect{2, 1})
+			}
+			apply(StackEffect{1, 0})
+			frames.Push(&effectFrame{kind: "of", start: depth})
+		case w == "endof":
+			frame, err := top("of")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			frames.Pop()
+			caseFrame, err := top("case")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			caseFrame.branches = append(caseFrame.branches, depth)
+			depth = frame.start
+		case w == "endcase":
+			frame, err := top("case")
+			if err != nil {
+				return StackEffect{}, err
+			}
+			frames.Pop()
+			for _, d := range frame.branches {
+				if d != depth {
+					return StackEffect{}, fmt.Errorf("unbalanced branches: case branches leave %+d and %+d cells",
+						d-frame.start, depth-frame.start)
+				}
+			}
+		case w == "{":
+			for i++; i < len(tokens) && tokens[i] != "}"; i++ {
+				locals[tokens[i]] = true
+				apply(StackEffect{1, 0})
+			}
+		case w == "to" || w == "is":
+			i++
+			apply(StackEffect{1, 0})
+		case w == "char":
+			i++
+			apply(StackEffect{0, 1})
+		case w == "send":
+			// the implementations are only known at run time
+			return StackEffect{}, errUnknownEffect
+		case w == "super":
+			i++
+			if i == len(tokens) {
+				return StackEffect{}, errUnknownEffect
+			}
+			impl, err := ec.fc.superMethod(word, tokens[i])
+			if err != nil {
+				return StackEffect{}, errUnknownEffect
+			}
+			se, ok := ec.effectOf(impl)
+			if !ok {
+				return StackEffect{}, errUnknownEffect
+			}
+			apply(se)
+		case w == "done":
+		case w == "[":
+			depth2 := 0
+			for i++; i < len(tokens); i++ {
+				if tokens[i] == "[" {
+					depth2++
+				} else if tokens[i] == "]" {
+					if depth2 == 0 {
+						break
+					}
+					depth2--
+				}
+			}
+			apply(StackEffect{0, 1})
+		case w == word:
+			// recursion
+			se, ok := ec.fc.declaredEffect(word)
+			if !ok {
+				return StackEffect{}, errUnknownEffect
+			}
+			apply(se)
+		case isString(w):
+			switch w[0] {
+			case '.':
+			case 'a':
+				apply(StackEffect{0, 1})
+			case 'g':
+				apply(StackEffect{0, len([]rune(w)) - 4 + 2})
+			case 's':
+				apply(StackEffect{0, 2})
+			}
+		case isNumeric(w) || isFloat(w):
+			apply(StackEffect{0, 1})
+		case locals[w] || ec.fc.vars.Contains(w):
+			apply(StackEffect{0, 1})
+		case w[0] == '&':
+			apply(StackEffect{0, 1})
+		default:
+			if value, ok := ec.fc.data[w]; ok {
+				if value == "SYS" {
+					if i == 0 || !isNumeric(tokens[i-1]) {
+						return StackEffect{}, errUnknownEffect
+					}
+					n, _ := strconv.ParseInt(tokens[i-1], 10, 64)
+					se, ok := syscallEffects[n]
+					if !ok {
+						return StackEffect{}, errUnknownEffect
+					}
+					apply(StackEffect{1, 0})
+					apply(se)
+				} else if se, ok := primitiveEffects[value]; ok {
+					apply(se)
+				} else {
+					return StackEffect{}, errUnknownEffect
+				}
+			} else if _, ok := ec.fc.defs[w]; ok {
+				se, ok := ec.effectOf(w)
+				if !ok {
+					return StackEffect{}, errUnknownEffect
+				}
+				apply(se)
+			} else {
+				// macros, unknown words, local names of callers
+				return StackEffect{}, errUnknownEffect
+			}
+		}
+	}
+
+	if !frames.IsEmpty() {
+		return StackEffect{}, errUnknownEffect
+	}
+
+	return StackEffect{In: -low, Out: depth - low}, nil
+}
+
+// Checks the stack effects of all words reachable from "main".
+// Returns the warnings found.
+func (fc *ForthCompiler) CheckStackEffects() []string {
+	ec := newEffectChecker(fc)
+	words := make([]string, 0, 50)
+
+	for word := range fc.reachable("main") {
+		words = append(words, word)
+	}
+
+	slices.Sort(words)
+
+	for _, word := range words {
+		ec.infer(word)
+	}
+
+	// the stack of the VM is kept between runs in the REPL
+	if se, ok := ec.inferred["main"]; ok && se.In > len(fc.Fvm.Stack) {
+		ec.warn("main", "stack underflow: the definition takes %d cells but the stack has %d", se.In, len(fc.Fvm.Stack))
+	}
+
+	return ec.warnings
+}
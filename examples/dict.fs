@@ -5,16 +5,14 @@ use llist.fs
   * )
 
 : class dict extends list ;
-: class kv 1 key 1 value ;
+: class kv sv:key sv:value ;
 
-: kv:print ( self -- )
-  dup kv:key @ .s ."  : " kv:value @ .s
-;
+\ kv:print, kv:equals and kv:copy are generated for the typed fields
 
 : dict:append ( k v self -- )
   kv:new { kv self v k }
-  k kv kv:key !
-  v kv kv:value !
+  k kv kv:setKey
+  v kv kv:setValue
   kv self list:append
 ;
 
@@ -3,7 +3,7 @@
 : add2 2 + ;
 : array 10 ;
 : init
-  20 allocate
+  20 memresize
   array newS
   20 array +s
   40 array +s
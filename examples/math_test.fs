@@ -0,0 +1,17 @@
+\ Run with: goforth test examples
+use test
+
+: test:arithmetic
+  T{ 1 2 + -> 3 }T
+  T{ 7 3 mod 2 squared -> 1 4 }T
+  5 fak 120 assert-eq
+;
+
+: test:float
+  2. fsqrt 1.414213 0.000001 assert-float
+;
+
+: test:output
+  output{ 42 . a" 42" }output
+  output{ 3 integers a" 1 2 3 " }output
+;
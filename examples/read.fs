@@ -13,7 +13,7 @@
   * cat ../main.go | ./read.fs
 )
 : main
-  110 allocate
+  110 memresize
   begin
     adr size read
     adr @ if
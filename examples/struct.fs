@@ -1,5 +1,13 @@
 \ To define a class use:
-\ class <name> <size> <name> ...
+\ class <name> <field> ...
+\
+\ A field is declared as
+\   name        one cell
+\   5 name      five cells
+\   f:name      a float, i: and a: declare ints and addresses
+\   sv:name     a reference to an object of the class sv
+\   point o:pos an embedded object of the class point
+\   count=10    a cell with a default value
 
 : class foo 1 a 1 b 1 c ;
 
@@ -10,6 +18,9 @@
 \ foo:b ( adr -- adr2 )
 \ foo:c ( adr -- adr2 )
 \ foo:[] ( index adr -- adr2 )
+\ foo:print ( self -- )
+\ foo:equals ( self other -- bool )
+\ foo:copy ( self -- obj )
 
 : class moo extends foo ;
 : class hoo extends foo 1 d 1 e 1 f ;
@@ -17,3 +28,23 @@
 : class abc 25 a 12 b 10 c ;
 : class xyz 1 a 2 b 5 c ;
 
+: class point x y ;
+
+\ pos is embedded, so item:pos is the address of a point
+: class item
+  sv:name
+  count=10
+  f:price=2.5
+  point o:pos
+;
+
+: main
+  item:new { it }
+  s" apple" sv:fromMem it item:setName
+  3 it item:pos point:setX
+  it item:print cr
+  it item:copy { other }
+  it other item:equals . cr
+  4 other item:pos point:setY
+  it other item:equals . cr
+;
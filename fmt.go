@@ -0,0 +1,388 @@
+package goforth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// The source formatter. It scans the source like Parse, but keeps the
+// characters of every token, comment and string. Only the whitespace
+// between them is changed, so the formatted source parses to the same
+// dictionary. Line breaks are kept as they are.
+
+// Words which open, close or continue a control structure.
+var (
+	fmtOpeners = []string{"if", "begin", "do", "?do", "case", "of", "?of", "[", "@if", "@begin"} // and "@each:name"
+	fmtClosers = []string{"then", "repeat", "until", "again", "loop", "+loop", "-loop", "endof", "endcase", "]", "done", "@then", "@repeat", "@next"}
+	fmtMiddles = []string{"else", "while", "@else", "@while"}
+)
+
+// A part of a line separated by whitespace. It may contain comments and strings.
+type fmtSegment struct {
+	text     string
+	word     string // the word seen by Parse, if any
+	name     bool   // the name of a definition
+	comment  bool   // a comment starting the segment
+	space    string // the whitespace before a "\" comment
+	defStart bool   // a definition starts in this segment
+	defEnd   bool   // the definition ends in this segment
+}
+
+type fmtLine struct {
+	segments []*fmtSegment
+	inDef    bool // the line starts inside a definition
+	meta     bool // a meta command like "use file"
+}
+
+type fmtScanner struct {
+	lines    []*fmtLine
+	line     *fmtLine
+	text     []rune
+	word     []rune
+	space    []rune // whitespace since the last segment
+	last     string // the last word
+	comment  bool
+	defStart bool
+	defEnd   bool
+	state    int
+	inDef    bool
+	counter  int // words of the current definition
+}
+
+func (s *fmtScanner) newLine() {
+	s.line = &fmtLine{inDef: s.inDef}
+	s.lines = append(s.lines, s.line)
+}
+
+func (s *fmtScanner) flush() {
+	if len(s.text) == 0 {
+		return
+	}
+
+	// the alignment of comments at the end of a line is kept
+	if !s.comment || s.text[0] != '\\' || len(s.line.segments) == 0 {
+		s.space = s.space[:0]
+	}
+
+	seg := &fmtSegment{
+		text:     strings.TrimRight(string(s.text), " \t\r"),
+		word:     string(s.word),
+		comment:  s.comment,
+		space:    string(s.space),
+		defStart: s.defStart,
+		defEnd:   s.defEnd,
+	}
+
+	if len(s.word) > 0 && s.inDef {
+		// ": inline name" and ": class name" have the name after the keyword
+		seg.name = s.counter == 0 || s.counter == 1 && (s.last == "inline" || s.last == "class")
+		s.counter++
+	}
+
+	if len(s.word) > 0 {
+		s.last = seg.word
+	}
+
+	s.line.segments = append(s.line.segments, seg)
+	s.text = s.text[:0]
+	s.word = s.word[:0]
+	s.space = s.space[:0]
+	s.comment = false
+	s.defStart = false
+	s.defEnd = false
+}
+
+// Records whitespace between segments.
+func (s *fmtScanner) whitespace(i rune) {
+	s.flush()
+
+	if i == '\n' {
+		s.space = s.space[:0]
+		s.newLine()
+	} else if i != '\r' {
+		s.space = append(s.space, i)
+	}
+}
+
+// Formats Forth source code: the bodies of definitions are indented by
+// their control structures, whitespace between words is reduced to one
+// space and stack comments of consecutive definitions are aligned.
+func FormatSource(src string) (string, error) {
+	s := &fmtScanner{}
+	s.newLine()
+
+	runes := []rune(src)
+
+	for index := 0; index < len(runes); index++ {
+		i := runes[index]
+		next := rune(0)
+		if index+1 < len(runes) {
+			next = runes[index+1]
+		}
+
+		switch s.state {
+		case 0:
+			switch i {
+			case ':':
+				s.state = 1
+				s.inDef = true
+				s.defStart = true
+				s.counter = 0
+				s.text = append(s.text, i)
+			case '\\':
+				s.state = 4
+				s.comment = len(s.text) == 0
+				s.text = append(s.text, i)
+			case '(':
+				s.state = 5
+				s.comment = len(s.text) == 0
+				s.text = append(s.text, i)
+			case '\r', '\t', ' ', '\n':
+				s.whitespace(i)
+			default:
+				s.flush()
+				s.state = 6
+				s.line.meta = true
+				s.text = append(s.text, i)
+			}
+		case 1:
+			switch i {
+			case '(':
+				s.state = 3
+				s.comment = len(s.text) == 0
+				s.text = append(s.text, i)
+			case '\\':
+				s.state = 2
+				s.comment = len(s.text) == 0
+				s.text = append(s.text, i)
+			case ';':
+				s.state = 0
+				s.inDef = false
+				s.defEnd = true
+				s.word = append(s.word, i)
+				s.text = append(s.text, i)
+			case '\n', '\r', '\t', ' ':
+				s.whitespace(i)
+			case '.', 'a', 'g', 's':
+				s.text = append(s.text, i)
+				if len(s.word) == 0 && next == '"' {
+					s.state = 8
+					s.text = append(s.text, next)
+					index++
+				} else if len(s.word) == 0 && next == '(' {
+					s.state = 10
+					s.text = append(s.text, next)
+					index++
+				} else {
+					s.word = append(s.word, i)
+				}
+			default:
+				s.text = append(s.text, i)
+				s.word = append(s.word, i)
+			}
+		case 2, 4:
+			// comment until the end of the line
+			if i == '\n' {
+				s.state = fmtOuterState(s.state)
+				s.flush()
+				s.newLine()
+			} else {
+				s.text = append(s.text, i)
+			}
+		case 3, 5:
+			s.text = append(s.text, i)
+			if i == ')' {
+				s.state = fmtOuterState(s.state)
+			}
+		case 6:
+			if i == '\n' {
+				s.state = 0
+				s.text = []rune(strings.TrimSpace(string(s.text)))
+				s.flush()
+				s.newLine()
+			} else {
+				s.text = append(s.text, i)
+			}
+		case 8, 10:
+			// inside a string, like Parse the escapes \n, \" and \) are skipped
+			end := '"'
+			if s.state == 10 {
+				end = ')'
+			}
+
+			s.text = append(s.text, i)
+
+			if i == '\\' && (next == 'n' || next == end) {
+				s.text = append(s.text, next)
+				index++
+			} else if i == end {
+				s.state = 1
+			}
+		}
+	}
+
+	switch s.state {
+	case 0:
+		s.flush()
+	case 6:
+		s.text = []rune(strings.TrimSpace(string(s.text)))
+		s.flush()
+	case 2, 4:
+		s.flush()
+	case 1:
+		return "", fmt.Errorf("syntax error: word definition is not closed")
+	case 8:
+		return "", fmt.Errorf("syntax error: missing '\"'")
+	default:
+		return "", fmt.Errorf("syntax error: missing ')'")
+	}
+
+	return s.format(), nil
+}
+
+// Returns the state after a comment: the comments 2 and 3 are inside a definition.
+func fmtOuterState(state int) int {
+	if state == 2 || state == 3 {
+		return 1
+	}
+
+	return 0
+}
+
+// Returns the "{" which are closed by "done". Their locals are indented.
+func fmtScopes(lines []*fmtLine) map[*fmtSegment]bool {
+	scopes := make(map[*fmtSegment]bool)
+	open := make([]*fmtSegment, 0, 5)
+
+	for _, line := range lines {
+		for _, seg := range line.segments {
+			switch {
+			case seg.word == "{":
+				open = append(open, seg)
+			case seg.word == "done" && len(open) > 0:
+				scopes[open[len(open)-1]] = true
+				open = open[:len(open)-1]
+			case seg.defEnd:
+				open = open[:0]
+			}
+		}
+	}
+
+	return scopes
+}
+
+func (s *fmtScanner) format() string {
+	var (
+		b     strings.Builder
+		depth int
+		blank int
+	)
+
+	scopes := fmtScopes(s.lines)
+	lines := make([]string, 0, len(s.lines))
+	headers := make([]int, 0, len(s.lines)) // column of the stack comment or -1
+
+	for _, line := range s.lines {
+		if len(line.segments) == 0 {
+			lines = append(lines, "")
+			headers = append(headers, -1)
+			continue
+		}
+
+		indent := 0
+
+		if line.inDef {
+			first := line.segments[0]
+			indent = depth
+			if first.defEnd && first.word == ";" {
+				indent = 0
+			} else if !first.name && (slices.Contains(fmtClosers, first.word) || slices.Contains(fmtMiddles, first.word)) {
+				indent = max(1, indent-1)
+			}
+		}
+
+		texts := make([]string, 0, len(line.segments))
+		header := -1
+
+		for n, seg := range line.segments {
+			if seg.space != "" && n > 0 {
+				// the comment keeps its column
+				texts[n-1] += seg.space[1:]
+			}
+
+			texts = append(texts, seg.text)
+
+			switch {
+			case seg.defEnd:
+				depth = 0
+			case seg.defStart:
+				depth = 1
+			case seg.name:
+				// a stack comment directly after the name of a definition
+				if n+1 < len(line.segments) && line.segments[n+1].comment &&
+					line.segments[n+1].text[0] == '(' && line.segments[0].text == ":" && !line.inDef {
+					header = len(texts)
+				}
+			case seg.word == "{" && scopes[seg]:
+				depth++
+			case slices.Contains(fmtOpeners, seg.word) || strings.HasPrefix(seg.word, "@each:"):
+				depth++
+			case slices.Contains(fmtClosers, seg.word):
+				depth = max(1, depth-1)
+			}
+		}
+
+		prefix := strings.Repeat("  ", indent)
+
+		if header > 0 {
+			lines = append(lines, prefix+strings.Join(texts[:header], " ")+"\x00"+strings.Join(texts[header:], " "))
+			headers = append(headers, utf8.RuneCountInString(prefix+strings.Join(texts[:header], " ")))
+		} else {
+			lines = append(lines, prefix+strings.Join(texts, " "))
+			headers = append(headers, -1)
+		}
+	}
+
+	// align the stack comments of consecutive one-line headers
+	for start := 0; start < len(lines); {
+		if headers[start] < 0 {
+			start++
+			continue
+		}
+
+		end := start
+		column := 0
+
+		for end < len(lines) && headers[end] >= 0 {
+			column = max(column, headers[end])
+			end++
+		}
+
+		for k := start; k < end; k++ {
+			before, after, _ := strings.Cut(lines[k], "\x00")
+			lines[k] = before + strings.Repeat(" ", column-headers[k]+1) + after
+		}
+
+		start = end
+	}
+
+	// at most one blank line, none at the beginning and the end
+	for _, line := range lines {
+		if line == "" {
+			blank++
+			continue
+		}
+
+		if blank > 0 && b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+
+		blank = 0
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
@@ -0,0 +1,372 @@
+package goforth
+
+import (
+	"log"
+	"math/bits"
+	"slices"
+)
+
+// The heap of allocate, free and resize takes its regions from here.
+// A block starts with a header holding its size in cells, including the
+// header, and the flags below. Free blocks are linked in lists by size
+// class, the links are stored in the two cells after the header and the
+// size again in the last cell, so a block can be merged with the free
+// block before it. Every region ends with an allocated block of size 0
+// and never starts at 0, so 0 ends a list.
+const (
+	heapUsed     = 1 // the block is allocated
+	heapPrevUsed = 2 // the block before is allocated
+	heapMarked   = 4 // the block is reachable, set by the collector
+	heapFlags    = 3 // the number of flag bits
+	heapMinBlock = 4 // the header, the links and the size of a free block
+	heapMinGrow  = 1024
+	heapClasses  = 64
+)
+
+type heapRegion struct {
+	start, end int64
+}
+
+type heapState struct {
+	regions     []heapRegion
+	free        [heapClasses]int64 // the first free block of each size class
+	auto        bool               // collect before the heap grows
+	allocs      int64
+	frees       int64
+	collections int64
+}
+
+// The size class of blocks with size cells, the blocks of class c have
+// at least 2^c cells.
+func heapClass(size int64) int {
+	return bits.Len64(uint64(size)) - 1
+}
+
+func (fvm *ForthVM) blockSize(h int64) int64 {
+	return fvm.Mem[h] >> heapFlags
+}
+
+func (fvm *ForthVM) setBlock(h, size, flags int64) {
+	fvm.Mem[h] = size<<heapFlags | flags
+}
+
+// Adds the block h to the list of its size class.
+func (fvm *ForthVM) pushFree(h, size, flags int64) {
+	hp := &fvm.heap
+	c := heapClass(size)
+
+	fvm.setBlock(h, size, flags&heapPrevUsed)
+	fvm.Mem[h+1] = hp.free[c]
+	fvm.Mem[h+2] = 0
+	if hp.free[c] != 0 {
+		fvm.Mem[hp.free[c]+2] = h
+	}
+	hp.free[c] = h
+	fvm.Mem[h+size-1] = size
+	fvm.Mem[h+size] &^= heapPrevUsed
+}
+
+// Removes the block h from the list of its size class.
+func (fvm *ForthVM) removeFree(h int64) {
+	next, prev := fvm.Mem[h+1], fvm.Mem[h+2]
+
+	if prev == 0 {
+		fvm.heap.free[heapClass(fvm.blockSize(h))] = next
+	} else {
+		fvm.Mem[prev+1] = next
+	}
+
+	if next != 0 {
+		fvm.Mem[next+2] = prev
+	}
+}
+
+// Frees the block h and merges it with its free neighbours.
+func (fvm *ForthVM) release(h int64) {
+	fvm.Mem[h] &^= heapUsed | heapMarked
+	size := fvm.blockSize(h)
+	flags := fvm.Mem[h]
+
+	if next := h + size; fvm.Mem[next]&heapUsed == 0 {
+		fvm.removeFree(next)
+		size += fvm.blockSize(next)
+	}
+
+	if flags&heapPrevUsed == 0 {
+		prev := h - fvm.Mem[h-1]
+		fvm.removeFree(prev)
+		size += h - prev
+		h = prev
+		flags = fvm.Mem[prev]
+	}
+
+	fvm.pushFree(h, size, flags)
+}
+
+// Shrinks the allocated block h to need cells and frees the rest.
+func (fvm *ForthVM) shrink(h, need int64) {
+	size := fvm.blockSize(h)
+
+	if size-need < heapMinBlock {
+		return
+	}
+
+	fvm.setBlock(h, need, fvm.Mem[h]&(heapUsed|heapPrevUsed))
+	fvm.setBlock(h+need, size-need, heapUsed|heapPrevUsed)
+	fvm.release(h + need)
+}
+
+// Returns the first free block with at least need cells or 0.
+func (fvm *ForthVM) findFree(need int64) int64 {
+	for c := heapClass(need); c < heapClasses; c++ {
+		for h := fvm.heap.free[c]; h != 0; h = fvm.Mem[h+1] {
+			if fvm.blockSize(h) >= need {
+				return h
+			}
+		}
+	}
+
+	return 0
+}
+
+// Takes at least need cells from here for the heap and returns the new here.
+// The heap grows behind its last region, if here is below it.
+func (fvm *ForthVM) growHeap(need, here int64) int64 {
+	hp := &fvm.heap
+	n := max(need+1, heapMinGrow)
+	start := max(here, fvm.heapEnd(), 1)
+	end := start + n
+
+	if end > int64(len(fvm.Mem)) {
+		mem := make([]int64, 2*end)
+		copy(mem, fvm.Mem)
+		fvm.Mem = mem
+	}
+
+	fvm.setBlock(end-1, 0, heapUsed)
+
+	if last := len(hp.regions) - 1; last >= 0 && hp.regions[last].end == start {
+		// the last region is extended, its end block becomes the new block
+		h := start - 1
+		fvm.setBlock(h, n, fvm.Mem[h]&heapPrevUsed|heapUsed)
+		hp.regions[last].end = end
+		fvm.release(h)
+	} else {
+		fvm.setBlock(start, n-1, heapUsed|heapPrevUsed)
+		hp.regions = append(hp.regions, heapRegion{start, end})
+		fvm.release(start)
+	}
+
+	return end
+}
+
+// Returns the address of n zeroed cells and the new here.
+// The blocks at the addresses in keep survive a collection.
+func (fvm *ForthVM) allocate(n, here int64, keep ...int64) (int64, int64) {
+	hp := &fvm.heap
+
+	if n < 0 {
+		log.Fatalf("ERROR: allocate - invalid size %d\n", n)
+	}
+
+	need := max(n+1, heapMinBlock)
+	h := fvm.findFree(need)
+
+	if h == 0 && hp.auto && len(hp.regions) > 0 {
+		fvm.collect(here, keep...)
+		h = fvm.findFree(need)
+	}
+
+	if h == 0 {
+		here = fvm.growHeap(need, here)
+		h = fvm.findFree(need)
+	}
+
+	fvm.removeFree(h)
+	size := fvm.blockSize(h)
+	fvm.setBlock(h, size, fvm.Mem[h]&heapPrevUsed|heapUsed)
+	fvm.Mem[h+size] |= heapPrevUsed
+	fvm.shrink(h, need)
+	clear(fvm.Mem[h+1 : h+fvm.blockSize(h)])
+	hp.allocs++
+
+	return h + 1, here
+}
+
+// Returns the header of the block allocated at addr.
+func (fvm *ForthVM) heapBlock(word string, addr int64) int64 {
+	h := addr - 1
+
+	for _, r := range fvm.heap.regions {
+		if h >= r.start && h < r.end-1 && fvm.Mem[h]&heapUsed != 0 {
+			if size := fvm.blockSize(h); size >= heapMinBlock && h+size < r.end {
+				return h
+			}
+		}
+	}
+
+	log.Fatalf("ERROR: %s - %d is not an allocated address\n", word, addr)
+	return 0
+}
+
+func (fvm *ForthVM) free(addr int64) {
+	if addr == 0 {
+		return
+	}
+
+	fvm.release(fvm.heapBlock("free", addr))
+	fvm.heap.frees++
+}
+
+// Changes the size of the block at addr to n cells and returns its
+// address and the new here. New cells are zeroed.
+func (fvm *ForthVM) resize(addr, n, here int64) (int64, int64) {
+	if addr == 0 {
+		return fvm.allocate(n, here)
+	}
+
+	h := fvm.heapBlock("resize", addr)
+	need := max(n+1, heapMinBlock)
+	size := fvm.blockSize(h)
+
+	if need > size {
+		next := h + size
+
+		if fvm.Mem[next]&heapUsed != 0 || size+fvm.blockSize(next) < need {
+			// the block is moved
+			result, here := fvm.allocate(n, here, addr)
+			copy(fvm.Mem[result:], fvm.Mem[addr:h+size])
+			fvm.free(addr)
+			return result, here
+		}
+
+		fvm.removeFree(next)
+		merged := size + fvm.blockSize(next)
+		fvm.setBlock(h, merged, fvm.Mem[h]&(heapUsed|heapPrevUsed))
+		fvm.Mem[h+merged] |= heapPrevUsed
+		clear(fvm.Mem[h+size : h+merged])
+	}
+
+	fvm.shrink(h, need)
+
+	return addr, here
+}
+
+// Frees the allocated blocks, which can not be reached from the stacks,
+// the locals, the variables, the memory below here or the addresses in
+// keep. Every cell is treated as a possible address, also of a cell
+// within a block.
+func (fvm *ForthVM) collect(here int64, keep ...int64) {
+	hp := &fvm.heap
+	var blocks, work []int64
+
+	for _, r := range hp.regions {
+		for h := r.start; fvm.blockSize(h) > 0; h += fvm.blockSize(h) {
+			if fvm.Mem[h]&heapUsed != 0 {
+				blocks = append(blocks, h)
+			}
+		}
+	}
+
+	slices.Sort(blocks)
+
+	mark := func(values ...int64) {
+		for _, v := range values {
+			i, _ := slices.BinarySearch(blocks, v)
+			if i == 0 {
+				continue
+			}
+
+			if h := blocks[i-1]; v < h+fvm.blockSize(h) && fvm.Mem[h]&heapMarked == 0 {
+				fvm.Mem[h] |= heapMarked
+				work = append(work, h)
+			}
+		}
+	}
+
+	mark(fvm.Stack...)
+	mark(fvm.Rstack...)
+	mark(keep...)
+
+	for ctx := 0; ctx <= fvm.ln; ctx++ {
+		for name := range fvm.l_len {
+			if local := fvm.local_get(name, ctx); local.active {
+				mark(local.data)
+			}
+		}
+	}
+
+	for _, value := range fvm.Vars {
+		mark(value)
+	}
+
+	// the memory below here without the heap
+	regions := slices.Clone(hp.regions)
+	slices.SortFunc(regions, func(a, b heapRegion) int { return int(a.start - b.start) })
+	here = min(here, int64(len(fvm.Mem)))
+	addr := int64(0)
+
+	for _, r := range regions {
+		if end := min(r.start, here); end > addr {
+			mark(fvm.Mem[addr:end]...)
+		}
+		addr = max(addr, r.end)
+	}
+
+	if here > addr {
+		mark(fvm.Mem[addr:here]...)
+	}
+
+	for len(work) > 0 {
+		h := work[len(work)-1]
+		work = work[:len(work)-1]
+		mark(fvm.Mem[h+1 : h+fvm.blockSize(h)]...)
+	}
+
+	for _, h := range blocks {
+		if fvm.Mem[h]&heapMarked != 0 {
+			fvm.Mem[h] &^= heapMarked
+		} else {
+			fvm.release(h)
+			hp.frees++
+		}
+	}
+
+	hp.collections++
+}
+
+// Pushes the cells of the heap, the cells of the allocated and the free
+// blocks, the number of allocated blocks, of allocations, of frees and
+// of collections.
+func (fvm *ForthVM) heapStats() {
+	hp := &fvm.heap
+	var size, used, free, blocks int64
+
+	for _, r := range hp.regions {
+		size += r.end - r.start
+
+		for h := r.start; fvm.blockSize(h) > 0; h += fvm.blockSize(h) {
+			if fvm.Mem[h]&heapUsed != 0 {
+				used += fvm.blockSize(h)
+				blocks++
+			} else {
+				free += fvm.blockSize(h)
+			}
+		}
+	}
+
+	for _, value := range []int64{size, used, free, blocks, hp.allocs, hp.frees, hp.collections} {
+		fvm.Push(value)
+	}
+}
+
+// The end of the heap region at the highest address or 0.
+func (fvm *ForthVM) heapEnd() int64 {
+	var end int64
+
+	for _, r := range fvm.heap.regions {
+		end = max(end, r.end)
+	}
+
+	return end
+}
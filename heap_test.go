@@ -0,0 +1,72 @@
+package goforth
+
+import "testing"
+
+func TestHeapAcrossRuns(t *testing.T) {
+	// the data segments and the literals of later runs must not overwrite
+	// the heap and the heap must not grow into the data segments
+	got := runSession(t,
+		"variable p\nvariable q\n: n. . space ;\n"+
+			`: main 10 allocate to p 11 p ! 20 allocate to q 22 q ! 30 allocate drop s" one" type ;`,
+		`: main p @ n. q @ n. q free 0 to q s" two" type gc heap-info n. n. n. n. 2drop drop ;`,
+		"create buf 5 , 6 ,\n"+
+			`: main buf @ n. p @ n. 100 allocate to q 33 q ! gc p @ n. q @ n. buf 1+ @ n. ;`,
+		`: main s" four" type p @ n. q @ n. 4000 allocate drop gc p @ n. q @ n. heap-info drop n. 2drop 2drop drop ;`,
+	)
+	want := []string{
+		"one",
+		"11 22 two1 2 3 1 ", // the block not referred to is collected
+		"5 11 11 33 6 ",
+		"four11 33 11 33 3 ",
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("run %d: got %q, want %q", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestHeapParity(t *testing.T) {
+	// the collector of the C backend finds the same roots as the one of the
+	// VM, so both free the same blocks
+	script := `: umod ( n m -- r ) 2dup / * - ;
+variable seed
+: rand ( -- n ) seed 1103515245 * 12345 + 2147483648 umod abs dup to seed 8 / ;
+
+: build ( n -- list )
+  { n }
+  0 0 { node list }
+  n 0 ?do
+    2 allocate to node
+    list node !
+    i node 1+ !
+    node to list
+  loop
+  list
+;
+
+: sum ( list -- n ) 0 swap begin dup while dup 1+ @ rot + swap @ repeat drop ;
+
+create lists 10 allot
+
+: churn ( -- ) 200 0 do rand 20 umod build drop loop ;
+
+: main
+  42 to seed
+  true gc-auto
+  10 0 do 20 i + build lists i + ! loop
+  30 build { mine }
+  churn
+  10 0 do lists i + @ sum . space loop
+  mine sum . cr
+  heap-info 7 0 do . space loop cr
+  0 to mine 0 lists ! gc
+  heap-info 7 0 do . space loop
+;`
+
+	vm := runVM(t, script)
+	if c := runC(t, script); c != vm {
+		t.Errorf("C: got\n%s\nVM:\n%s", c, vm)
+	}
+}
@@ -0,0 +1,356 @@
+package goforth
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Words that access the return stack. Words using them directly or through
+// inlined words keep the fixed four-token rule, since inlining or calling
+// them changes what is on the return stack.
+var rstackWords = []string{">r", "r>", "r@", "2>r", "2r>", "2r@"}
+
+// Number of cells emitted by the control structures of the compiler.
+var controlCost = map[string]int{
+	"if":      1,
+	"else":    2,
+	"then":    1,
+	"case":    0,
+	"of":      3,
+	"?of":     1,
+	"endof":   2,
+	"endcase": 1,
+	"begin":   1,
+	"while":   1,
+	"repeat":  2,
+	"until":   2,
+	"again":   2,
+	"do":      2,
+	"?do":     7,
+	"loop":    13,
+	"+loop":   13,
+	"-loop":   14,
+	"leave":   1,
+	"done":    1,
+}
+
+type inlineDecision struct {
+	inline bool
+	cost   int    // number of cells if the word is inlined
+	calls  int    // number of call sites
+	reason string // reported by ShowInlining
+}
+
+type inlinePlanner struct {
+	fc        *ForthCompiler
+	decisions map[string]*inlineDecision
+	calls     map[string]int
+	pending   map[string]bool
+}
+
+// Decides for all words reachable from "main" whether they are inlined or called.
+func (fc *ForthCompiler) planInlining() {
+	p := &inlinePlanner{
+		fc:        fc,
+		decisions: make(map[string]*inlineDecision),
+		calls:     make(map[string]int),
+		pending:   make(map[string]bool),
+	}
+
+	reachable := fc.reachable("main")
+
+	for word := range reachable {
+		for callee, n := range fc.callSites(word, false) {
+			p.calls[callee] += n
+		}
+	}
+
+	for word := range reachable {
+		if word != "main" {
+			p.decide(word)
+		}
+	}
+
+	fc.inlining = p.decisions
+
+	if ShowInlining {
+		fc.printInlining()
+	}
+}
+
+// Reports whether the word should be inlined.
+func (fc *ForthCompiler) shouldInline(word string) bool {
+	if d, ok := fc.inlining[word]; ok {
+		return d.inline
+	}
+
+	// words outside of the plan, e.g. compiled by the REPL debugger
+	return fc.defs[word].Len() <= 4
+}
+
+func (fc *ForthCompiler) printInlining() {
+	words := make([]string, 0, len(fc.inlining))
+	for word := range fc.inlining {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+
+	for _, word := range words {
+		d := fc.inlining[word]
+		mode := "call"
+		if d.inline {
+			mode = "inline"
+		}
+		fmt.Printf("%-6s %s: %s (cost %d, calls %d)\n", mode, word, d.reason, d.cost, d.calls)
+	}
+}
+
+// Returns all words of the dictionary used in the definition of word.
+// If withRefs is set, words referenced by &word are included.
+func (fc *ForthCompiler) callees(word string, withRefs bool) map[string]bool {
+	result := make(map[string]bool)
+
+	for callee := range fc.callSites(word, withRefs) {
+		result[callee] = true
+	}
+
+	return result
+}
+
+// Returns how often the words of the dictionary are used in the definition
+// of word. If withRefs is set, words referenced by &word are included.
+func (fc *ForthCompiler) callSites(word string, withRefs bool) map[string]int {
+	result := make(map[string]int)
+
+	tokens := fc.defs[word].data
+
+	for i := 0; i < len(tokens); i++ {
+		w := tokens[i]
+		if (w == "send" || w == "super") && i+1 < len(tokens) {
+			// calls the implementations of the method
+			i++
+			if w == "send" {
+				for _, impl := range fc.implementations[tokens[i]] {
+					if impl != word {
+						result[impl]++
+					}
+				}
+			} else if impl, err := fc.superMethod(word, tokens[i]); err == nil {
+				result[impl]++
+			}
+		} else if _, ok := fc.defs[w]; ok && w != word {
+			result[w]++
+		} else if _, ok := fc.defs[strings.TrimPrefix(w, "&")]; ok && withRefs && w[0] == '&' {
+			result[w[1:]]++
+		} else if isString(w) {
+			// strings are compiled to words like emit or print
+			tmp := NewStack[string]()
+			handleForthString(tmp, []rune(w))
+			for _, s := range tmp.data {
+				if _, ok := fc.defs[s]; ok {
+					result[s]++
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// Returns all words used directly or indirectly by word including word.
+func (fc *ForthCompiler) reachable(word string) map[string]bool {
+	visited := make(map[string]bool)
+	todo := []string{word}
+
+	for len(todo) > 0 {
+		w := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+
+		if visited[w] {
+			continue
+		}
+
+		if _, ok := fc.defs[w]; !ok {
+			continue
+		}
+
+		visited[w] = true
+
+		for callee := range fc.callees(w, true) {
+			todo = append(todo, callee)
+		}
+	}
+
+	return visited
+}
+
+func (p *inlinePlanner) isRecursive(word string) bool {
+	if p.fc.defs[word].Contains(word) {
+		return true
+	}
+
+	for callee := range p.fc.callees(word, false) {
+		if p.fc.reachable(callee)[word] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reports whether word accesses the return stack directly or through inlined words.
+func (p *inlinePlanner) usesRstack(word string, visited map[string]bool) bool {
+	def := p.fc.defs[word]
+
+	if def.ContainsAny(rstackWords) {
+		return true
+	}
+
+	visited[word] = true
+
+	for callee := range p.fc.callees(word, false) {
+		if visited[callee] || p.fc.defs[callee].Len() > 4 {
+			continue
+		}
+
+		if p.usesRstack(callee, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *inlinePlanner) decide(word string) *inlineDecision {
+	if d, ok := p.decisions[word]; ok {
+		return d
+	}
+
+	def := p.fc.defs[word]
+	d := &inlineDecision{calls: p.calls[word]}
+	p.decisions[word] = d
+	d.cost = p.cost(word)
+
+	switch {
+	case p.fc.attributes[word] == "noinline":
+		d.reason = "noinline attribute"
+	case p.isRecursive(word):
+		d.reason = "recursive"
+		if p.fc.attributes[word] == "inline" {
+			d.reason = "recursive, inline attribute ignored"
+		}
+	case p.fc.attributes[word] == "inline":
+		d.inline = true
+		d.reason = "inline attribute"
+	case p.usesRstack(word, make(map[string]bool)):
+		d.inline = def.Len() <= 4
+		d.reason = "uses the return stack"
+	case def.Contains("{") || def.Contains("["):
+		d.reason = "has locals or blocks"
+	case d.cost <= 1:
+		d.inline = true
+		d.reason = "not larger than a call"
+	case d.cost > InlineMaxCost:
+		d.reason = fmt.Sprintf("cost > %d", InlineMaxCost)
+	case d.calls*(d.cost-1)-(d.cost+2) > InlineMaxGrowth:
+		d.reason = fmt.Sprintf("code growth > %d", InlineMaxGrowth)
+	default:
+		d.inline = true
+		d.reason = "cheap"
+	}
+
+	return d
+}
+
+// Estimates the number of cells emitted for the definition of word.
+func (p *inlinePlanner) cost(word string) int {
+	if p.pending[word] {
+		return 1
+	}
+
+	p.pending[word] = true
+	defer delete(p.pending, word)
+
+	return p.costOf(word, p.fc.defs[word].data)
+}
+
+func (p *inlinePlanner) costOf(word string, tokens []string) int {
+	var cost int
+
+	for i := 0; i < len(tokens); i++ {
+		w := tokens[i]
+
+		switch {
+		case w == word:
+			cost++
+		case w == "to" || w == "char":
+			i++
+			cost++
+		case w == "send":
+			i++
+			cost += 7
+		case w == "super":
+			i++
+			cost++
+		case w == "{":
+			cost++
+			for i++; i < len(tokens) && tokens[i] != "}"; i++ {
+				cost++
+			}
+		case w == "[":
+			// a block is compiled into a function and referenced
+			depth := 0
+			for i++; i < len(tokens); i++ {
+				if tokens[i] == "[" {
+					depth++
+				} else if tokens[i] == "]" {
+					if depth == 0 {
+						break
+					}
+					depth--
+				}
+			}
+			cost++
+		case isString(w):
+			tmp := NewStack[string]()
+			handleForthString(tmp, []rune(w))
+			cost += p.costOf(word, tmp.data)
+		default:
+			if c, ok := controlCost[w]; ok {
+				cost += c
+			} else if _, ok := p.fc.defs[w]; ok {
+				if !p.pending[w] && p.decide(w).inline {
+					cost += p.decisions[w].cost
+				} else {
+					cost++
+				}
+			} else {
+				cost++
+			}
+		}
+	}
+
+	return cost
+}
+
+// Handles the meta commands "inline word ..." and "noinline word ...".
+func (fc *ForthCompiler) setInlineAttribute(attr string, words []string) error {
+	if len(words) == 0 {
+		return fmt.Errorf("%s: missing word name", attr)
+	}
+
+	for _, word := range words {
+		if strings.TrimSpace(word) == "" {
+			continue
+		}
+
+		if _, ok := fc.inlines[word]; ok {
+			return fmt.Errorf("%s: \"%s\" is a macro", attr, word)
+		}
+
+		fc.attributes[word] = attr
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+package goforth
+
+import (
+	"io"
+	"testing"
+)
+
+func TestInlineCalls(t *testing.T) {
+	fc := NewForthCompiler()
+	if err := fc.ParseFile("core"); err != nil {
+		t.Fatal(err)
+	}
+
+	fc.Fvm.Out = io.Discard
+
+	// every use of sq is a call site, not only every caller
+	if err := fc.Run(": sq dup * ; : main 2 sq 3 sq 4 sq 5 sq . . . . ;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := fc.inlining["sq"]; d == nil || d.calls != 4 {
+		t.Errorf("got %+v, want 4 calls of sq", d)
+	}
+}
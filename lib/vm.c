@@ -1,3 +1,5 @@
+#define _POSIX_C_SOURCE 200809L
+
 #include <stdio.h>
 #include <stdlib.h>
 #include <stdint.h>
@@ -13,6 +15,8 @@
 
 #define VM_STACK_SIZE 200
 #define VM_RSTACK_SIZE 50
+#define VM_LOCALS_SIZE 10000
+#define VM_CAPTURES 16
 
 typedef union u_cell {
   int64_t value;
@@ -26,8 +30,10 @@ static int64_t fvm_mem_size = 0;
 static cell_t* fvm_mem = NULL;
 static cell_t fvm_stack[VM_STACK_SIZE];
 static cell_t fvm_rstack[VM_RSTACK_SIZE];
+static cell_t fvm_locals[VM_LOCALS_SIZE]; // the locals of the running words
 static ptrdiff_t fvm_n = -1;
 static ptrdiff_t fvm_rn = -1;
+static ptrdiff_t fvm_ln = -1;
 
 #if DEBUG
 static int64_t fvm_nmax = 0;
@@ -35,6 +41,18 @@ static int64_t fvm_rmax = 0;
 #endif
 
 static clock_t fvm_begin = 0;
+static char fvm_input[4]; // the start of a code point not completed by "read"
+static size_t fvm_input_n = 0;
+
+// the output written since "capture"
+typedef struct s_capture {
+  FILE *fp;
+  char *buf;
+  size_t size;
+} capture_t;
+
+static capture_t fvm_captures[VM_CAPTURES];
+static int fvm_captures_n = 0;
 void (*fvm_sys_custom)(int64_t) = NULL;
 
 // #ifndef inline
@@ -44,7 +62,7 @@ void (*fvm_sys_custom)(int64_t) = NULL;
 #define myerror(txt) \
   do { \
     printf("ERROR: " txt "\n"); \
-    exit(0); \
+    exit(1); \
   } while(0)
 
 static inline cell_t fvm_cell(int64_t i) {
@@ -55,6 +73,89 @@ static inline cell_t fvm_cell_d(double i) {
   return (cell_t){ .dvalue = i };
 }
 
+// Cells hold code points, which are encoded in UTF-8 for I/O.
+// Invalid code points and bytes are replaced by U+FFFD.
+
+static inline int fvm_encode(int64_t c, char *buf) {
+  if (c < 0 || c > 0x10FFFF || (c >= 0xD800 && c <= 0xDFFF)) {
+    c = 0xFFFD;
+  }
+
+  if (c < 0x80) {
+    buf[0] = (char)c;
+    return 1;
+  } else if (c < 0x800) {
+    buf[0] = (char)(0xC0 | (c >> 6));
+    buf[1] = (char)(0x80 | (c & 0x3F));
+    return 2;
+  } else if (c < 0x10000) {
+    buf[0] = (char)(0xE0 | (c >> 12));
+    buf[1] = (char)(0x80 | ((c >> 6) & 0x3F));
+    buf[2] = (char)(0x80 | (c & 0x3F));
+    return 3;
+  }
+
+  buf[0] = (char)(0xF0 | (c >> 18));
+  buf[1] = (char)(0x80 | ((c >> 12) & 0x3F));
+  buf[2] = (char)(0x80 | ((c >> 6) & 0x3F));
+  buf[3] = (char)(0x80 | (c & 0x3F));
+  return 4;
+}
+
+// Returns the number of bytes of the code point starting with the byte b.
+static inline int fvm_runesize(unsigned char b) {
+  if (b >= 0xF0) return 4;
+  if (b >= 0xE0) return 3;
+  if (b >= 0xC0) return 2;
+  return 1;
+}
+
+// Decodes the code point at the start of str with n bytes into c and
+// returns the number of bytes used.
+static inline int fvm_decode(const char *str, size_t n, int64_t *c) {
+  const unsigned char *s = (const unsigned char*)str;
+  int size = fvm_runesize(s[0]);
+  static const int64_t min[] = { 0, 0, 0x80, 0x800, 0x10000 };
+
+  if (s[0] < 0x80) {
+    *c = s[0];
+    return 1;
+  }
+
+  if (s[0] < 0xC0 || s[0] > 0xF4 || (size_t)size > n) {
+    *c = 0xFFFD;
+    return 1;
+  }
+
+  int64_t r = s[0] & (0x7F >> size);
+
+  for (int i = 1; i < size; i++) {
+    if ((s[i] & 0xC0) != 0x80) {
+      *c = 0xFFFD;
+      return 1;
+    }
+    r = (r << 6) | (s[i] & 0x3F);
+  }
+
+  if (r < min[size] || r > 0x10FFFF || (r >= 0xD800 && r <= 0xDFFF)) {
+    *c = 0xFFFD;
+    return 1;
+  }
+
+  *c = r;
+  return size;
+}
+
+// The stream of the output, stdout or the last capture.
+static inline FILE* fvm_out(void) {
+  return fvm_captures_n > 0 ? fvm_captures[fvm_captures_n-1].fp : stdout;
+}
+
+static inline void fvm_putrune(int64_t c) {
+  char buf[4];
+  fwrite(buf, 1, (size_t)fvm_encode(c, buf), fvm_out());
+}
+
 static inline void fvm_push(cell_t i) {
   fvm_stack[++fvm_n] = i;
 #if DEBUG
@@ -87,6 +188,14 @@ static inline cell_t fvm_rpop(void) {
   return fvm_rstack[fvm_rn--];
 }
 
+// Defines a local with the value popped and returns its cell. The locals
+// of a context are removed by resetting fvm_ln when it is left.
+static inline cell_t* fvm_ldef(void) {
+  if (fvm_ln == VM_LOCALS_SIZE - 1) myerror("fvm_locals is full in fvm_ldef()");
+  fvm_locals[++fvm_ln] = fvm_pop();
+  return &fvm_locals[fvm_ln];
+}
+
 static inline void fvm_lv(void) {
   fvm_push(fvm_mem[fvm_pop().value]);
 }
@@ -154,11 +263,11 @@ static inline void fvm_mlf(void) {
 }
 
 static inline void fvm_pri(void) {
-  printf("%ld", fvm_pop().value);
+  fprintf(fvm_out(), "%ld", fvm_pop().value);
 }
 
 static inline void fvm_prf(void) {
-  printf("%f", fvm_pop().dvalue);
+  fprintf(fvm_out(), "%f", fvm_pop().dvalue);
 }
 
 static inline void fvm_lsf(void) {
@@ -176,7 +285,7 @@ static inline void fvm_grf(void) {
 }
 
 static inline void fvm_pra(void) {
-  putchar((int)fvm_pop().value);
+  fvm_putrune(fvm_pop().value);
 }
 
 static inline void fvm_rdi(void) {
@@ -369,31 +478,44 @@ static inline char* fvm_getstring() {
   cell_t str = fvm_pop();
   cell_t len = fvm_mem[str.value];
   cell_t data = fvm_mem[str.value+1];
-  char *buffer = (char*)malloc(len.value+1);
+  char *buffer = (char*)malloc(4*len.value+1);
+  size_t n = 0;
 
   if (buffer == NULL) {
     myerror("Unable to allocate memory");
   }
 
   for (int64_t i = 0; i < len.value; i++) {
-    buffer[i] = (char)fvm_mem[data.value+i].value;
+    n += fvm_encode(fvm_mem[data.value+i].value, buffer+n);
   }
 
-  buffer[len.value] = '\0';
+  buffer[n] = '\0';
 
   return buffer;
 }
 
 // Push str to the fvm_stack
 static inline void fvm_stringtostack(const char* str) {
+  size_t n = strlen(str);
+  int64_t *runes = (int64_t*)malloc(sizeof(int64_t)*(n+1));
+  int64_t length = 0;
+
+  if (runes == NULL) {
+    myerror("Unable to allocate memory");
+  }
+
+  for (size_t i = 0; i < n; length++) {
+    i += fvm_decode(str+i, n-i, &runes[length]);
+  }
+
   fvm_push(fvm_cell(0));
-  int64_t length = (int64_t)strlen(str);
 
   for (int64_t i = length - 1; i >= 0; --i) {
-    fvm_push(fvm_cell(str[i]));
+    fvm_push(fvm_cell(runes[i]));
   }
 
   fvm_push(fvm_cell(length));
+  free(runes);
 }
 
 static inline void fvm_free(void) {
@@ -410,6 +532,472 @@ static inline void fvm_copy(cell_t *dest, int64_t dest_size, const cell_t *src,
   memcpy(dest, src, sizeof(cell_t) * n);
 }
 
+static inline void fvm_memresize(int64_t n) {
+  if (n == 0) {
+    fvm_free();
+  } else {
+    cell_t *tmp = (cell_t*)calloc((size_t)n, sizeof(cell_t));
+    if (tmp == NULL) {
+      myerror("Unable to allocate memory");
+    }
+    fvm_copy(tmp, n, fvm_mem, fvm_mem_size);
+    fvm_free();
+    fvm_mem_size = n;
+    fvm_mem = tmp;
+  }
+}
+
+// The heap of allocate, free and resize takes its regions from here.
+// A block starts with a header holding its size in cells, including the
+// header, and the flags below. Free blocks are linked in lists by size
+// class, the links are stored in the two cells after the header and the
+// size again in the last cell, so a block can be merged with the free
+// block before it. Every region ends with an allocated block of size 0
+// and never starts at 0, so 0 ends a list.
+
+#define HEAP_USED 1      // the block is allocated
+#define HEAP_PREV_USED 2 // the block before is allocated
+#define HEAP_MARKED 4    // the block is reachable, set by the collector
+#define HEAP_FLAGS 3     // the number of flag bits
+#define HEAP_MIN_BLOCK 4 // the header, the links and the size of a free block
+#define HEAP_MIN_GROW 1024
+#define HEAP_CLASSES 64
+
+typedef struct heap_region {
+  int64_t start;
+  int64_t end;
+} heap_region_t;
+
+static heap_region_t *fvm_heap_regions = NULL;
+static size_t fvm_heap_nregions = 0;
+static int64_t fvm_heap_lists[HEAP_CLASSES]; // the first free block of each size class
+static int fvm_heap_auto = 0;                // collect before the heap grows
+static int64_t fvm_heap_allocs = 0;
+static int64_t fvm_heap_frees = 0;
+static int64_t fvm_heap_collections = 0;
+
+// The variables as a NULL terminated array, a root of the collector
+// besides the stacks, the locals and the memory.
+static cell_t **fvm_globals = NULL;
+
+// The size class of blocks with size cells, the blocks of class c have
+// at least 2^c cells.
+static inline int fvm_heap_class(int64_t size) {
+  int c = -1;
+  while (size > 0) {
+    size >>= 1;
+    c++;
+  }
+  return c;
+}
+
+static inline int64_t fvm_heap_size(int64_t h) {
+  return fvm_mem[h].value >> HEAP_FLAGS;
+}
+
+static inline void fvm_heap_set(int64_t h, int64_t size, int64_t flags) {
+  fvm_mem[h].value = size << HEAP_FLAGS | flags;
+}
+
+// Adds the block h to the list of its size class.
+static void fvm_heap_push(int64_t h, int64_t size, int64_t flags) {
+  int c = fvm_heap_class(size);
+
+  fvm_heap_set(h, size, flags & HEAP_PREV_USED);
+  fvm_mem[h+1].value = fvm_heap_lists[c];
+  fvm_mem[h+2].value = 0;
+  if (fvm_heap_lists[c] != 0) {
+    fvm_mem[fvm_heap_lists[c]+2].value = h;
+  }
+  fvm_heap_lists[c] = h;
+  fvm_mem[h+size-1].value = size;
+  fvm_mem[h+size].value &= ~(int64_t)HEAP_PREV_USED;
+}
+
+// Removes the block h from the list of its size class.
+static void fvm_heap_remove(int64_t h) {
+  int64_t next = fvm_mem[h+1].value;
+  int64_t prev = fvm_mem[h+2].value;
+
+  if (prev == 0) {
+    fvm_heap_lists[fvm_heap_class(fvm_heap_size(h))] = next;
+  } else {
+    fvm_mem[prev+1].value = next;
+  }
+
+  if (next != 0) {
+    fvm_mem[next+2].value = prev;
+  }
+}
+
+// Frees the block h and merges it with its free neighbours.
+static void fvm_heap_release(int64_t h) {
+  fvm_mem[h].value &= ~(int64_t)(HEAP_USED | HEAP_MARKED);
+  int64_t size = fvm_heap_size(h);
+  int64_t flags = fvm_mem[h].value;
+  int64_t next = h + size;
+
+  if ((fvm_mem[next].value & HEAP_USED) == 0) {
+    fvm_heap_remove(next);
+    size += fvm_heap_size(next);
+  }
+
+  if ((flags & HEAP_PREV_USED) == 0) {
+    int64_t prev = h - fvm_mem[h-1].value;
+    fvm_heap_remove(prev);
+    size += h - prev;
+    h = prev;
+    flags = fvm_mem[prev].value;
+  }
+
+  fvm_heap_push(h, size, flags);
+}
+
+// Shrinks the allocated block h to need cells and frees the rest.
+static void fvm_heap_shrink(int64_t h, int64_t need) {
+  int64_t size = fvm_heap_size(h);
+
+  if (size - need < HEAP_MIN_BLOCK) {
+    return;
+  }
+
+  fvm_heap_set(h, need, fvm_mem[h].value & (HEAP_USED | HEAP_PREV_USED));
+  fvm_heap_set(h + need, size - need, HEAP_USED | HEAP_PREV_USED);
+  fvm_heap_release(h + need);
+}
+
+// Returns the first free block with at least need cells or 0.
+static int64_t fvm_heap_find(int64_t need) {
+  for (int c = fvm_heap_class(need); c < HEAP_CLASSES; c++) {
+    for (int64_t h = fvm_heap_lists[c]; h != 0; h = fvm_mem[h+1].value) {
+      if (fvm_heap_size(h) >= need) {
+        return h;
+      }
+    }
+  }
+
+  return 0;
+}
+
+// The end of the heap region at the highest address or 0.
+static int64_t fvm_heap_end(void) {
+  int64_t end = 0;
+
+  for (size_t i = 0; i < fvm_heap_nregions; i++) {
+    if (fvm_heap_regions[i].end > end) {
+      end = fvm_heap_regions[i].end;
+    }
+  }
+
+  return end;
+}
+
+// Takes at least need cells from here for the heap and returns the new here.
+// The heap grows behind its last region, if here is below it.
+static int64_t fvm_heap_grow(int64_t need, int64_t here) {
+  int64_t n = need + 1 > HEAP_MIN_GROW ? need + 1 : HEAP_MIN_GROW;
+  int64_t start = here > 1 ? here : 1;
+  int64_t end;
+
+  if (fvm_heap_end() > start) {
+    start = fvm_heap_end();
+  }
+
+  end = start + n;
+
+  if (end > fvm_mem_size) {
+    fvm_memresize(2 * end);
+  }
+
+  fvm_heap_set(end - 1, 0, HEAP_USED);
+
+  if (fvm_heap_nregions > 0 && fvm_heap_regions[fvm_heap_nregions-1].end == start) {
+    // the last region is extended, its end block becomes the new block
+    int64_t h = start - 1;
+    fvm_heap_set(h, n, (fvm_mem[h].value & HEAP_PREV_USED) | HEAP_USED);
+    fvm_heap_regions[fvm_heap_nregions-1].end = end;
+    fvm_heap_release(h);
+  } else {
+    heap_region_t *tmp = (heap_region_t*)realloc(fvm_heap_regions, sizeof(heap_region_t) * (fvm_heap_nregions + 1));
+    if (tmp == NULL) {
+      myerror("Unable to allocate memory");
+    }
+    fvm_heap_regions = tmp;
+    fvm_heap_regions[fvm_heap_nregions++] = (heap_region_t){ start, end };
+    fvm_heap_set(start, n - 1, HEAP_USED | HEAP_PREV_USED);
+    fvm_heap_release(start);
+  }
+
+  return end;
+}
+
+static void fvm_heap_collect(int64_t here, int64_t keep);
+
+// Returns the address of n zeroed cells and sets here.
+// The block at the address keep survives a collection.
+static int64_t fvm_heap_allocate(int64_t n, int64_t *here, int64_t keep) {
+  if (n < 0) myerror("allocate - invalid size");
+
+  int64_t need = n + 1 > HEAP_MIN_BLOCK ? n + 1 : HEAP_MIN_BLOCK;
+  int64_t h = fvm_heap_find(need);
+
+  if (h == 0 && fvm_heap_auto && fvm_heap_nregions > 0) {
+    fvm_heap_collect(*here, keep);
+    h = fvm_heap_find(need);
+  }
+
+  if (h == 0) {
+    *here = fvm_heap_grow(need, *here);
+    h = fvm_heap_find(need);
+  }
+
+  fvm_heap_remove(h);
+  int64_t size = fvm_heap_size(h);
+  fvm_heap_set(h, size, (fvm_mem[h].value & HEAP_PREV_USED) | HEAP_USED);
+  fvm_mem[h+size].value |= HEAP_PREV_USED;
+  fvm_heap_shrink(h, need);
+  memset(fvm_mem + h + 1, 0, sizeof(cell_t) * (size_t)(fvm_heap_size(h) - 1));
+  fvm_heap_allocs++;
+
+  return h + 1;
+}
+
+// Returns the header of the block allocated at addr.
+static int64_t fvm_heap_block(int64_t addr) {
+  int64_t h = addr - 1;
+
+  for (size_t i = 0; i < fvm_heap_nregions; i++) {
+    heap_region_t r = fvm_heap_regions[i];
+    if (h >= r.start && h < r.end - 1 && (fvm_mem[h].value & HEAP_USED) != 0) {
+      int64_t size = fvm_heap_size(h);
+      if (size >= HEAP_MIN_BLOCK && h + size < r.end) {
+        return h;
+      }
+    }
+  }
+
+  return -1;
+}
+
+static void fvm_heap_free(int64_t addr) {
+  if (addr == 0) {
+    return;
+  }
+
+  int64_t h = fvm_heap_block(addr);
+  if (h < 0) myerror("free - not an allocated address");
+
+  fvm_heap_release(h);
+  fvm_heap_frees++;
+}
+
+// Changes the size of the block at addr to n cells, sets here and returns
+// the address of the block. New cells are zeroed.
+static int64_t fvm_heap_resize(int64_t addr, int64_t n, int64_t *here) {
+  if (addr == 0) {
+    return fvm_heap_allocate(n, here, 0);
+  }
+
+  int64_t h = fvm_heap_block(addr);
+  if (h < 0) myerror("resize - not an allocated address");
+
+  int64_t need = n + 1 > HEAP_MIN_BLOCK ? n + 1 : HEAP_MIN_BLOCK;
+  int64_t size = fvm_heap_size(h);
+
+  if (need > size) {
+    int64_t next = h + size;
+
+    if ((fvm_mem[next].value & HEAP_USED) != 0 || size + fvm_heap_size(next) < need) {
+      // the block is moved
+      int64_t result = fvm_heap_allocate(n, here, addr);
+      memcpy(fvm_mem + result, fvm_mem + addr, sizeof(cell_t) * (size_t)(size - 1));
+      fvm_heap_free(addr);
+      return result;
+    }
+
+    fvm_heap_remove(next);
+    int64_t merged = size + fvm_heap_size(next);
+    fvm_heap_set(h, merged, fvm_mem[h].value & (HEAP_USED | HEAP_PREV_USED));
+    fvm_mem[h+merged].value |= HEAP_PREV_USED;
+    memset(fvm_mem + h + size, 0, sizeof(cell_t) * (size_t)(merged - size));
+  }
+
+  fvm_heap_shrink(h, need);
+
+  return addr;
+}
+
+// The state of a collection: the headers of the allocated blocks in
+// ascending order and the marked blocks, which are not scanned yet.
+static int64_t *fvm_gc_blocks = NULL;
+static size_t fvm_gc_nblocks = 0;
+static int64_t *fvm_gc_work = NULL;
+static size_t fvm_gc_nwork = 0;
+
+static int fvm_gc_compare(const void *a, const void *b) {
+  int64_t x = *(const int64_t*)a;
+  int64_t y = *(const int64_t*)b;
+  return (x > y) - (x < y);
+}
+
+static void fvm_gc_mark(int64_t v) {
+  size_t lo = 0, hi = fvm_gc_nblocks;
+
+  while (lo < hi) {
+    size_t mid = lo + (hi - lo) / 2;
+    if (fvm_gc_blocks[mid] < v) {
+      lo = mid + 1;
+    } else {
+      hi = mid;
+    }
+  }
+
+  if (lo == 0) {
+    return;
+  }
+
+  int64_t h = fvm_gc_blocks[lo-1];
+  if (v < h + fvm_heap_size(h) && (fvm_mem[h].value & HEAP_MARKED) == 0) {
+    fvm_mem[h].value |= HEAP_MARKED;
+    fvm_gc_work[fvm_gc_nwork++] = h;
+  }
+}
+
+static void fvm_gc_mark_range(int64_t from, int64_t to) {
+  for (int64_t addr = from; addr < to; addr++) {
+    fvm_gc_mark(fvm_mem[addr].value);
+  }
+}
+
+// Frees the allocated blocks, which can not be reached from the stacks,
+// the locals, the variables, the memory below here or the address keep.
+// Every cell is treated as a possible address, also of a cell within a
+// block.
+static void fvm_heap_collect(int64_t here, int64_t keep) {
+  size_t count = 0;
+
+  for (size_t i = 0; i < fvm_heap_nregions; i++) {
+    for (int64_t h = fvm_heap_regions[i].start; fvm_heap_size(h) > 0; h += fvm_heap_size(h)) {
+      if ((fvm_mem[h].value & HEAP_USED) != 0) {
+        count++;
+      }
+    }
+  }
+
+  fvm_gc_blocks = (int64_t*)malloc(sizeof(int64_t) * (count + 1));
+  fvm_gc_work = (int64_t*)malloc(sizeof(int64_t) * (count + 1));
+  if (fvm_gc_blocks == NULL || fvm_gc_work == NULL) {
+    myerror("Unable to allocate memory");
+  }
+  fvm_gc_nblocks = 0;
+  fvm_gc_nwork = 0;
+
+  for (size_t i = 0; i < fvm_heap_nregions; i++) {
+    for (int64_t h = fvm_heap_regions[i].start; fvm_heap_size(h) > 0; h += fvm_heap_size(h)) {
+      if ((fvm_mem[h].value & HEAP_USED) != 0) {
+        fvm_gc_blocks[fvm_gc_nblocks++] = h;
+      }
+    }
+  }
+
+  qsort(fvm_gc_blocks, fvm_gc_nblocks, sizeof(int64_t), fvm_gc_compare);
+
+  for (ptrdiff_t i = 0; i <= fvm_n; i++) {
+    fvm_gc_mark(fvm_stack[i].value);
+  }
+
+  for (ptrdiff_t i = 0; i <= fvm_rn; i++) {
+    fvm_gc_mark(fvm_rstack[i].value);
+  }
+
+  fvm_gc_mark(keep);
+
+  for (size_t i = 0; fvm_globals != NULL && fvm_globals[i] != NULL; i++) {
+    fvm_gc_mark(fvm_globals[i]->value);
+  }
+
+  for (ptrdiff_t i = 0; i <= fvm_ln; i++) {
+    fvm_gc_mark(fvm_locals[i].value);
+  }
+
+  // the memory below here without the heap
+  if (here > fvm_mem_size) {
+    here = fvm_mem_size;
+  }
+
+  for (int64_t addr = 0; addr < here;) {
+    int64_t next = here;
+    int inside = 0;
+
+    for (size_t i = 0; i < fvm_heap_nregions; i++) {
+      heap_region_t r = fvm_heap_regions[i];
+      if (addr >= r.start && addr < r.end) {
+        addr = r.end;
+        inside = 1;
+        break;
+      }
+      if (r.start > addr && r.start < next) {
+        next = r.start;
+      }
+    }
+
+    if (!inside) {
+      fvm_gc_mark_range(addr, next);
+      addr = next;
+    }
+  }
+
+  while (fvm_gc_nwork > 0) {
+    int64_t h = fvm_gc_work[--fvm_gc_nwork];
+    fvm_gc_mark_range(h + 1, h + fvm_heap_size(h));
+  }
+
+  for (size_t i = 0; i < fvm_gc_nblocks; i++) {
+    int64_t h = fvm_gc_blocks[i];
+    if ((fvm_mem[h].value & HEAP_MARKED) != 0) {
+      fvm_mem[h].value &= ~(int64_t)HEAP_MARKED;
+    } else {
+      fvm_heap_release(h);
+      fvm_heap_frees++;
+    }
+  }
+
+  free(fvm_gc_blocks);
+  free(fvm_gc_work);
+  fvm_gc_blocks = NULL;
+  fvm_gc_work = NULL;
+  fvm_gc_nblocks = 0;
+  fvm_heap_collections++;
+}
+
+// Pushes the cells of the heap, the cells of the allocated and the free
+// blocks, the number of allocated blocks, of allocations, of frees and
+// of collections.
+static void fvm_heap_stats(void) {
+  int64_t size = 0, used = 0, unused = 0, blocks = 0;
+
+  for (size_t i = 0; i < fvm_heap_nregions; i++) {
+    size += fvm_heap_regions[i].end - fvm_heap_regions[i].start;
+
+    for (int64_t h = fvm_heap_regions[i].start; fvm_heap_size(h) > 0; h += fvm_heap_size(h)) {
+      if ((fvm_mem[h].value & HEAP_USED) != 0) {
+        used += fvm_heap_size(h);
+        blocks++;
+      } else {
+        unused += fvm_heap_size(h);
+      }
+    }
+  }
+
+  fvm_push(fvm_cell(size));
+  fvm_push(fvm_cell(used));
+  fvm_push(fvm_cell(unused));
+  fvm_push(fvm_cell(blocks));
+  fvm_push(fvm_cell(fvm_heap_allocs));
+  fvm_push(fvm_cell(fvm_heap_frees));
+  fvm_push(fvm_cell(fvm_heap_collections));
+}
+
 static inline void fvm_sys(void) {
   cell_t sys = fvm_pop();
 
@@ -458,33 +1046,34 @@ static inline void fvm_sys(void) {
     // num-bytes read
     {
       cell_t c = fvm_pop();
-      char buf[(size_t)c.value];
-      ssize_t n = read(STDIN_FILENO, &buf, (size_t)c.value);
+      char buf[fvm_input_n + (size_t)c.value + 1];
+      memcpy(buf, fvm_input, fvm_input_n);
+      ssize_t n = read(STDIN_FILENO, buf + fvm_input_n, (size_t)c.value);
       if (n <= 0) {
+        fvm_input_n = 0;
         fvm_stringtostack("");
       } else {
-        buf[n] = '\0';
+        // an incomplete code point at the end is completed by the next read
+        size_t end = fvm_input_n + (size_t)n;
+        for (size_t start = end; start > 0 && start + 4 > end; start--) {
+          unsigned char b = (unsigned char)buf[start-1];
+          if ((b & 0xC0) != 0x80) {
+            if (b >= 0xC0 && start - 1 + (size_t)fvm_runesize(b) > end) {
+              end = start - 1;
+            }
+            break;
+          }
+        }
+        fvm_input_n = fvm_input_n + (size_t)n - end;
+        memcpy(fvm_input, buf + end, fvm_input_n);
+        buf[end] = '\0';
         fvm_stringtostack(buf);
       }
     }
     break;
   case 10:
-    // allocate
-    {
-      cell_t n = fvm_pop();
-      if (n.value == 0) {
-        fvm_free();
-      } else {
-        cell_t *tmp = (cell_t*)calloc((size_t)n.value, sizeof(cell_t));
-        if (tmp == NULL) {
-          myerror("Unable to allocate memory");
-        }
-        fvm_copy(tmp, n.value, fvm_mem, fvm_mem_size);
-        fvm_free();
-        fvm_mem_size = n.value;
-        fvm_mem = tmp;
-      }
-    }
+    // memresize
+    fvm_memresize(fvm_pop().value);
     break;
   case 11:
     // memsize
@@ -546,6 +1135,79 @@ static inline void fvm_sys(void) {
       fvm_stringtostack(arg);
     }
     break;
+  case 18:
+    // capture
+    {
+      if (fvm_captures_n == VM_CAPTURES) myerror("capture - too many captures");
+      capture_t *c = &fvm_captures[fvm_captures_n];
+      c->fp = open_memstream(&c->buf, &c->size);
+      if (c->fp == NULL) {
+        myerror("Unable to allocate memory");
+      }
+      fvm_captures_n++;
+    }
+    break;
+  case 19:
+    // captured
+    {
+      if (fvm_captures_n == 0) myerror("sys() - \"captured\" without \"capture\"");
+      capture_t *c = &fvm_captures[--fvm_captures_n];
+      fclose(c->fp);
+      fvm_stringtostack(c->buf);
+      free(c->buf);
+    }
+    break;
+  case 20:
+    // addr len type
+    {
+      cell_t n = fvm_pop();
+      cell_t addr = fvm_pop();
+      for (int64_t i = 0; i < n.value; i++) {
+        fvm_putrune(fvm_mem[addr.value + i].value);
+      }
+    }
+    break;
+  case 21:
+    // here n allocate
+    {
+      cell_t n = fvm_pop();
+      int64_t here = fvm_pop().value;
+      int64_t addr = fvm_heap_allocate(n.value, &here, 0);
+      fvm_push(fvm_cell(addr));
+      fvm_push(fvm_cell(here));
+    }
+    break;
+  case 22:
+    // addr free
+    fvm_heap_free(fvm_pop().value);
+    break;
+  case 23:
+    // here addr n resize
+    {
+      cell_t n = fvm_pop();
+      cell_t addr = fvm_pop();
+      int64_t here = fvm_pop().value;
+      int64_t result = fvm_heap_resize(addr.value, n.value, &here);
+      fvm_push(fvm_cell(result));
+      fvm_push(fvm_cell(here));
+    }
+    break;
+  case 24:
+    // here gc
+    fvm_heap_collect(fvm_pop().value, 0);
+    break;
+  case 25:
+    // bool gc-auto
+    fvm_heap_auto = fvm_pop().value != 0;
+    break;
+  case 26:
+    // heap-info
+    fvm_heap_stats();
+    break;
+  case 27:
+    // heap-end
+    fvm_push(fvm_cell(fvm_heap_end()));
+    break;
   default:
     if (fvm_sys_custom != NULL) {
       fvm_sys_custom(sys.value);
@@ -0,0 +1,866 @@
+package goforth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A language server for Forth sources. It speaks the Language Server
+// Protocol (JSON-RPC with Content-Length headers) and uses the compiler
+// to analyze the open documents.
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspCompletionItem struct {
+	Label  string `json:"label"`
+	Kind   int    `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type lspRequest struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type lspPositionParams struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+	Context  struct {
+		IncludeDeclaration bool `json:"includeDeclaration"`
+	} `json:"context"`
+}
+
+type lspDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+
+	lspKindFunction = 3
+	lspKindVariable = 6
+	lspKindKeyword  = 14
+)
+
+var errLSPExit = errors.New("exit")
+
+// The words of the control structures handled by the compiler.
+var controlWords = []string{
+	"if", "else", "then", "case", "of", "?of", "endof", "endcase", "begin", "while",
+	"repeat", "until", "again", "do", "?do", "loop", "+loop", "-loop", "leave",
+	"to", "char", "done", "exec", "send", "super",
+}
+
+// A token of a source file with its position. Comments and strings are skipped.
+type lspToken struct {
+	text string
+	line int
+	col  int
+	def  bool // the name of a definition
+}
+
+type lspDocument struct {
+	uri    string
+	path   string
+	text   string
+	tokens []lspToken
+	fc     *ForthCompiler
+}
+
+type lspServer struct {
+	in       *bufio.Reader
+	out      io.Writer
+	docs     map[string]*lspDocument
+	shutdown bool
+}
+
+// Runs a language server reading requests from in and writing responses
+// to out until the client sends "exit".
+func ServeLSP(in io.Reader, out io.Writer) error {
+	s := &lspServer{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: make(map[string]*lspDocument),
+	}
+
+	for {
+		data, err := s.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var req lspRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			if err := s.reply(nil, nil, &lspError{-32700, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		result, rerr := s.handle(req)
+
+		if rerr == errLSPExit {
+			if !s.shutdown {
+				return errors.New("lsp: exit without shutdown")
+			}
+			return nil
+		}
+
+		var lerr *lspError
+		if rerr != nil && !errors.As(rerr, &lerr) {
+			if len(req.ID) == 0 {
+				return rerr
+			}
+			lerr = &lspError{-32603, rerr.Error()}
+		}
+
+		// notifications have no id and get no response
+		if len(req.ID) == 0 {
+			continue
+		}
+
+		if err := s.reply(req.ID, result, lerr); err != nil {
+			return err
+		}
+	}
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string {
+	return e.Message
+}
+
+func (s *lspServer) read() ([]byte, error) {
+	length := -1
+
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("lsp: invalid header \"%s\"", line)
+			}
+		}
+	}
+
+	if length < 0 {
+		return nil, errors.New("lsp: missing Content-Length header")
+	}
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(s.in, data)
+	return data, err
+}
+
+func (s *lspServer) write(msg any) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (s *lspServer) reply(id json.RawMessage, result any, lerr *lspError) error {
+	msg := map[string]any{"jsonrpc": "2.0", "id": id}
+
+	if id == nil {
+		msg["id"] = nil
+	}
+
+	if lerr != nil {
+		msg["error"] = lerr
+	} else {
+		msg["result"] = result
+	}
+
+	return s.write(msg)
+}
+
+func (s *lspServer) notify(method string, params any) error {
+	return s.write(map[string]any{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *lspServer) handle(req lspRequest) (any, error) {
+	switch req.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":   1, // full
+				"definitionProvider": true,
+				"hoverProvider":      true,
+				"referencesProvider": true,
+				"completionProvider": map[string]any{"triggerCharacters": []string{":"}},
+			},
+			"serverInfo": map[string]any{"name": "goforth"},
+		}, nil
+	case "initialized", "$/cancelRequest", "textDocument/didSave":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "exit":
+		return nil, errLSPExit
+	case "textDocument/didOpen", "textDocument/didChange", "textDocument/didClose":
+		var params lspDocumentParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &lspError{-32602, err.Error()}
+		}
+		uri := params.TextDocument.URI
+		switch req.Method {
+		case "textDocument/didOpen":
+			return nil, s.update(uri, params.TextDocument.Text)
+		case "textDocument/didChange":
+			if len(params.ContentChanges) == 0 {
+				return nil, nil
+			}
+			return nil, s.update(uri, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		default:
+			delete(s.docs, uri)
+			return nil, s.notify("textDocument/publishDiagnostics",
+				map[string]any{"uri": uri, "diagnostics": []lspDiagnostic{}})
+		}
+	case "textDocument/definition", "textDocument/hover", "textDocument/completion", "textDocument/references":
+		var params lspPositionParams
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &lspError{-32602, err.Error()}
+		}
+		doc, ok := s.docs[params.TextDocument.URI]
+		if !ok {
+			return nil, &lspError{-32602, fmt.Sprintf("unknown document \"%s\"", params.TextDocument.URI)}
+		}
+		switch req.Method {
+		case "textDocument/definition":
+			return s.definition(doc, params.Position), nil
+		case "textDocument/hover":
+			return s.hover(doc, params.Position), nil
+		case "textDocument/completion":
+			return s.completion(doc, params.Position), nil
+		default:
+			return s.references(doc, params.Position, params.Context.IncludeDeclaration), nil
+		}
+	default:
+		return nil, &lspError{-32601, fmt.Sprintf("method \"%s\" not found", req.Method)}
+	}
+}
+
+// Analyzes the new text of a document and publishes the diagnostics.
+func (s *lspServer) update(uri, text string) error {
+	doc := &lspDocument{uri: uri, path: uriToPath(uri), text: text}
+	doc.tokens = lspTokenize(text)
+	s.docs[uri] = doc
+
+	diagnostics := doc.analyze()
+
+	return s.notify("textDocument/publishDiagnostics", map[string]any{"uri": uri, "diagnostics": diagnostics})
+}
+
+var lspErrorPosition = regexp.MustCompile(`^(.*?) Line (\d+) at (\d+): `)
+
+func (doc *lspDocument) analyze() []lspDiagnostic {
+	diagnostics := make([]lspDiagnostic, 0, 10)
+
+	add := func(severity int, msg string) {
+		for _, d := range diagnostics {
+			if d.Message == msg {
+				return
+			}
+		}
+
+		diagnostics = append(diagnostics, lspDiagnostic{
+			Range:    doc.locate(msg),
+			Severity: severity,
+			Source:   "goforth",
+			Message:  msg,
+		})
+	}
+
+	fc := NewForthCompiler()
+	fc.noComptime = true // the code of the document may not terminate
+	doc.fc = fc
+
+	if manifest, err := FindManifest(filepath.Dir(doc.path)); err != nil {
+		add(lspSeverityError, err.Error())
+	} else {
+		fc.Manifest = manifest
+	}
+
+	if err := fc.ParseFile("core"); err != nil {
+		add(lspSeverityError, err.Error())
+		return diagnostics
+	}
+
+	if err := fc.Parse(doc.text, doc.path); err != nil {
+		add(lspSeverityError, err.Error())
+		return diagnostics
+	}
+
+	if err := fc.Preprocess(); err != nil {
+		add(lspSeverityError, err.Error())
+		return diagnostics
+	}
+
+	// words not used by main are checked by compiling them from a generated main
+	realMain, hasMain := fc.defs["main"]
+	words := NewStack[string]()
+
+	for word, loc := range fc.locations {
+		// defining words are only run by meta commands
+		if _, ok := fc.defs[word]; ok && loc.File == doc.path && word != "main" && !fc.isDefiningWord(word) {
+			words.Push(word)
+		}
+	}
+
+	sort.Strings(words.data)
+
+	check := func(main *Stack[string], generated bool) {
+		fc.defs["main"] = main
+
+		warnings := fc.CheckStackEffects()
+		if TypeCheck {
+			warnings = append(warnings, fc.CheckTypes()...)
+		}
+
+		for _, warning := range warnings {
+			if !generated || !strings.HasPrefix(warning, "word \"main\"") {
+				add(lspSeverityWarning, warning)
+			}
+		}
+
+		stackCheck, typeCheck := StackCheck, TypeCheck
+		StackCheck, TypeCheck = false, false
+		err := fc.Compile()
+		StackCheck, TypeCheck = stackCheck, typeCheck
+
+		if err != nil {
+			add(lspSeverityError, err.Error())
+		}
+	}
+
+	if hasMain {
+		check(realMain, false)
+		defer func() { fc.defs["main"] = realMain }()
+	} else {
+		defer delete(fc.defs, "main")
+	}
+
+	check(words, true)
+
+	return diagnostics
+}
+
+// Finds the position in the document a message of the compiler refers to.
+func (doc *lspDocument) locate(msg string) lspRange {
+	lines := strings.Split(doc.text, "\n")
+
+	lineRange := func(line int) lspRange {
+		line = max(0, min(line, len(lines)-1))
+		return lspRange{lspPosition{line, 0}, lspPosition{line, len([]rune(lines[line]))}}
+	}
+
+	if m := lspErrorPosition.FindStringSubmatch(msg); m != nil && m[1] == doc.path {
+		line, _ := strconv.Atoi(m[2])
+		return lineRange(line - 1)
+	}
+
+	// the first quoted name in the message
+	_, rest, ok := strings.Cut(msg, "\"")
+	name, _, ok2 := strings.Cut(rest, "\"")
+
+	if !ok || !ok2 {
+		return lineRange(0)
+	}
+
+	if loc, ok := doc.fc.locations[name]; ok && loc.File == doc.path {
+		for _, tok := range doc.tokens {
+			if tok.def && doc.fc.nameIn(doc.path, tok.text) == name {
+				return tok.span()
+			}
+		}
+		return lineRange(loc.Line - 1)
+	}
+
+	for _, tok := range doc.tokens {
+		if tok.text == name {
+			return tok.span()
+		}
+	}
+
+	return lineRange(0)
+}
+
+func (tok lspToken) span() lspRange {
+	return lspRange{
+		lspPosition{tok.line, tok.col},
+		lspPosition{tok.line, tok.col + len([]rune(tok.text))},
+	}
+}
+
+// Splits Forth source code into tokens like Parse does.
+func lspTokenize(text string) []lspToken {
+	var (
+		tokens  []lspToken
+		line    int
+		col     int
+		current []rune
+		start   lspPosition
+	)
+
+	runes := []rune(text)
+
+	flush := func() {
+		if len(current) > 0 {
+			tok := lspToken{text: string(current), line: start.Line, col: start.Character}
+			n := len(tokens)
+			tok.def = n > 0 && tokens[n-1].text == ":" ||
+				n > 1 && (tokens[n-1].text == "inline" || tokens[n-1].text == "class") && tokens[n-2].text == ":"
+			tokens = append(tokens, tok)
+			current = current[:0]
+		}
+	}
+
+	// skips to the rune end and returns the index after it
+	skip := func(i int, end rune) int {
+		for ; i < len(runes); i++ {
+			if runes[i] == '\\' && i+1 < len(runes) && runes[i+1] == end {
+				i++
+				col += 2
+				continue
+			}
+			if runes[i] == '\n' {
+				line++
+				col = 0
+				continue
+			}
+			col++
+			if runes[i] == end {
+				return i + 1
+			}
+		}
+		return i
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case r == '\n':
+			flush()
+			line++
+			col = 0
+			i++
+		case r == ' ' || r == '\t' || r == '\r':
+			flush()
+			col++
+			i++
+		case len(current) == 0 && (r == '.' || r == 'a' || r == 'g' || r == 's') && i+1 < len(runes) &&
+			(runes[i+1] == '"' || runes[i+1] == '('):
+			// strings
+			end := '"'
+			if runes[i+1] == '(' {
+				end = ')'
+			}
+			col += 2
+			i = skip(i+2, end)
+		case r == '\\':
+			flush()
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+		case r == '(':
+			flush()
+			col++
+			i = skip(i+1, ')')
+		default:
+			if len(current) == 0 {
+				start = lspPosition{line, col}
+			}
+			current = append(current, r)
+			col++
+			i++
+		}
+	}
+
+	flush()
+	return tokens
+}
+
+// Returns the token at pos.
+func (doc *lspDocument) tokenAt(pos lspPosition) (lspToken, bool) {
+	for _, tok := range doc.tokens {
+		if tok.line == pos.Line && tok.col <= pos.Character && pos.Character <= tok.col+len([]rune(tok.text)) {
+			return tok, true
+		}
+	}
+
+	return lspToken{}, false
+}
+
+// Returns the names of the locals declared before pos in the enclosing definition.
+func (doc *lspDocument) localsAt(pos lspPosition) []string {
+	var locals []string
+
+	for i := 0; i < len(doc.tokens); i++ {
+		tok := doc.tokens[i]
+
+		if tok.line > pos.Line || tok.line == pos.Line && tok.col >= pos.Character {
+			break
+		}
+
+		switch tok.text {
+		case ":":
+			locals = locals[:0]
+		case "{":
+			for i++; i < len(doc.tokens) && doc.tokens[i].text != "}"; i++ {
+				locals = append(locals, doc.tokens[i].text)
+			}
+		}
+	}
+
+	return locals
+}
+
+func uriToPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return uri
+	}
+
+	return filepath.FromSlash(u.Path)
+}
+
+func pathToURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// Resolves a file name given to use to a path. A file of the embedded
+// stdlib resolves to an identical copy in the config path or else to a
+// read-only copy in the cache, which is written for the editor.
+func resolveSourcePath(fc *ForthCompiler, filename string) (string, error) {
+	key, ok := fc.files[filename]
+	if !ok {
+		key = fc.fileKey(filename)
+	}
+
+	if isURL(key) {
+		return "", fmt.Errorf("\"%s\" is not a local file", filename)
+	}
+
+	if filepath.IsAbs(key) {
+		return key, nil
+	}
+
+	data, err := Stdlib.ReadFile(key)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimPrefix(key, "stdlib/")
+	path := filepath.Join(ConfigPath(), "stdlib", name)
+
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return path, nil
+	}
+
+	return stdlibCopy(name, data)
+}
+
+// Returns the read-only copy of the stdlib file name with data in the
+// cache. The copies of other versions of the file are kept apart by the
+// checksum of data.
+func stdlibCopy(name string, data []byte) (string, error) {
+	sum := strings.TrimPrefix(moduleSum(data), "sha256:")
+	path := filepath.Join(ConfigPath(), "cache", "stdlib", sum[:16], name)
+
+	if old, err := os.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return path, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), name+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", err
+	}
+
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// Returns the URI and the text of the file a definition is located in.
+func (s *lspServer) source(doc *lspDocument, file string) (string, string, bool) {
+	if file == doc.path {
+		return doc.uri, doc.text, true
+	}
+
+	for _, other := range s.docs {
+		if other.path == file {
+			return other.uri, other.text, true
+		}
+	}
+
+	path, err := resolveSourcePath(doc.fc, file)
+	if err != nil {
+		return "", "", false
+	}
+
+	uri := pathToURI(path)
+	if other, ok := s.docs[uri]; ok {
+		return uri, other.text, true
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", "", false
+	}
+
+	return uri, string(data), true
+}
+
+func (s *lspServer) definition(doc *lspDocument, pos lspPosition) []lspLocation {
+	tok, ok := doc.tokenAt(pos)
+	if !ok || doc.fc == nil {
+		return nil
+	}
+
+	loc, ok := doc.fc.locations[doc.fc.nameIn(doc.path, tok.text)]
+	if !ok {
+		return nil
+	}
+
+	uri, text, ok := s.source(doc, loc.File)
+	if !ok {
+		return nil
+	}
+
+	var found *lspToken
+
+	for _, t := range lspTokenize(text) {
+		if t.line == loc.Line-1 && t.def {
+			if t.text == tok.text {
+				return []lspLocation{{uri, t.span()}}
+			}
+			found = &t
+		}
+	}
+
+	// words generated by a class are located at the name of the class
+	if found != nil {
+		return []lspLocation{{uri, found.span()}}
+	}
+
+	start := lspPosition{max(0, loc.Line-1), 0}
+	return []lspLocation{{uri, lspRange{start, start}}}
+}
+
+func (s *lspServer) hover(doc *lspDocument, pos lspPosition) any {
+	tok, ok := doc.tokenAt(pos)
+	if !ok || doc.fc == nil {
+		return nil
+	}
+
+	fc := doc.fc
+	word := fc.nameIn(doc.path, tok.text)
+	var b strings.Builder
+
+	switch {
+	case slices.Contains(doc.localsAt(pos), tok.text):
+		fmt.Fprintf(&b, "local `%s`", tok.text)
+	case fc.vars.Contains(word):
+		fmt.Fprintf(&b, "variable `%s`", word)
+	case fc.data[word] != "":
+		op := fc.data[word]
+		if se, ok := primitiveEffects[op]; ok {
+			fmt.Fprintf(&b, "```forth\n%s %s\n```\n", word, se)
+		}
+		fmt.Fprintf(&b, "primitive `%s`", op)
+	case fc.inlines[word] != nil:
+		fmt.Fprintf(&b, "```forth\n: inline %s", word)
+		if effect, ok := fc.effects[word]; ok {
+			fmt.Fprintf(&b, " ( %s )", effect)
+		}
+		b.WriteString("\n```\nmacro")
+	case fc.defs[word] != nil:
+		fmt.Fprintf(&b, "```forth\n: %s ", word)
+		if effect, ok := fc.effects[word]; ok {
+			fmt.Fprintf(&b, "( %s )", effect)
+		} else if se, ok := newEffectChecker(fc).effectOf(word); ok {
+			fmt.Fprintf(&b, "%s \\ inferred", se)
+		}
+		fmt.Fprintf(&b, "\n  %s ;\n```", strings.Join(fc.defs[word].data, " "))
+	case slices.Contains(controlWords, word):
+		fmt.Fprintf(&b, "control word `%s`", word)
+	default:
+		return nil
+	}
+
+	if loc, ok := fc.locations[word]; ok {
+		fmt.Fprintf(&b, "\n\ndefined in %s line %d", loc.File, loc.Line)
+	}
+
+	return map[string]any{
+		"contents": map[string]any{"kind": "markdown", "value": b.String()},
+		"range":    tok.span(),
+	}
+}
+
+func (s *lspServer) completion(doc *lspDocument, pos lspPosition) []lspCompletionItem {
+	items := make([]lspCompletionItem, 0, 100)
+
+	if doc.fc == nil {
+		return items
+	}
+
+	// the part of the word left of the cursor
+	var prefix string
+	if tok, ok := doc.tokenAt(pos); ok {
+		prefix = string([]rune(tok.text)[:pos.Character-tok.col])
+	}
+
+	fc := doc.fc
+	seen := make(map[string]bool)
+
+	add := func(label string, kind int, detail string) {
+		if strings.HasPrefix(label, prefix) && !seen[label] {
+			seen[label] = true
+			items = append(items, lspCompletionItem{label, kind, detail})
+		}
+	}
+
+	for _, name := range doc.localsAt(pos) {
+		add(name, lspKindVariable, "local")
+	}
+
+	for name := range fc.vars.Values() {
+		add(name, lspKindVariable, "variable")
+	}
+
+	for name := range fc.defs {
+		// words without a location are generated, e.g. blocks
+		if _, ok := fc.locations[name]; ok {
+			add(name, lspKindFunction, fc.effects[name])
+		}
+	}
+
+	for name := range fc.inlines {
+		add(name, lspKindFunction, "macro")
+	}
+
+	for name, op := range fc.data {
+		add(name, lspKindKeyword, op)
+	}
+
+	for _, name := range controlWords {
+		add(name, lspKindKeyword, "")
+	}
+
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+	return items
+}
+
+func (s *lspServer) references(doc *lspDocument, pos lspPosition, includeDeclaration bool) []lspLocation {
+	tok, ok := doc.tokenAt(pos)
+	if !ok || doc.fc == nil {
+		return nil
+	}
+
+	result := make([]lspLocation, 0, 10)
+	files := []string{doc.path}
+
+	for _, loc := range doc.fc.locations {
+		if !slices.Contains(files, loc.File) {
+			files = append(files, loc.File)
+		}
+	}
+
+	visited := make(map[string]bool)
+
+	for _, file := range files {
+		uri, text, ok := s.source(doc, file)
+		if !ok || visited[uri] {
+			continue
+		}
+
+		visited[uri] = true
+
+		for _, t := range lspTokenize(text) {
+			if t.text == tok.text && (includeDeclaration || !t.def) {
+				result = append(result, lspLocation{uri, t.span()})
+			}
+		}
+	}
+
+	return result
+}
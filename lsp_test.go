@@ -0,0 +1,266 @@
+package goforth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// A client talking to a language server over an in-memory pipe.
+type lspClient struct {
+	t      *testing.T
+	in     *bufio.Reader
+	out    io.WriteCloser
+	id     int
+	done   chan error
+	notify []map[string]any
+}
+
+func startLSP(t *testing.T) *lspClient {
+	t.Helper()
+
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+
+	c := &lspClient{t: t, in: bufio.NewReader(clientIn), out: clientOut, done: make(chan error, 1)}
+
+	go func() {
+		err := ServeLSP(serverIn, serverOut)
+		serverOut.Close()
+		c.done <- err
+	}()
+
+	return c
+}
+
+func (c *lspClient) send(msg map[string]any) {
+	c.t.Helper()
+
+	msg["jsonrpc"] = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if _, err := fmt.Fprintf(c.out, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *lspClient) receive() map[string]any {
+	c.t.Helper()
+
+	length := -1
+
+	for {
+		line, err := c.in.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		if value, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+			length, _ = strconv.Atoi(value)
+		}
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.in, data); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var msg map[string]any
+	if err := json.Unmarshal(data, &msg); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return msg
+}
+
+// Sends a request and returns its result. Notifications are collected.
+func (c *lspClient) request(method string, params any) any {
+	c.t.Helper()
+
+	c.id++
+	c.send(map[string]any{"id": c.id, "method": method, "params": params})
+
+	for {
+		msg := c.receive()
+
+		if _, ok := msg["method"]; ok {
+			c.notify = append(c.notify, msg)
+			continue
+		}
+
+		if msg["id"] != float64(c.id) {
+			c.t.Fatalf("%s: response to %v", method, msg["id"])
+		}
+
+		if msg["error"] != nil {
+			c.t.Fatalf("%s: %v", method, msg["error"])
+		}
+
+		return msg["result"]
+	}
+}
+
+// Sends a notification and returns the diagnostics published for it.
+func (c *lspClient) open(uri, text string) []any {
+	c.t.Helper()
+
+	c.send(map[string]any{"method": "textDocument/didOpen", "params": map[string]any{
+		"textDocument": map[string]any{"uri": uri, "languageId": "forth", "version": 1, "text": text},
+	}})
+
+	msg := c.receive()
+	if msg["method"] != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("didOpen: got %v", msg)
+	}
+
+	return msg["params"].(map[string]any)["diagnostics"].([]any)
+}
+
+func (c *lspClient) close() {
+	c.t.Helper()
+
+	c.request("shutdown", nil)
+	c.send(map[string]any{"method": "exit"})
+	c.out.Close()
+
+	if err := <-c.done; err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func positionParams(uri string, line, char int) map[string]any {
+	return map[string]any{
+		"textDocument": map[string]any{"uri": uri},
+		"position":     map[string]any{"line": line, "character": char},
+		"context":      map[string]any{"includeDeclaration": true},
+	}
+}
+
+// Returns the locations as "file:line:character".
+func locationStrings(t *testing.T, result any) []string {
+	t.Helper()
+
+	list, ok := result.([]any)
+	if !ok {
+		t.Fatalf("no locations: %v", result)
+	}
+
+	locations := make([]string, 0, len(list))
+
+	for _, item := range list {
+		loc := item.(map[string]any)
+		start := loc["range"].(map[string]any)["start"].(map[string]any)
+		locations = append(locations, fmt.Sprintf("%s:%v:%v",
+			filepath.Base(uriToPath(loc["uri"].(string))), start["line"], start["character"]))
+	}
+
+	return locations
+}
+
+func TestLSP(t *testing.T) {
+	config := cachedConfigPath
+	cachedConfigPath = t.TempDir()
+	t.Cleanup(func() { cachedConfigPath = config })
+
+	dir := t.TempDir()
+	lib := ": sq ( n -- n ) dup * ;\n: cube dup sq * ;\n"
+	if err := os.WriteFile(filepath.Join(dir, "lib.fs"), []byte(lib), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	main := "use lib\n: main 3 sq . 10 allot drop ;\n"
+	if err := os.WriteFile(filepath.Join(dir, "main.fs"), []byte(main), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	uri := pathToURI(filepath.Join(dir, "main.fs"))
+	c := startLSP(t)
+
+	caps := c.request("initialize", map[string]any{"capabilities": map[string]any{}}).(map[string]any)["capabilities"].(map[string]any)
+	if caps["referencesProvider"] != true || caps["definitionProvider"] != true {
+		t.Errorf("initialize: capabilities %v", caps)
+	}
+
+	if diagnostics := c.open(uri, main); len(diagnostics) != 0 {
+		t.Errorf("didOpen: diagnostics %v", diagnostics)
+	}
+
+	t.Run("definition", func(t *testing.T) {
+		got := locationStrings(t, c.request("textDocument/definition", positionParams(uri, 1, 10)))
+		if strings.Join(got, " ") != "lib.fs:0:2" {
+			t.Errorf("got %v", got)
+		}
+	})
+
+	t.Run("references", func(t *testing.T) {
+		got := locationStrings(t, c.request("textDocument/references", positionParams(uri, 1, 10)))
+		want := []string{"lib.fs:0:2", "lib.fs:1:11", "main.fs:1:9"}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("hover", func(t *testing.T) {
+		result := c.request("textDocument/hover", positionParams(uri, 1, 10)).(map[string]any)
+		value := result["contents"].(map[string]any)["value"].(string)
+		if !strings.Contains(value, ": sq ( n -- n )") || !strings.Contains(value, "dup *") {
+			t.Errorf("got %q", value)
+		}
+	})
+
+	t.Run("stdlib", func(t *testing.T) {
+		got := locationStrings(t, c.request("textDocument/definition", positionParams(uri, 1, 18)))
+		if len(got) != 1 || !strings.HasPrefix(got[0], "memory.fs:") {
+			t.Fatalf("got %v", got)
+		}
+
+		// the definition is in a read-only copy in the cache, the stdlib
+		// in the config path is not written
+		result := c.request("textDocument/definition", positionParams(uri, 1, 18)).([]any)
+		path := uriToPath(result[0].(map[string]any)["uri"].(string))
+		if !strings.HasPrefix(path, filepath.Join(cachedConfigPath, "cache")) {
+			t.Errorf("path %s", path)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0222 != 0 {
+			t.Errorf("copy %v %v", info, err)
+		}
+		if _, err := os.Stat(filepath.Join(cachedConfigPath, "stdlib")); !os.IsNotExist(err) {
+			t.Errorf("stdlib written: %v", err)
+		}
+
+		// an identical copy in the config path is used instead
+		data, err := Stdlib.ReadFile("stdlib/memory.fs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(cachedConfigPath, "stdlib")
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "memory.fs"), data, 0640); err != nil {
+			t.Fatal(err)
+		}
+		result = c.request("textDocument/definition", positionParams(uri, 1, 18)).([]any)
+		if path := uriToPath(result[0].(map[string]any)["uri"].(string)); path != filepath.Join(dir, "memory.fs") {
+			t.Errorf("path %s", path)
+		}
+	})
+
+	c.close()
+}
@@ -1,7 +1,10 @@
 package goforth
 
 import (
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -10,6 +13,11 @@ type MacroCompiler struct {
 	label  Label
 	labels Stack[string]
 	whiles Stack[string]
+	eaches Stack[string]
+
+	// Reports whether a word starting with @ is a word of the dictionary
+	// like "@+". Other words starting with @ must be macro words.
+	isWord func(word string) bool
 }
 
 type MacroOptcode int
@@ -35,6 +43,14 @@ const (
 	M_PRS
 	M_PRINT
 	M_STP
+	M_SBI
+	M_MLI
+	M_CONCAT
+	M_GENSYM
+	M_SET
+	M_EACH
+	M_NEXT_ARG
+	M_ERROR
 )
 
 var MacroName = map[MacroOptcode]string{
@@ -57,18 +73,52 @@ var MacroName = map[MacroOptcode]string{
 	M_PRS:         "PRS",
 	M_PRINT:       "PRINT",
 	M_STP:         "STP",
+	M_SBI:         "SBI",
+	M_MLI:         "MLI",
+	M_CONCAT:      "CONCAT",
+	M_GENSYM:      "GENSYM",
+	M_SET:         "SET",
+	M_EACH:        "EACH",
+	M_NEXT_ARG:    "NEXT_ARG",
+	M_ERROR:       "ERROR",
 }
 
 type Mc struct {
 	cmd    MacroOptcode
 	arg    string
 	argInt int
+	name   string // the register of M_NEXT_ARG
 }
 
-func (mc *MacroCompiler) Compile(macroDef *Stack[string]) *Stack[*Mc] {
+// Returns the message of "@error". It is a string like ." message" or the
+// words from "message to message".
+func errorMessage(words []string) (string, int, error) {
+	if len(words) > 0 && isString(words[0]) {
+		return strings.TrimPrefix(words[0][2:len(words[0])-1], " "), 1, nil
+	}
+
+	if len(words) == 0 || !strings.HasPrefix(words[0], "\"") {
+		return "", 0, fmt.Errorf("@error needs a message \"...\"")
+	}
+
+	for n, word := range words {
+		if (n > 0 || len(word) > 1) && strings.HasSuffix(word, "\"") {
+			message := strings.Join(words[:n+1], " ")
+			return message[1 : len(message)-1], n + 1, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("missing \" at the end of the message of @error")
+}
+
+func (mc *MacroCompiler) Compile(macroDef *Stack[string]) (*Stack[*Mc], error) {
 	r := NewStack[*Mc]()
+	mc.labels.Reset()
+	mc.whiles.Reset()
+	mc.eaches.Reset()
 
-	for macroWord := range macroDef.Values() {
+	for index := 0; index < macroDef.Len(); index++ {
+		macroWord := macroDef.data[index]
 		length := len(macroWord)
 
 		if length > 2 && (macroWord[0] == '@' && macroWord[length-1] == '@') {
@@ -83,6 +133,22 @@ func (mc *MacroCompiler) Compile(macroDef *Stack[string]) *Stack[*Mc] {
 			continue
 		}
 
+		if name, ok := strings.CutPrefix(macroWord, "@!"); ok && name != "" {
+			r.Push(&Mc{cmd: M_SET, arg: name})
+			continue
+		}
+
+		if name, ok := strings.CutPrefix(macroWord, "@each:"); ok && name != "" {
+			start := mc.label.CreateNewLabel()
+			end := mc.label.CreateNewLabel()
+			r.Push(&Mc{cmd: M_EACH})
+			r.Push(&Mc{cmd: M_NOP, arg: start})
+			r.Push(&Mc{cmd: M_NEXT_ARG, arg: end, name: name})
+			mc.eaches.Push(end)
+			mc.eaches.Push(start)
+			continue
+		}
+
 		switch macroWord {
 		case "@numArgs":
 			r.Push(&Mc{cmd: M_NUM_ARGS})
@@ -110,17 +176,47 @@ func (mc *MacroCompiler) Compile(macroDef *Stack[string]) *Stack[*Mc] {
 			r.Push(&Mc{cmd: M_PRS})
 		case "@add":
 			r.Push(&Mc{cmd: M_ADI})
+		case "@sub":
+			r.Push(&Mc{cmd: M_SBI})
+		case "@mul":
+			r.Push(&Mc{cmd: M_MLI})
+		case "@concat":
+			r.Push(&Mc{cmd: M_CONCAT})
+		case "@gensym":
+			r.Push(&Mc{cmd: M_GENSYM})
+		case "@error":
+			message, n, err := errorMessage(macroDef.data[index+1:])
+			if err != nil {
+				return nil, err
+			}
+			r.Push(&Mc{cmd: M_ERROR, arg: message})
+			index += n
+		case "@next":
+			start, ok := mc.eaches.Pop()
+			if !ok {
+				return nil, fmt.Errorf("@next without @each")
+			}
+			r.Push(&Mc{cmd: M_JMP, arg: start})
+			r.Push(&Mc{cmd: M_NOP, arg: mc.eaches.ExPop()})
 		case "@if":
 			lbl := mc.label.CreateNewLabel()
 			r.Push(&Mc{cmd: M_JIN, arg: lbl})
 			mc.labels.Push(lbl)
 		case "@else":
+			then, ok := mc.labels.Pop()
+			if !ok {
+				return nil, fmt.Errorf("@else without @if")
+			}
 			lbl := mc.label.CreateNewLabel()
 			r.Push(&Mc{cmd: M_JMP, arg: lbl})
-			r.Push(&Mc{cmd: M_NOP, arg: mc.labels.ExPop()})
+			r.Push(&Mc{cmd: M_NOP, arg: then})
 			mc.labels.Push(lbl)
 		case "@then":
-			r.Push(&Mc{cmd: M_NOP, arg: mc.labels.ExPop()})
+			then, ok := mc.labels.Pop()
+			if !ok {
+				return nil, fmt.Errorf("@then without @if")
+			}
+			r.Push(&Mc{cmd: M_NOP, arg: then})
 		case "@begin":
 			lbl := mc.label.CreateNewLabel()
 			r.Push(&Mc{cmd: M_NOP, arg: lbl})
@@ -130,32 +226,73 @@ func (mc *MacroCompiler) Compile(macroDef *Stack[string]) *Stack[*Mc] {
 			r.Push(&Mc{cmd: M_JIN, arg: lbl})
 			mc.whiles.Push(lbl)
 		case "@repeat":
+			if mc.labels.IsEmpty() || mc.whiles.IsEmpty() {
+				return nil, fmt.Errorf("@repeat without @begin and @while")
+			}
 			r.Push(&Mc{cmd: M_JMP, arg: mc.labels.ExPop()})
 			r.Push(&Mc{cmd: M_NOP, arg: mc.whiles.ExPop()})
 		default:
+			if length > 1 && macroWord[0] == '@' && (mc.isWord == nil || !mc.isWord(macroWord)) {
+				return nil, fmt.Errorf("unknown macro word \"%s\"", macroWord)
+			}
 			r.Push(&Mc{cmd: M_PRINT, arg: macroWord})
 		}
 	}
 
+	switch {
+	case !mc.labels.IsEmpty():
+		return nil, fmt.Errorf("missing @then or @repeat")
+	case !mc.whiles.IsEmpty():
+		return nil, fmt.Errorf("missing @repeat")
+	case !mc.eaches.IsEmpty():
+		return nil, fmt.Errorf("missing @next")
+	}
+
 	r.Push(&Mc{cmd: M_STP})
 
-	// optimise JIN and JMP
+	// optimise JIN, JMP and NEXT_ARG
 	for index, nop := range r.All() {
 		if nop.cmd == M_NOP {
 			for c := range r.Values() {
-				if (c.cmd == M_JIN || c.cmd == M_JMP) && nop.arg == c.arg {
+				if (c.cmd == M_JIN || c.cmd == M_JMP || c.cmd == M_NEXT_ARG) && nop.arg == c.arg {
 					c.argInt = index
 				}
 			}
 		}
 	}
 
-	return r
+	return r, nil
+}
+
+// The arguments of a loop "@each:name ... @next".
+type macroLoop struct {
+	args []*Stack[string]
+	next int
 }
 
 type MacroVM struct {
 	register map[string]*Stack[string]
 	stack    *Stack[string]
+	loops    []*macroLoop
+	symbols  int // the number of names created by @gensym
+
+	// Kept by Run for -trace-macros: the number of tokens before the
+	// arguments taken by the macro and the registers of the last run.
+	rest     int
+	bindings map[string]*Stack[string]
+}
+
+// The macro words of the opcodes for error messages.
+var macroWords = map[MacroOptcode]string{
+	M_GRI:  "@>",
+	M_LSI:  "@<",
+	M_NOT:  "@not",
+	M_ADI:  "@add",
+	M_SBI:  "@sub",
+	M_MLI:  "@mul",
+	M_JIN:  "@if or @while",
+	M_DROP: "@drop",
+	M_PRS:  "@.",
 }
 
 func NewMacroVM() *MacroVM {
@@ -173,7 +310,7 @@ func (vm *MacroVM) wordInRegister(wordDef *Stack[string], register string) (*Sta
 	)
 
 	if word, ok = wordDef.Pop(); !ok {
-		return nil, fmt.Errorf("unable to pop \"%s\". Not enough arguments", register)
+		return nil, fmt.Errorf("%s: not enough arguments", register)
 	}
 
 	result := NewStack[string]()
@@ -183,7 +320,7 @@ func (vm *MacroVM) wordInRegister(wordDef *Stack[string], register string) (*Sta
 		count = 1
 		for {
 			if word, ok = wordDef.Pop(); !ok {
-				return nil, fmt.Errorf("unable to pop word from block definition. Number of \"]\" and of \"[\" is not equal")
+				return nil, fmt.Errorf("%s: the argument has more \"]\" than \"[\"", register)
 			}
 			if word == "[" {
 				count--
@@ -203,6 +340,8 @@ func (vm *MacroVM) wordInRegister(wordDef *Stack[string], register string) (*Sta
 		result.Push(word)
 	}
 
+	vm.rest = min(vm.rest, wordDef.Len())
+
 	return result, nil
 }
 
@@ -230,11 +369,24 @@ func numberOfBlocksOrWords(data *Stack[string]) int {
 	return result
 }
 
-func popToInt(s *Stack[string]) (int64, error) {
-	a := s.ExPop()
+// Pops a value from the macro stack for the instruction cmd.
+func (vm *MacroVM) pop(cmd *Mc) (string, error) {
+	if a, ok := vm.stack.Pop(); ok {
+		return a, nil
+	}
+
+	return "", fmt.Errorf("%s: the macro stack is empty", macroWords[cmd.cmd])
+}
+
+// Pops an integer from the macro stack for the instruction cmd.
+func (vm *MacroVM) popInt(cmd *Mc) (int64, error) {
+	a, err := vm.pop(cmd)
+	if err != nil {
+		return 0, err
+	}
 
 	if !isNumeric(a) {
-		return 0, fmt.Errorf("unable to parse %s as integer", a)
+		return 0, fmt.Errorf("%s: unable to parse %s as integer", macroWords[cmd.cmd], a)
 	}
 
 	if b, err := strconv.ParseInt(a, 10, 64); err != nil {
@@ -246,7 +398,15 @@ func popToInt(s *Stack[string]) (int64, error) {
 
 func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 	done := false
-	defer clear(vm.register)
+	vm.rest = result.Len()
+
+	defer func() {
+		if TraceMacros {
+			vm.bindings = maps.Clone(vm.register)
+		}
+		clear(vm.register)
+		vm.loops = vm.loops[:0]
+	}()
 
 	for progPtr := 0; !done; progPtr++ {
 		cmd := code.data[progPtr]
@@ -254,10 +414,13 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 		switch cmd.cmd {
 		case M_L:
 			var err error
-			if vm.register[cmd.arg], err = vm.wordInRegister(result, cmd.arg); err != nil {
+			if vm.register[cmd.arg], err = vm.wordInRegister(result, "@"+cmd.arg+"@"); err != nil {
 				return err
 			}
 		case M_STR:
+			if vm.register[cmd.arg] == nil {
+				return fmt.Errorf("#%s#: the register \"%s\" is not set", cmd.arg, cmd.arg)
+			}
 			for w := range vm.register[cmd.arg].Values() {
 				result.Push(w)
 			}
@@ -270,7 +433,7 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 				err  error
 				word *Stack[string]
 			)
-			if word, err = vm.wordInRegister(result, cmd.arg); err != nil {
+			if word, err = vm.wordInRegister(result, "@push"); err != nil {
 				return err
 			}
 			for _, w := range word.Backward() {
@@ -281,10 +444,10 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 				a, b int64
 				err  error
 			)
-			if a, err = popToInt(vm.stack); err != nil {
+			if a, err = vm.popInt(cmd); err != nil {
 				return err
 			}
-			if b, err = popToInt(vm.stack); err != nil {
+			if b, err = vm.popInt(cmd); err != nil {
 				return err
 			}
 			if a < b {
@@ -297,10 +460,10 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 				a, b int64
 				err  error
 			)
-			if a, err = popToInt(vm.stack); err != nil {
+			if a, err = vm.popInt(cmd); err != nil {
 				return err
 			}
-			if b, err = popToInt(vm.stack); err != nil {
+			if b, err = vm.popInt(cmd); err != nil {
 				return err
 			}
 			if a > b {
@@ -309,6 +472,9 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 				vm.stack.Push("0")
 			}
 		case M_EQI:
+			if vm.stack.Len() < 2 {
+				return fmt.Errorf("@=: needs two values")
+			}
 			a := vm.stack.ExPop()
 			b := vm.stack.ExPop()
 
@@ -318,7 +484,10 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 				vm.stack.Push("0")
 			}
 		case M_NOT:
-			a := vm.stack.ExPop()
+			a, err := vm.pop(cmd)
+			if err != nil {
+				return err
+			}
 
 			if a == "0" {
 				vm.stack.Push("1")
@@ -330,20 +499,79 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 				a, b int64
 				err  error
 			)
-			if a, err = popToInt(vm.stack); err != nil {
+			if a, err = vm.popInt(cmd); err != nil {
 				return err
 			}
-			if b, err = popToInt(vm.stack); err != nil {
+			if b, err = vm.popInt(cmd); err != nil {
 				return err
 			}
 			vm.stack.Push(fmt.Sprint(a + b))
+		case M_SBI, M_MLI:
+			var (
+				a, b int64
+				err  error
+			)
+			if a, err = vm.popInt(cmd); err != nil {
+				return err
+			}
+			if b, err = vm.popInt(cmd); err != nil {
+				return err
+			}
+			if cmd.cmd == M_SBI {
+				vm.stack.Push(fmt.Sprint(b - a))
+			} else {
+				vm.stack.Push(fmt.Sprint(b * a))
+			}
+		case M_CONCAT:
+			if vm.stack.Len() < 2 {
+				return fmt.Errorf("@concat: needs two values")
+			}
+			a := vm.stack.ExPop()
+			b := vm.stack.ExPop()
+			vm.stack.Push(b + a)
+		case M_GENSYM:
+			vm.symbols++
+			vm.stack.Push(fmt.Sprintf("_gensym%d", vm.symbols))
+		case M_SET:
+			a, ok := vm.stack.Pop()
+			if !ok {
+				return fmt.Errorf("@!%s: the macro stack is empty", cmd.arg)
+			}
+			vm.register[cmd.arg] = &Stack[string]{data: []string{a}}
+		case M_EACH:
+			// only the arguments are taken, not the tokens emitted before
+			emitted := slices.Clone(result.data[vm.rest:])
+			result.data = result.data[:vm.rest]
+			loop := &macroLoop{args: make([]*Stack[string], numberOfBlocksOrWords(result))}
+			for i := len(loop.args) - 1; i >= 0; i-- {
+				var err error
+				if loop.args[i], err = vm.wordInRegister(result, "@each"); err != nil {
+					return err
+				}
+			}
+			result.data = append(result.data, emitted...)
+			vm.loops = append(vm.loops, loop)
+		case M_NEXT_ARG:
+			loop := vm.loops[len(vm.loops)-1]
+			if loop.next == len(loop.args) {
+				vm.loops = vm.loops[:len(vm.loops)-1]
+				progPtr = cmd.argInt
+			} else {
+				vm.register[cmd.name] = loop.args[loop.next]
+				loop.next++
+			}
+		case M_ERROR:
+			return errors.New(cmd.arg)
 		case M_PRINT_STACK:
 			for _, word := range vm.stack.Backward() {
 				result.Push(word)
 			}
 			vm.stack.Reset()
 		case M_JIN:
-			a := vm.stack.ExPop()
+			a, err := vm.pop(cmd)
+			if err != nil {
+				return err
+			}
 			if a == "0" {
 				progPtr = cmd.argInt
 			}
@@ -352,16 +580,29 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 		case M_NOP:
 			// pass
 		case M_DUP:
-			vm.stack.Push(vm.stack.data[len(vm.stack.data)-1])
+			a, ok := vm.stack.Fetch()
+			if !ok {
+				return fmt.Errorf("@dup: the macro stack is empty")
+			}
+			vm.stack.Push(a)
 		case M_DROP:
-			vm.stack.ExPop()
+			if _, err := vm.pop(cmd); err != nil {
+				return err
+			}
 		case M_SWAP:
+			if vm.stack.Len() < 2 {
+				return fmt.Errorf("@swap: needs two values")
+			}
 			n := len(vm.stack.data) - 1
 			a := vm.stack.data[n]
 			vm.stack.data[n] = vm.stack.data[n-1]
 			vm.stack.data[n-1] = a
 		case M_PRS:
-			result.Push(vm.stack.ExPop())
+			a, err := vm.pop(cmd)
+			if err != nil {
+				return err
+			}
+			result.Push(a)
 		case M_PRINT:
 			arg := cmd.arg
 			if isString(arg) {
@@ -384,3 +625,77 @@ func (vm *MacroVM) Run(code *Stack[*Mc], result *Stack[string]) error {
 
 	return nil
 }
+
+// A macro written in Go. It takes its arguments from args and returns the
+// tokens replacing them and the macro.
+type MacroFunc func(args MacroArgs) ([]string, error)
+
+// The arguments of a MacroFunc: the words and [ ] blocks before the macro
+// in the definition. The last argument is taken first.
+type MacroArgs struct {
+	vm     *MacroVM
+	tokens *Stack[string]
+}
+
+// Returns the number of arguments left.
+func (a MacroArgs) Len() int {
+	return numberOfBlocksOrWords(a.tokens)
+}
+
+// Reports whether the last argument is a [ ] block.
+func (a MacroArgs) IsBlock() bool {
+	word, ok := a.tokens.Fetch()
+	return ok && word == "]"
+}
+
+// Takes the last argument. A block is returned without the brackets.
+func (a MacroArgs) Pop() ([]string, error) {
+	if a.tokens.IsEmpty() {
+		return nil, fmt.Errorf("not enough arguments")
+	}
+
+	arg, err := a.vm.wordInRegister(a.tokens, "argument")
+	if err != nil {
+		return nil, err
+	}
+
+	return arg.data, nil
+}
+
+// Takes the last argument, which must be a word.
+func (a MacroArgs) Word() (string, error) {
+	if a.IsBlock() {
+		return "", fmt.Errorf("expected a word but got a block")
+	}
+
+	arg, err := a.Pop()
+	if err != nil {
+		return "", err
+	}
+
+	return arg[0], nil
+}
+
+// Takes the last argument, which must be a block.
+func (a MacroArgs) Block() ([]string, error) {
+	if !a.IsBlock() && !a.tokens.IsEmpty() {
+		return nil, fmt.Errorf("expected a block but got \"%s\"", a.tokens.data[a.tokens.Len()-1])
+	}
+
+	return a.Pop()
+}
+
+// Runs the macro f on the tokens in result.
+func (vm *MacroVM) RunFunc(f MacroFunc, result *Stack[string]) error {
+	vm.rest = result.Len()
+	vm.bindings = nil
+
+	tokens, err := f(MacroArgs{vm: vm, tokens: result})
+	if err != nil {
+		return err
+	}
+
+	result.data = append(result.data, tokens...)
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package goforth
+
+import "testing"
+
+func TestMacroEach(t *testing.T) {
+	tests := []struct {
+		name, script, want string
+	}{
+		{"arguments", ": inline sum! @each:x #x# . @next ; : main 1 2 3 sum! ;", "123"},
+		{"blocks", ": inline sum! @each:x #x# . @next ; : main [ 1 2 + ] 4 sum! ;", "34"},
+		// the 0 emitted before @each is no argument
+		{"emitted", ": inline sum! 0 @each:x #x# + @next ; : main 1 2 3 sum! . ;", "6"},
+		{"emitted argument", ": inline twice! @a@ #a# #a# @each:x #x# . @next ; : main 1 2 3 twice! + . ;", "126"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := runVM(t, test.script); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
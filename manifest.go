@@ -0,0 +1,352 @@
+package goforth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// The names of the files of a project.
+const (
+	ManifestName = "goforth.mod"
+	SumName      = "goforth.sum"
+	VendorDir    = "vendor"
+)
+
+// The manifest of a project read from goforth.mod:
+//
+//	\ the file run by "goforth run"
+//	entry main.fs
+//	require https://example.com/forth/json.fs
+//
+// The SHA-256 hashes of the required modules are locked in goforth.sum.
+// Remote modules are read from the vendor directory or the cache under
+// ConfigPath(), so that a project builds offline once it is downloaded.
+type Manifest struct {
+	Dir      string // the directory of goforth.mod
+	Entry    string
+	Requires []string
+	Sums     map[string]string // "sha256:..." by URL
+}
+
+// Returns the manifest in dir or the nearest parent directory.
+// Without a manifest the result is nil.
+func FindManifest(dir string) (*Manifest, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		if IsFile(filepath.Join(dir, ManifestName)) {
+			return ReadManifest(dir)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Reads goforth.mod and goforth.sum in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	m := &Manifest{Dir: dir, Sums: make(map[string]string)}
+
+	err := readLines(filepath.Join(dir, ManifestName), func(fields []string) error {
+		switch {
+		case fields[0] == "entry" && len(fields) == 2:
+			m.Entry = fields[1]
+		case fields[0] == "require" && len(fields) == 2:
+			if !isURL(fields[1]) {
+				return fmt.Errorf("\"%s\" is no http or https URL", fields[1])
+			}
+			if !slices.Contains(m.Requires, fields[1]) {
+				m.Requires = append(m.Requires, fields[1])
+			}
+		default:
+			return fmt.Errorf("invalid line \"%s\"", strings.Join(fields, " "))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readLines(filepath.Join(dir, SumName), func(fields []string) error {
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "sha256:") {
+			return fmt.Errorf("invalid line \"%s\"", strings.Join(fields, " "))
+		}
+		m.Sums[fields[0]] = fields[1]
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Calls f with the fields of each line of a file. Empty lines and "\" comments are skipped.
+func readLines(name string, f func(fields []string) error) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "\\")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := f(fields); err != nil {
+			return fmt.Errorf("%s:%d: %w", filepath.Base(name), n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Writes goforth.sum with the hashes of the required modules.
+func (m *Manifest) WriteSums() error {
+	var b strings.Builder
+
+	urls := make([]string, 0, len(m.Sums))
+	for u := range m.Sums {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+
+	for _, u := range urls {
+		fmt.Fprintf(&b, "%s %s\n", u, m.Sums[u])
+	}
+
+	return os.WriteFile(filepath.Join(m.Dir, SumName), []byte(b.String()), 0644)
+}
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// Returns the hash of data as written to goforth.sum.
+func moduleSum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Returns the file of a module in the cache.
+func cachePath(sum string) string {
+	return filepath.Join(ConfigPath(), "cache", strings.TrimPrefix(sum, "sha256:"))
+}
+
+// Returns the file of a module in the vendor directory, e.g.
+// "vendor/example.com/forth/json.fs".
+func (m *Manifest) vendorPath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(VendorDir, strings.ReplaceAll(u.Host, ":", "_"), filepath.FromSlash(filepath.Clean("/"+u.Path)))
+
+	return filepath.Join(m.Dir, path), nil
+}
+
+// Downloads a remote module.
+func download(rawURL string) ([]byte, error) {
+	client := http.Client{
+		Timeout: DownloadTimeout,
+	}
+
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download of \"%s\" failed: %s", rawURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(MaxDownloadSize)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > MaxDownloadSize {
+		return nil, fmt.Errorf("file from \"%s\" too large (> %d bytes)", rawURL, MaxDownloadSize)
+	}
+
+	return data, nil
+}
+
+// Reads the locked module from the vendor directory or the cache.
+// The result is nil if it is in neither of them.
+func (m *Manifest) readLocal(rawURL, sum string) ([]byte, error) {
+	vendor, err := m.vendorPath(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range []string{vendor, cachePath(sum)} {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if moduleSum(data) != sum {
+			return nil, fmt.Errorf("checksum mismatch of \"%s\" in %s", rawURL, path)
+		}
+		return data, nil
+	}
+
+	return nil, nil
+}
+
+// Returns the content of a required module. It is downloaded only if it is
+// neither vendored nor cached. The content must match the hash in goforth.sum.
+func (m *Manifest) Fetch(rawURL string) ([]byte, error) {
+	if !slices.Contains(m.Requires, rawURL) {
+		return nil, fmt.Errorf("\"%s\" is not required in %s", rawURL, ManifestName)
+	}
+
+	sum, ok := m.Sums[rawURL]
+	if !ok {
+		return nil, fmt.Errorf("missing hash of \"%s\" in %s, run \"goforth mod download\"", rawURL, SumName)
+	}
+
+	data, err := m.readLocal(rawURL, sum)
+	if err != nil || data != nil {
+		return data, err
+	}
+
+	if data, err = download(rawURL); err != nil {
+		return nil, err
+	}
+
+	if moduleSum(data) != sum {
+		return nil, fmt.Errorf("checksum mismatch of \"%s\": downloaded %s, %s has %s", rawURL, moduleSum(data), SumName, sum)
+	}
+
+	return data, writeCache(data)
+}
+
+func writeCache(data []byte) error {
+	path := cachePath(moduleSum(data))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// Downloads the required modules into the cache and locks the hashes of
+// new modules in goforth.sum. Modules which are no longer required are removed
+// from goforth.sum.
+func (m *Manifest) Download() error {
+	for _, u := range m.Requires {
+		if _, ok := m.Sums[u]; ok {
+			if _, err := m.Fetch(u); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data, err := download(u)
+		if err != nil {
+			return err
+		}
+
+		if err := writeCache(data); err != nil {
+			return err
+		}
+
+		m.Sums[u] = moduleSum(data)
+	}
+
+	for u := range m.Sums {
+		if !slices.Contains(m.Requires, u) {
+			delete(m.Sums, u)
+		}
+	}
+
+	return m.WriteSums()
+}
+
+// Checks that the required modules are locked and that the vendored or
+// cached files match their hashes. Nothing is downloaded.
+func (m *Manifest) Verify() []error {
+	errs := make([]error, 0, 5)
+
+	for _, u := range m.Requires {
+		sum, ok := m.Sums[u]
+		if !ok {
+			errs = append(errs, fmt.Errorf("missing hash of \"%s\" in %s", u, SumName))
+			continue
+		}
+
+		data, err := m.readLocal(u, sum)
+		if err != nil {
+			errs = append(errs, err)
+		} else if data == nil {
+			errs = append(errs, fmt.Errorf("\"%s\" is not downloaded", u))
+		}
+	}
+
+	return errs
+}
+
+// Copies the required modules into the vendor directory of the project.
+func (m *Manifest) Vendor() error {
+	files := make(map[string][]byte, len(m.Requires))
+
+	for _, u := range m.Requires {
+		data, err := m.Fetch(u)
+		if err != nil {
+			return err
+		}
+
+		path, err := m.vendorPath(u)
+		if err != nil {
+			return err
+		}
+
+		files[path] = data
+	}
+
+	if err := os.RemoveAll(filepath.Join(m.Dir, VendorDir)); err != nil {
+		return err
+	}
+
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package goforth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	config := cachedConfigPath
+	cachedConfigPath = t.TempDir()
+	t.Cleanup(func() { cachedConfigPath = config })
+
+	const content = ": sq dup * ;\n"
+	var (
+		served   atomic.Value // the content of the module served
+		requests atomic.Int32
+	)
+	served.Store(content)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/forth/sq.fs" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(served.Load().(string)))
+	}))
+	defer srv.Close()
+
+	url := srv.URL + "/forth/sq.fs"
+	dir := t.TempDir()
+	mod := "\\ a test project\nentry main.fs\nrequire " + url + "\n"
+
+	if err := os.WriteFile(filepath.Join(dir, ManifestName), []byte(mod), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Entry != "main.fs" || len(m.Requires) != 1 || m.Requires[0] != url {
+		t.Fatalf("manifest %+v", m)
+	}
+
+	if errs := m.Verify(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "missing hash") {
+		t.Errorf("verify before download: %v", errs)
+	}
+
+	t.Run("download", func(t *testing.T) {
+		if err := m.Download(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, SumName))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := moduleSum([]byte(content))
+		if string(data) != url+" "+sum+"\n" {
+			t.Errorf("%s: %q", SumName, data)
+		}
+
+		if errs := m.Verify(); len(errs) != 0 {
+			t.Errorf("verify: %v", errs)
+		}
+
+		// the lockfile is read back
+		locked, err := ReadManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked.Sums[url] != sum {
+			t.Errorf("sums %v", locked.Sums)
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		n := requests.Load()
+
+		data, err := m.Fetch(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("got %q", data)
+		}
+		if requests.Load() != n {
+			t.Errorf("cached module downloaded")
+		}
+	})
+
+	t.Run("tampered cache", func(t *testing.T) {
+		path := cachePath(m.Sums[url])
+		if err := os.WriteFile(path, []byte(": sq drop 0 ;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		defer os.WriteFile(path, []byte(content), 0644)
+
+		if _, err := m.Fetch(url); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("fetch: %v", err)
+		}
+		if errs := m.Verify(); len(errs) != 1 {
+			t.Errorf("verify: %v", errs)
+		}
+	})
+
+	t.Run("tampered download", func(t *testing.T) {
+		path := cachePath(m.Sums[url])
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		defer os.WriteFile(path, []byte(content), 0644)
+
+		served.Store(": sq drop 0 ;\n")
+		defer served.Store(content)
+
+		if _, err := m.Fetch(url); err == nil || !strings.Contains(err.Error(), "downloaded") {
+			t.Errorf("fetch: %v", err)
+		}
+	})
+
+	t.Run("not required", func(t *testing.T) {
+		if _, err := m.Fetch(srv.URL + "/forth/other.fs"); err == nil {
+			t.Errorf("fetch of a module not required")
+		}
+	})
+
+	t.Run("vendor", func(t *testing.T) {
+		if err := m.Vendor(); err != nil {
+			t.Fatal(err)
+		}
+
+		path, err := m.vendorPath(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(path, filepath.Join(dir, VendorDir)) || !strings.HasSuffix(path, filepath.Join("forth", "sq.fs")) {
+			t.Errorf("vendor path %s", path)
+		}
+	})
+
+	srv.Close()
+
+	t.Run("offline vendor", func(t *testing.T) {
+		cache := cachePath(m.Sums[url])
+		if err := os.Rename(cache, cache+".bak"); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Rename(cache+".bak", cache)
+
+		data, err := m.Fetch(url)
+		if err != nil || string(data) != content {
+			t.Errorf("fetch: %q %v", data, err)
+		}
+	})
+
+	t.Run("offline cache", func(t *testing.T) {
+		if err := os.RemoveAll(filepath.Join(dir, VendorDir)); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := m.Fetch(url)
+		if err != nil || string(data) != content {
+			t.Errorf("fetch: %q %v", data, err)
+		}
+
+		if errs := m.Verify(); len(errs) != 0 {
+			t.Errorf("verify: %v", errs)
+		}
+	})
+
+	t.Run("offline missing", func(t *testing.T) {
+		if err := os.Remove(cachePath(m.Sums[url])); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := m.Fetch(url); err == nil {
+			t.Errorf("fetch without server, vendor and cache")
+		}
+		if errs := m.Verify(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "not downloaded") {
+			t.Errorf("verify: %v", errs)
+		}
+	})
+}
@@ -0,0 +1,570 @@
+package goforth
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Modules. A file starting with "module name" defines its words as
+// "name.word". Inside the module and in modules using it the words are
+// found without the prefix. A "use" of a module outside of a module makes
+// its public words available without the prefix, unless a word with the
+// same name is defined. Words declared with "private" are only visible
+// inside their module.
+
+// The names visible while a file is parsed.
+type moduleScope struct {
+	file    string
+	key     string            // identifies the file, see fileKey
+	layer   int               // the filesystem of the file, see findFile
+	dir     string            // the directory of the file
+	module  string            // the module declared by "module name"
+	imports map[string]string // the modules used by the module by alias
+	words   []string          // the words defined in the file
+}
+
+// Returns the scope of the file being parsed. Meta commands of the REPL are
+// handled outside of a file.
+func (fc *ForthCompiler) scope() *moduleScope {
+	if len(fc.scopes) == 0 {
+		return &moduleScope{}
+	}
+
+	return fc.scopes[len(fc.scopes)-1]
+}
+
+// Returns the modules visible by alias in scope. The aliases used outside
+// of a module are visible in all files outside of a module.
+func (fc *ForthCompiler) imports(scope *moduleScope) map[string]string {
+	if scope.module != "" {
+		return scope.imports
+	}
+
+	return fc.aliases
+}
+
+// Returns the name of word defined in the current scope.
+func (fc *ForthCompiler) qualify(word string) string {
+	scope := fc.scope()
+
+	if scope.module == "" || word == "main" {
+		return word
+	}
+
+	return scope.module + "." + word
+}
+
+// Returns the directories searched by use: IncludePath, the directories of
+// the environment variable GOFORTH_PATH and the lib directory in the
+// config directory.
+func SearchPath() []string {
+	dirs := slices.Clone(IncludePath)
+
+	for _, dir := range filepath.SplitList(os.Getenv("GOFORTH_PATH")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return append(dirs, filepath.Join(ConfigPath(), "lib"))
+}
+
+// Sets the filesystems searched by use and template, e.g. an embed.FS with
+// the Forth libraries of a Go program or a fstest.MapFS. They are searched
+// in order after the directory of the including file and before the OS
+// filesystem, which is disabled by RestrictFS.
+func (fc *ForthCompiler) SetFS(fsys ...fs.FS) {
+	fc.fsys = fsys
+}
+
+// The layers of findFile. The filesystems of SetFS are the layers from 1 on.
+const (
+	osLayer     = 0
+	stdlibLayer = -1
+)
+
+// Returns the file loaded by "use name" and the filesystem containing it,
+// which is nil for the OS filesystem. A relative name is searched in the
+// directory of the file being parsed, the filesystems of SetFS, the current
+// directory, SearchPath() and at last in the stdlib, which is embedded.
+// ".fs" is appended to names without extension.
+func (fc *ForthCompiler) FindFile(name string) (fs.FS, string, error) {
+	layer, file, err := fc.findFile(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return fc.layerFS(layer), file, nil
+}
+
+func (fc *ForthCompiler) findFile(name string) (layer int, file string, err error) {
+	type location struct {
+		layer int
+		dir   string
+	}
+
+	names := []string{name}
+	if filepath.Ext(name) == "" {
+		names = append(names, name+".fs")
+	}
+
+	locations := make([]location, 0, 10)
+
+	if filepath.IsAbs(name) {
+		if !fc.RestrictFS {
+			locations = append(locations, location{osLayer, ""})
+		}
+	} else {
+		if scope := fc.scope(); scope.dir != "" && (scope.layer != osLayer || !fc.RestrictFS) {
+			locations = append(locations, location{scope.layer, scope.dir})
+		}
+
+		for i := range fc.fsys {
+			locations = append(locations, location{i + 1, "."})
+		}
+
+		if !fc.RestrictFS {
+			locations = append(locations, location{osLayer, ""})
+			for _, dir := range SearchPath() {
+				locations = append(locations, location{osLayer, dir})
+			}
+		}
+
+		locations = append(locations, location{stdlibLayer, "stdlib"})
+	}
+
+	for _, loc := range locations {
+		for _, name := range names {
+			if file, ok := fc.stat(loc.layer, loc.dir, name); ok {
+				return loc.layer, file, nil
+			}
+		}
+	}
+
+	return 0, "", fmt.Errorf("file \"%s\" not found", name)
+}
+
+// Returns the filesystem of a layer of findFile. The OS filesystem is nil.
+func (fc *ForthCompiler) layerFS(layer int) fs.FS {
+	switch layer {
+	case osLayer:
+		return nil
+	case stdlibLayer:
+		return Stdlib
+	}
+
+	return fc.fsys[layer-1]
+}
+
+// Returns the path of the file name in dir of a layer if it exists.
+func (fc *ForthCompiler) stat(layer int, dir, name string) (string, bool) {
+	fsys := fc.layerFS(layer)
+
+	if fsys == nil {
+		file := filepath.Join(dir, name)
+		return file, IsFile(file)
+	}
+
+	file := path.Join(dir, filepath.ToSlash(name))
+	if !fs.ValidPath(file) {
+		return "", false
+	}
+
+	info, err := fs.Stat(fsys, file)
+	return file, err == nil && !info.IsDir()
+}
+
+// Returns a key identifying the file loaded by "use name".
+func (fc *ForthCompiler) fileKey(name string) string {
+	if isURL(name) {
+		return name
+	}
+
+	layer, file, err := fc.findFile(name)
+
+	switch {
+	case err != nil:
+		return name
+	case layer == stdlibLayer:
+		return file
+	case layer != osLayer:
+		return fmt.Sprintf("fs%d:%s", layer, file)
+	}
+
+	if abs, err := filepath.Abs(file); err == nil {
+		return abs
+	}
+
+	return file
+}
+
+// Parses str in scope and resolves the names of its definitions.
+func (fc *ForthCompiler) parseScope(str string, scope *moduleScope) error {
+	fc.scopes = append(fc.scopes, scope)
+	err := fc.parse(str, scope.file)
+	fc.scopes = fc.scopes[:len(fc.scopes)-1]
+
+	if err != nil {
+		return err
+	}
+
+	return fc.resolveScope(scope, scope.file)
+}
+
+// handles "module name"
+func (fc *ForthCompiler) declareModule(name string) error {
+	scope := fc.scope()
+
+	switch {
+	case len(fc.scopes) == 0:
+		return fmt.Errorf("module \"%s\" must be declared in a file", name)
+	case name == "" || strings.ContainsAny(name, ".:"):
+		return fmt.Errorf("invalid module name \"%s\"", name)
+	case scope.module != "":
+		return fmt.Errorf("module \"%s\" is already declared as \"%s\"", name, scope.module)
+	case len(scope.words) > 0:
+		return fmt.Errorf("module \"%s\" must be declared before the definitions", name)
+	}
+
+	if file, ok := fc.modules[name]; ok && file != scope.key {
+		return fmt.Errorf("module \"%s\" is already defined in %s", name, file)
+	}
+
+	fc.modules[name] = scope.key
+	scope.module = name
+	scope.imports = make(map[string]string)
+
+	return nil
+}
+
+// handles "private word ..."
+func (fc *ForthCompiler) declarePrivate(words []string) error {
+	if fc.scope().module == "" {
+		return fmt.Errorf("private words must be defined in a module")
+	}
+
+	for _, word := range words {
+		if word != "" {
+			fc.private[fc.qualify(word)] = true
+		}
+	}
+
+	return nil
+}
+
+// handles "use name" and "use name as alias". A file is loaded only once.
+func (fc *ForthCompiler) use(name, alias string) error {
+	key := fc.fileKey(name)
+
+	if i := slices.Index(fc.loading, key); i >= 0 {
+		return fmt.Errorf("circular use: %s -> %s", strings.Join(fc.loading[i:], " -> "), key)
+	}
+
+	if _, ok := fc.loaded[key]; !ok {
+		if err := fc.ParseFile(name); err != nil {
+			return err
+		}
+	}
+
+	module := fc.loaded[key]
+
+	if module == "" {
+		if alias != "" {
+			return fmt.Errorf("\"%s\" is not a module", name)
+		}
+		return nil
+	}
+
+	scope := fc.scope()
+
+	if alias == "" {
+		fc.imports(scope)[module] = module
+		if scope.module == "" {
+			fc.forward(module)
+		}
+		return nil
+	}
+
+	fc.imports(scope)[alias] = module
+
+	return nil
+}
+
+// Makes the public words and macros of module available without the prefix.
+// Words with the same name which are not forwarded are kept.
+func (fc *ForthCompiler) forward(module string) {
+	prefix := module + "."
+
+	add := func(word string, isMacro bool) {
+		name, ok := strings.CutPrefix(word, prefix)
+		if !ok || fc.private[word] {
+			return
+		}
+
+		if _, ok := fc.forwards[name]; !ok && (fc.defs[name] != nil || fc.inlines[name] != nil) {
+			return
+		}
+
+		if isMacro {
+			delete(fc.defs, name)
+			fc.inlines[name] = fc.inlines[word]
+			fc.clean = false
+		} else {
+			delete(fc.inlines, name)
+			fc.defs[name] = &Stack[string]{data: []string{word}}
+		}
+
+		fc.forwards[name] = word
+		fc.effects[name] = fc.effects[word]
+		fc.locations[name] = fc.locations[word]
+		fc.docs[name] = fc.docs[word]
+	}
+
+	for word := range fc.defs {
+		add(word, false)
+	}
+
+	for word := range fc.inlines {
+		add(word, true)
+	}
+}
+
+// Removes the forwarding of word before it is defined.
+func (fc *ForthCompiler) unforward(word string) {
+	if _, ok := fc.forwards[word]; ok {
+		delete(fc.forwards, word)
+		delete(fc.defs, word)
+		delete(fc.inlines, word)
+	}
+}
+
+// Returns the name of the class "extends" refers to.
+func (fc *ForthCompiler) resolveClass(name string) string {
+	scope := fc.scope()
+
+	if word, err := fc.resolveQualified(scope, name); err == nil && word != name {
+		return word
+	}
+
+	if scope.module != "" && fc.defs[scope.module+"."+name+":sizeof"] != nil {
+		return scope.module + "." + name
+	}
+
+	// a class of a used module
+	if word, ok := fc.forwards[name+":sizeof"]; ok {
+		return strings.TrimSuffix(word, ":sizeof")
+	}
+
+	return name
+}
+
+// Reports whether a word, macro or variable is defined.
+func (fc *ForthCompiler) isDefined(word string) bool {
+	return fc.defs[word] != nil || fc.inlines[word] != nil || fc.vars.Contains(word)
+}
+
+// Resolves "alias.word" and "module.word".
+func (fc *ForthCompiler) resolveQualified(scope *moduleScope, token string) (string, error) {
+	alias, name, ok := strings.Cut(token, ".")
+	if !ok || alias == "" || name == "" {
+		return token, nil
+	}
+
+	module, ok := fc.imports(scope)[alias]
+	if !ok {
+		if _, ok := fc.modules[alias]; !ok {
+			return token, nil
+		}
+		module = alias
+	}
+
+	word := module + "." + name
+
+	if !fc.isDefined(word) {
+		return "", fmt.Errorf("module %s has no word \"%s\"", module, name)
+	}
+
+	if fc.private[word] && scope.module != module {
+		return "", fmt.Errorf("\"%s\" is private in module %s", name, module)
+	}
+
+	return word, nil
+}
+
+// Resolves a word without prefix inside of a module: the words of the
+// module are found first, then the public words of the modules it uses.
+func (fc *ForthCompiler) resolveUnqualified(scope *moduleScope, token string) (string, error) {
+	if scope.module == "" || strings.Contains(token, ".") {
+		return token, nil
+	}
+
+	if word := scope.module + "." + token; fc.isDefined(word) {
+		return word, nil
+	}
+
+	found := make([]string, 0, 1)
+
+	for alias, module := range scope.imports {
+		if word := module + "." + token; alias == module && fc.isDefined(word) && !fc.private[word] {
+			found = append(found, word)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return token, nil
+	case 1:
+		return found[0], nil
+	}
+
+	sort.Strings(found)
+
+	return "", fmt.Errorf("\"%s\" is ambiguous: %s", token, strings.Join(found, " or "))
+}
+
+// Returns the names of the locals of a definition.
+func definedLocals(tokens []string) map[string]bool {
+	locals := make(map[string]bool)
+	inside := false
+
+	for _, token := range tokens {
+		switch {
+		case token == "{":
+			inside = true
+		case token == "}":
+			inside = false
+		case inside:
+			locals[token] = true
+		}
+	}
+
+	return locals
+}
+
+// Replaces the tokens of def with the results of resolve. Locals, strings
+// and the syntax of macros are kept.
+func (fc *ForthCompiler) resolveTokens(def *Stack[string], resolve func(string) (string, error)) (*Stack[string], error) {
+	locals := definedLocals(def.data)
+	result := &Stack[string]{data: make([]string, len(def.data))}
+
+	for i, token := range def.data {
+		result.data[i] = token
+
+		if locals[token] || isString(token) || strings.HasPrefix(token, "@") || strings.HasPrefix(token, "#") {
+			continue
+		}
+
+		// method names are not words
+		if i > 0 && (def.data[i-1] == "send" || def.data[i-1] == "super") {
+			continue
+		}
+
+		word, err := resolve(token)
+		if err != nil {
+			return nil, err
+		}
+
+		result.data[i] = word
+	}
+
+	return result, nil
+}
+
+// Resolves the names in the definitions of a parsed file. Qualified names
+// and macros are resolved now, because macros are expanded by name.
+// Macros may be expanded in other modules, so their bodies are resolved
+// completely.
+func (fc *ForthCompiler) resolveScope(scope *moduleScope, filename string) error {
+	for _, word := range scope.words {
+		var err error
+
+		if def := fc.inlines[word]; def != nil {
+			def, err = fc.resolveTokens(def, func(token string) (string, error) {
+				if word, err := fc.resolveQualified(scope, token); err != nil || word != token {
+					return word, err
+				}
+				return fc.resolveUnqualified(scope, token)
+			})
+			if err == nil {
+				fc.inlines[word] = def
+			}
+		} else if def := fc.defs[word]; def != nil {
+			def, err = fc.resolveTokens(def, func(token string) (string, error) {
+				if word, err := fc.resolveQualified(scope, token); err != nil || word != token {
+					return word, err
+				}
+				if word, err := fc.resolveUnqualified(scope, token); err != nil || fc.inlines[word] != nil {
+					return word, err
+				}
+				return token, nil
+			})
+			if err == nil {
+				fc.defs[word] = def
+			}
+		}
+
+		if err != nil {
+			loc := fc.locations[word]
+			return fmt.Errorf("%s Line %d: word \"%s\": %s", filename, loc.Line, word, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Resolves the words without prefix in the definitions of modules after
+// the macros are expanded.
+func (fc *ForthCompiler) resolveModuleWords() error {
+	for word, scope := range fc.wordScopes {
+		def := fc.defs[word]
+
+		if def == nil || scope.module == "" {
+			continue
+		}
+
+		def, err := fc.resolveTokens(def, func(token string) (string, error) {
+			return fc.resolveUnqualified(scope, token)
+		})
+		if err != nil {
+			return fmt.Errorf("word \"%s\": %s", word, err.Error())
+		}
+
+		fc.defs[word] = def
+	}
+
+	return nil
+}
+
+// Forgets the loaded files and modules, e.g. before the core words are loaded again.
+func (fc *ForthCompiler) resetModules() {
+	clear(fc.wordScopes)
+	clear(fc.modules)
+	clear(fc.loaded)
+	clear(fc.files)
+	clear(fc.aliases)
+	clear(fc.private)
+	clear(fc.forwards)
+}
+
+// Returns the name of word used in file, e.g. "csv.fromSV" for "fromSV" in the module csv.
+func (fc *ForthCompiler) nameIn(file, word string) string {
+	key := fc.fileKey(file)
+
+	for module, moduleFile := range fc.modules {
+		if name := module + "." + word; moduleFile == key && fc.isDefined(name) {
+			return name
+		}
+	}
+
+	if name, err := fc.resolveQualified(&moduleScope{}, word); err == nil {
+		return name
+	}
+
+	return word
+}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"unicode"
@@ -23,12 +24,14 @@ var baseSyntax = []string{
 	"begin", "while", "repeat", "do", "?do", "loop", "+loop", "-loop", "if", "then",
 	"else", "{", "}", "[", "]", "until", "again", "leave", "to", "done", ":", ";",
 	"case", "of", "?of", "endof", "endcase", "variable", "char", "class", "extends",
-	"inline",
+	"inline", "[[", "]]", "constant", "value", "create", "does>", "defer", "is",
+	"method", "override", "super", "send", "interface", "implements",
 }
 
 var marcoSyntax = []string{
 	"@if", "@else", "@then", "@push", "@drop", "@dup", "@swap", "@numArgs", "@depth",
 	"@>", "@<", "@=", "@not", "@$", "@.", "@add", "@begin", "@while", "@repeat",
+	"@sub", "@mul", "@concat", "@gensym", "@next", "@error",
 }
 
 var (
@@ -53,7 +56,8 @@ func isMacroVariable(word string) bool {
 }
 
 func isMacroSyntax(word string) bool {
-	return isMacroVariable(word) || slices.Contains(marcoSyntax, word)
+	return isMacroVariable(word) || slices.Contains(marcoSyntax, word) ||
+		(len(word) > 2 && strings.HasPrefix(word, "@!")) || (len(word) > 6 && strings.HasPrefix(word, "@each:"))
 }
 
 func getWordColored(fc *ForthCompiler, word string) string {
@@ -61,7 +65,7 @@ func getWordColored(fc *ForthCompiler, word string) string {
 		return Magenta(word)
 	} else if _, ok := fc.defs[word]; ok {
 		return Cyan(word)
-	} else if _, ok := fc.inlines[word]; ok {
+	} else if fc.isMacro(word) {
 		return Red(word)
 	} else if fc.vars.Contains(word) {
 		return Red(word)
@@ -154,6 +158,12 @@ func (fc *ForthCompiler) printDefinition(word string) {
 		} else {
 			printVariable(word)
 		}
+		fc.printDoc(word)
+		return
+	}
+
+	if doc, ok := fc.Doc(word); ok && doc.Kind == "class" {
+		fc.printDoc(word)
 		return
 	}
 
@@ -204,6 +214,30 @@ func (fc *ForthCompiler) printDefinition(word string) {
 	} else {
 		printWord(word, s)
 	}
+
+	fc.printDoc(word)
+}
+
+// Prints the earlier definitions of word, the latest last.
+func (fc *ForthCompiler) printHistory(word string) {
+	history := fc.history[word]
+
+	if len(history) == 0 {
+		return
+	}
+
+	fmt.Println("Earlier definitions (restore name n):")
+
+	for n, v := range history {
+		fmt.Printf("%d: %s Line %d\n", n+1, v.location.File, v.location.Line)
+
+		def := &Stack[string]{data: v.source}
+		if Colored {
+			printWordColored(fc, word, def)
+		} else {
+			printWord(word, def)
+		}
+	}
 }
 
 func (fc *ForthCompiler) printAllDefinitions() {
@@ -376,6 +410,7 @@ func (fc *ForthCompiler) handleREPL() {
 
 		if text[0] == '%' && len(text) > 1 {
 			fc.printDefinition(text[2:])
+			fc.printHistory(text[2:])
 			continue
 		} else if text[0] == '%' && len(text) == 1 {
 			fc.printAllDefinitions()
@@ -396,9 +431,49 @@ func (fc *ForthCompiler) handleREPL() {
 		} else if strings.Index(text, "reset") == 0 {
 			clear(fc.defs)
 			clear(fc.inlines)
+			clear(fc.statics)
+			clear(fc.classes)
+			clear(fc.interfaces)
+			fc.inits = fc.inits[:0]
+			fc.resetModules()
+			fc.resetHistory()
 			fc.ParseFile("core")
 			continue
-		} else if strings.Index(text, "variable ") == 0 {
+		} else if strings.Index(text, "marker ") == 0 {
+			if err := fc.marker(strings.TrimSpace(text[7:])); err != nil {
+				PrintError(err)
+			}
+			continue
+		} else if fc.isMarker(strings.TrimSpace(text)) {
+			if err := fc.rollback(strings.TrimSpace(text)); err != nil {
+				PrintError(err)
+			}
+			line.Config.AutoComplete = fc.initCompleter()
+			continue
+		} else if strings.Index(text, "forget ") == 0 {
+			for _, word := range strings.Fields(text[7:]) {
+				if err := fc.forget(word); err != nil {
+					PrintError(err)
+				}
+			}
+			line.Config.AutoComplete = fc.initCompleter()
+			continue
+		} else if strings.Index(text, "restore ") == 0 {
+			args := strings.Fields(text[8:])
+			if len(args) == 0 || len(args) > 2 {
+				PrintError(fmt.Errorf("usage: restore name [n]"))
+				continue
+			}
+			// the latest earlier definition by default
+			n := len(fc.history[args[0]])
+			if len(args) == 2 {
+				n, _ = strconv.Atoi(args[1])
+			}
+			if err := fc.restore(args[0], n); err != nil {
+				PrintError(err)
+			}
+			continue
+		} else if strings.Index(text, "variable ") == 0 || fc.isDefinition(text) {
 			if err := fc.handleMeta(text); err != nil {
 				PrintError(err)
 			}
@@ -539,9 +614,12 @@ func (fc *ForthCompiler) initGlobalNameCache() func(name string) string {
 			for k, v := range cache {
 				result.WriteString(fmt.Sprintf("static cell_t %s = { .value = %d }; // %s\n", v, 0, k))
 			}
-			if result.Len() > 0 {
-				result.WriteString("\n")
+			// the variables are roots of the garbage collector
+			result.WriteString("static cell_t *fvm_variables[] = {")
+			for _, v := range cache {
+				result.WriteString(fmt.Sprintf(" &%s,", v))
 			}
+			result.WriteString(" NULL };\n\n")
 			return result.String()
 		}
 
@@ -598,8 +676,11 @@ func (fc *ForthCompiler) CompileToC() error {
 	globals := fc.initGlobalNameCache()
 	spaces := initSpaceCache()
 	indent := 2
+	depth := 0 // the number of open local contexts
+	cmds := strings.Split(fc.ByteCode(), ";")
+	sub := ""
 
-	for cmd := range strings.SplitSeq(fc.ByteCode(), ";") {
+	for index, cmd := range cmds {
 		if cmd == "" {
 			continue
 		}
@@ -624,28 +705,52 @@ func (fc *ForthCompiler) CompileToC() error {
 		case "LF":
 			result.WriteString(fmt.Sprintf("%sfvm_push(fvm_cell_d(%s));\n", spaces(indent), scmd[1]))
 		case "LCTX":
-			result.WriteString(fmt.Sprintf("%s{\n", spaces(indent)))
+			// the locals are stored in fvm_locals, where the collector finds them
+			depth++
+			result.WriteString(fmt.Sprintf("%s{\n%s  ptrdiff_t ctx%d = fvm_ln;\n", spaces(indent), spaces(indent), depth))
 			indent += 2
 		case "LCLR":
+			if isTailClear(cmds[index:]) {
+				// leaving the scope is done by goto, the LCLRs before this one
+				// removed the locals of the inner contexts
+				ctx := depth
+				for i := index - 1; i >= 0 && cmds[i] == "LCLR"; i-- {
+					ctx--
+				}
+				result.WriteString(fmt.Sprintf("%sfvm_ln = ctx%d;\n", spaces(indent), ctx))
+				continue
+			}
+			result.WriteString(fmt.Sprintf("%sfvm_ln = ctx%d;\n", spaces(indent), depth))
+			depth--
 			indent -= 2
 			result.WriteString(fmt.Sprintf("%s}\n", spaces(indent)))
 		case "LDEF":
-			result.WriteString(fmt.Sprintf("%scell_t %s = fvm_pop(); // %s\n", spaces(indent), locals(scmd[1]), scmd[1]))
+			result.WriteString(fmt.Sprintf("%scell_t *%s = fvm_ldef(); // %s\n", spaces(indent), locals(scmd[1]), scmd[1]))
 		case "LCL":
-			result.WriteString(fmt.Sprintf("%sfvm_push(%s); // %s\n", spaces(indent), locals(scmd[1]), scmd[1]))
+			result.WriteString(fmt.Sprintf("%sfvm_push(*%s); // %s\n", spaces(indent), locals(scmd[1]), scmd[1]))
 		case "LSET":
-			result.WriteString(fmt.Sprintf("%s%s = fvm_pop(); // %s\n", spaces(indent), locals(scmd[1]), scmd[1]))
+			result.WriteString(fmt.Sprintf("%s*%s = fvm_pop(); // %s\n", spaces(indent), locals(scmd[1]), scmd[1]))
 		case "SUB":
-			result.WriteString(fmt.Sprintf("static void %s(void) { // %s\n", funcs(scmd[1]), scmd[1]))
+			sub = scmd[1]
+			result.WriteString(fmt.Sprintf("static void %s(void) { // %s\n", funcs(sub), sub))
+			if hasSelfTailCall(sub, cmds[index+1:]) {
+				result.WriteString(fmt.Sprintf("t_%s:\n%s;\n", funcs(sub), spaces(indent)))
+			}
 		case "END":
 			result.WriteString("}\n\n")
 		case "MAIN":
-			result.WriteString("int main(int argc, char** argv) {\n  fvm_argc = (int64_t)argc;\n  fvm_argv = argv;\n")
+			result.WriteString("int main(int argc, char** argv) {\n  fvm_argc = (int64_t)argc;\n  fvm_argv = argv;\n  fvm_globals = fvm_variables;\n")
 			if ShowExecutionTime {
 				result.WriteString("  fvm_time();\n")
 			}
 		case "CALL":
 			result.WriteString(fmt.Sprintf("%s%s(); // %s\n", spaces(indent), funcs(scmd[1]), scmd[1]))
+		case "TAIL":
+			if scmd[1] == sub {
+				result.WriteString(fmt.Sprintf("%sgoto t_%s; // %s\n", spaces(indent), funcs(sub), sub))
+			} else {
+				result.WriteString(fmt.Sprintf("%s%s(); // %s\n%sreturn;\n", spaces(indent), funcs(scmd[1]), scmd[1], spaces(indent)))
+			}
 		case "REF":
 			result.WriteString(fmt.Sprintf("%sfvm_ref(&%s); // %s\n", spaces(indent), funcs(scmd[1]), scmd[1]))
 		default:
@@ -664,6 +769,32 @@ func (fc *ForthCompiler) CompileToC() error {
 	return nil
 }
 
+// Reports whether the LCLRs at the beginning of cmds are followed by a TAIL.
+func isTailClear(cmds []string) bool {
+	for _, cmd := range cmds {
+		if cmd != "LCLR" {
+			return strings.HasPrefix(cmd, "TAIL ")
+		}
+	}
+
+	return false
+}
+
+// Reports whether the subroutine body in cmds contains a tail call to itself.
+func hasSelfTailCall(sub string, cmds []string) bool {
+	for _, cmd := range cmds {
+		if cmd == "END" {
+			break
+		}
+
+		if cmd == "TAIL "+sub {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (fc *ForthCompiler) prepareCompileAndRun(cgen string) error {
 	cvm, _ := Stdlib.ReadFile("lib/vm.c")
 	var cout *COutFile
@@ -795,21 +926,14 @@ func (fc *ForthCompiler) printPreprocess(word string) error {
 		return fmt.Errorf("only words can be preprocessed. \"%s\" is a macro.", word)
 	}
 
-	macroNames := slices.Collect(maps.Keys(fc.inlines))
 	printWordColored(fc, word, fc.defs[word])
-	fc.compileMacros(macroNames)
-	mvm := NewMacroVM()
-
-	for fc.defs[word].ContainsAny(macroNames) {
-		if result, err := fc.evaluateMacro(word, mvm); err != nil {
-			return err
-		} else {
-			fc.defs[word] = result
-			printWordColored(fc, word, fc.defs[word])
-		}
+	if err := fc.compileMacros(slices.Collect(maps.Keys(fc.inlines))); err != nil {
+		return err
 	}
 
-	return nil
+	return fc.expandMacros(word, fc.macroNames(), NewMacroVM(), func() {
+		printWordColored(fc, word, fc.defs[word])
+	})
 }
 
 func (fc *ForthCompiler) printDebug() {
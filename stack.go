@@ -182,6 +182,11 @@ func (ss *SliceStack[T]) Pop() (*Stack[T], bool) {
 	return element, true
 }
 
+func (ss *SliceStack[T]) Reset() {
+	clear(*ss)
+	*ss = (*ss)[:0]
+}
+
 func (ss *SliceStack[T]) ExPop() *Stack[T] {
 	value, ok := ss.Pop()
 	if !ok {
@@ -5,6 +5,7 @@ use list
 use logic
 use math
 use memory
+use reflect
 use sv
 use sys
 use shell
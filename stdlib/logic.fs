@@ -4,7 +4,8 @@
   @numArgs 1 @push @> @if
     @f@ @t@ if #t# else #f# then
   @else
-    { b a } if a exec else b exec then
+    @gensym @!a @gensym @!b
+    { #b# #a# } if #a# exec else #b# exec then
   @then
 ;
 
@@ -34,7 +35,8 @@
   @numArgs 1 @push @> @if
     @b@ @a@ dup #a# swap #b#
   @else
-    { b a } dup a exec swap b exec
+    @gensym @!a @gensym @!b
+    { #b# #a# } dup #a# exec swap #b# exec
   @then
 ;
 
@@ -44,7 +46,8 @@
   @numArgs 2 @push @> @if
     @a@ @b@ @c@ dup #c# over #b# rot #a#
   @else
-    { a b c } dup c exec over b exec rot a exec
+    @gensym @!a @gensym @!b @gensym @!c
+    { #a# #b# #c# } dup #c# exec over #b# exec rot #a# exec
   @then
 ;
 
@@ -60,7 +63,8 @@
   @numArgs 1 @push @> @if
     @w@ @b@ begin #b# while #w# repeat drop
   @else
-    { w b } begin b exec while w exec repeat drop
+    @gensym @!w @gensym @!b
+    { #w# #b# } begin #b# exec while #w# exec repeat drop
   @then
 ;
 
@@ -71,6 +75,7 @@
   @numArgs 0 @push @> @if
     @b@ ?do i #b# loop
   @else
-    { b } ?do i b exec loop
+    @gensym @!b
+    { #b# } ?do i #b# exec loop
   @then
 ;
@@ -25,12 +25,32 @@ variable here
   here >r
   here + to here
   here memsize > if
-    here 2* allocate
+    here 2* memresize
   then
   r>
 ;
 
-: inline alloc ( block -- ) @b@ here #b# to here ;
+: , ( n -- ) 1 allot ! ;
+
+: inline alloc ( block -- ) @b@ here #b# heap-end max to here ;
+
+\ The heap takes its memory from here. Blocks of allocate are zeroed and
+\ returned by free, gc frees the blocks no cell refers to anymore.
+: allocate  ( n -- addr ) here swap 21 sys to here ;
+: free      ( addr -- ) 22 sys ;
+: resize    ( addr n -- addr2 ) here -rot 23 sys to here ;
+: gc        ( -- ) here 24 sys ;
+: gc-auto   ( bool -- ) 25 sys ;
+: heap-info ( -- size used free blocks allocs frees collections ) 26 sys ;
+: heap-end  ( -- addr ) 27 sys ;
+
+: heap-stats ( -- )
+  heap-info { collections frees allocs blocks unused used size }
+  ." heap: " size . ."  used: " used . ."  free: " unused .
+  ."  blocks: " blocks . cr
+  ." allocs: " allocs . ."  frees: " frees . ."  collections: " collections .
+  cr
+;
 
 : $ depth begin dup 0> while dup pick . space 1- repeat drop ;
 : empty begin depth 0> while drop repeat ;
@@ -0,0 +1,64 @@
+\ Reflection of classes. point>class pushes the metadata of the class
+\ point, which is stored in the data segment by the compiler.
+
+: class:name   ( class -- addr len ) dup @ swap 1+ @ ;
+: class:base   ( class -- class ) 2 + @ ;
+: class:sizeof ( class -- n ) 3 + @ ;
+: class:fields ( class -- n ) 4 + @ ;
+
+\ the field idx, the fields of the base classes come first
+: class:field ( idx class -- field ) 5 + swap 6 * + ;
+
+: field-name   ( field -- addr len ) dup @ swap 1+ @ ;
+: field-offset ( field -- n ) 2 + @ ;
+: field-size   ( field -- n ) 3 + @ ;
+: field-type   ( field -- type ) 4 + @ ;
+
+\ the class of references and embedded objects or 0
+: field-class ( field -- class ) 5 + @ ;
+
+\ the address of the field in obj
+: field-addr ( obj field -- addr ) field-offset + ;
+
+\ the types of fields
+: type:cell 0 ;
+: type:int 1 ;
+: type:float 2 ;
+: type:addr 3 ;
+: type:ref 4 ;
+: type:object 5 ;
+
+\ compares n cells at addr1 and addr2
+: cells= ( addr1 addr2 n -- bool )
+  { n addr2 addr1 }
+  0 true { result idx }
+  begin
+    result idx n < and
+  while
+    idx addr1 + @ idx addr2 + @ = to result
+    idx 1+ to idx
+  repeat
+  result
+;
+
+\ the field called addr len or 0
+: class:find ( addr len class -- field )
+  { class len addr }
+  0 0 { result idx }
+  begin
+    result 0= idx class class:fields < and
+  while
+    idx class class:field
+    dup field-name len = if
+      addr len cells= if
+        to result
+      else
+        drop
+      then
+    else
+      2drop
+    then
+    idx 1+ to idx
+  repeat
+  result
+;
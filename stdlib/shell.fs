@@ -1,3 +1,5 @@
+module shell
+
 ( ***************************
   macro ends at | word
   : test
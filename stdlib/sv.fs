@@ -3,7 +3,7 @@
   data
 ;
 
-: sv:fromS ( 0 c b a N -- adr )
+: sv:fromS ( 0 c ... a N -- adr )
   sv:new { self len }
   len self sv:setLen
   len allot self sv:setData
@@ -17,18 +17,45 @@
   self
 ;
 
-: sv:print { self }
-  self sv:getData { ptr }
-  self sv:getLen
-  [ dup 0> ]
-  [
-    ptr @ emit
-    ptr 1+ to ptr
-    1-
-  ]
-  while!
+\ copies the string at addr, e.g. a literal s" ..."
+: sv:fromMem ( addr len -- sv )
+  sv:new { self len addr }
+  len self sv:setLen
+  len allot self sv:setData
+  len addr self sv:getData memcpy
+  self
 ;
 
+\ uses the string at addr without copying it
+: sv:view ( addr len -- sv )
+  sv:new { self len addr }
+  len self sv:setLen
+  addr self sv:setData
+  self
+;
+
+: sv:str ( self -- addr len )
+  dup sv:getData swap sv:getLen
+;
+
+: sv:print ( self -- ) sv:str type ;
+
+\ compares the code points of the strings
+: sv:equals ( self other -- bool )
+  sv:str rot sv:str { len1 addr1 len2 addr2 }
+  0 len1 len2 = { result idx }
+  begin
+    result idx len1 < and
+  while
+    idx addr1 + @ idx addr2 + @ = to result
+    idx 1+ to idx
+  repeat
+  result
+;
+
+\ copies the string, so that the copy can be changed
+: sv:copy ( self -- sv ) sv:str sv:fromMem ;
+
 : sv:each { self block }
   [
     self sv:iter
@@ -41,12 +68,13 @@
 : inline sv:_toS @1@
   #1# sv:getData #1# sv:getLen 1- +
   #1# sv:getData
-  { base ptr }
+  @gensym @!base @gensym @!ptr
+  { #base# #ptr# }
     begin
-      ptr base >=
+      #ptr# #base# >=
     while
-      ptr @
-      ptr 1- to ptr
+      #ptr# @
+      #ptr# 1- to #ptr#
     repeat
   done
 ;
@@ -69,7 +97,7 @@
 \ ------------ Iterator ----------------
 
 : class sviter
-  sv
+  sv:sv
   len
   index
 ;
@@ -102,3 +130,74 @@
 : sviter:get { self }
   self sviter:getSv sv:getData self sviter:getIndex + @
 ;
+
+\ ------------ UTF-8 ----------------
+
+\ The cells of a string hold code points, which are encoded in UTF-8 by
+\ emit, type and the syscalls.
+
+\ the number of bytes of the code point c in UTF-8
+: utf8-size ( c -- n )
+  { c }
+  1 c 127 > + c 2047 > + c 65535 > +
+;
+
+\ the number of bytes of the string at addr in UTF-8
+: utf8-length ( addr len -- n )
+  0 -rot over + swap ?do i @ utf8-size + loop
+;
+
+: sv:utf8Length ( self -- n ) sv:str utf8-length ;
+
+\ combining marks, variation selectors, emoji modifiers and the zero width
+\ joiner belong to the grapheme before them
+: grapheme-extend? ( c -- bool )
+  { c }
+  c 768 879 within
+  c 6832 6911 within or
+  c 7616 7679 within or
+  c 8400 8447 within or
+  c 65024 65039 within or
+  c 65056 65071 within or
+  c 127995 127999 within or
+  c 8205 = or
+;
+
+\ a grapheme starts at index idx, also after a zero width joiner or CR LF
+: sv:boundary? ( self idx -- bool )
+  { idx self }
+  self sv:getData idx + { p }
+  idx 0<= idx self sv:getLen >= or if
+    true
+  else
+    p @ grapheme-extend? not
+    p 1- @ 8205 <> and
+    p 1- @ 13 = p @ 10 = and not and
+  then
+;
+
+\ the number of graphemes
+: sv:graphemes ( self -- n )
+  { self }
+  0 self sv:getLen 0 ?do self i sv:boundary? if 1+ then loop
+;
+
+\ the index of the cell starting grapheme n, or the length
+: sv:graphemeIndex ( self n -- i )
+  { n self }
+  self sv:getLen
+  self sv:getLen 0 ?do
+    self i sv:boundary? if
+      n 0= if drop i leave then
+      n 1- to n
+    then
+  loop
+;
+
+\ n graphemes from grapheme start as a view on the string
+: sv:slice ( self start n -- sv )
+  { n start self }
+  self start sv:graphemeIndex { first }
+  self start n + sv:graphemeIndex { last }
+  self sv:getData first + last first - sv:view
+;
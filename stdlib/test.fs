@@ -0,0 +1,114 @@
+\ Unit tests. "goforth test" runs the words starting with "test:" of the
+\ files ending in "_test.fs", each in a fresh VM:
+\
+\ use test
+\ : test:add T{ 1 2 + -> 3 }T ;
+
+variable assert:count
+variable assert:failures
+variable assert:depth
+variable assert:results
+variable assert:size
+
+\ Starts the next assertion.
+: assert:begin ( -- ) assert:count 1+ to assert:count ;
+
+\ Counts a failed assertion and prints the start of its message.
+: assert:fail ( -- )
+  assert:failures 1+ to assert:failures
+  ." assertion " assert:count . space ." failed: "
+;
+
+\ Moves the top n cells to addr. The top cell is stored first.
+: assert:save { addr n }
+  n 0 ?do
+    addr i + !
+  loop
+;
+
+\ Prints n cells saved by assert:save in stack order.
+: assert:print { n addr }
+  n 0 ?do
+    space addr n 1- i - + @ .
+  loop
+;
+
+\ Compares n cells at a and b.
+: assert:equal { n b a }
+  1
+  n 0 ?do
+    a i + @ b i + @ <> if
+      drop 0
+    then
+  loop
+;
+
+\ Starts an assertion comparing the results of the code up to "->" with
+\ the cells up to "}T": T{ 1 2 + -> 3 }T
+: T{ ( -- )
+  assert:begin
+  depth to assert:depth
+;
+
+\ Saves the results of the tested code.
+: -> ( ... -- )
+  depth assert:depth - 0 max to assert:size
+  assert:size allot to assert:results
+  assert:size assert:results assert:save
+;
+
+\ Compares the expected cells with the saved results.
+: }T ( ... -- )
+  depth assert:depth - 0 max dup allot { expected n }
+  n expected assert:save
+  n assert:size = if
+    assert:results expected n assert:equal
+  else
+    0
+  then
+  not if
+    assert:fail
+    ." expected" expected n assert:print
+    ." , got" assert:results assert:size assert:print cr
+  then
+;
+
+: assert-eq ( actual expected -- )
+  assert:begin
+  2dup <> if
+    assert:fail ." expected " . ." , got " . cr
+  else
+    2drop
+  then
+;
+
+: assert-true ( flag -- )
+  assert:begin
+  0= if
+    assert:fail ." expected true" cr
+  then
+;
+
+\ Compares two floats which may differ by tolerance: 0.1 0.2 f+ 0.3 0.000001 assert-float
+: assert-float { tolerance expected actual }
+  assert:begin
+  actual expected f- fabs tolerance f> if
+    assert:fail ." expected " expected f. ." , got " actual f. cr
+  then
+;
+
+\ Starts capturing the output: output{ 42 . a" 42" }output
+: output{ ( -- )
+  assert:begin
+  capture
+;
+
+\ Compares the captured output with the string expected.
+: }output ( expected -- )
+  captured sv:fromS { actual expected }
+  actual expected compare 0= if
+    assert:fail
+    ." expected output " quo expected sv:print quo
+    ." , got " quo actual sv:print quo cr
+  then
+;
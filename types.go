@@ -0,0 +1,625 @@
+package goforth
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The type of a cell inferred by the type lint.
+type cellType byte
+
+const (
+	typeUnknown cellType = iota
+	typeInt
+	typeFloat
+	typeAddr
+)
+
+func (t cellType) String() string {
+	switch t {
+	case typeInt:
+		return "int"
+	case typeFloat:
+		return "float"
+	case typeAddr:
+		return "address"
+	default:
+		return "unknown"
+	}
+}
+
+// Ints and addresses can be mixed, floats only with floats.
+func (t cellType) compatible(other cellType) bool {
+	if t == typeUnknown || other == typeUnknown {
+		return true
+	}
+
+	return (t == typeFloat) == (other == typeFloat)
+}
+
+// Parses the type of a cell in a stack comment like "x:f".
+func parseCellType(field string) cellType {
+	_, suffix, ok := strings.Cut(field, ":")
+	if !ok {
+		return typeUnknown
+	}
+
+	switch suffix {
+	case "i", "n", "int":
+		return typeInt
+	case "f", "float":
+		return typeFloat
+	case "a", "addr", "adr":
+		return typeAddr
+	default:
+		return typeUnknown
+	}
+}
+
+// The types of the cells taken and left by a word.
+type typeSignature struct {
+	in  []cellType
+	out []cellType
+}
+
+// Parses a typed stack comment like "x:f y:f -- z:f".
+func parseTypeSignature(comment string) (typeSignature, bool) {
+	var sig typeSignature
+
+	if _, ok := ParseStackEffect(comment); !ok {
+		return sig, false
+	}
+
+	before, after, _ := strings.Cut(" "+comment+" ", " -- ")
+
+	for field := range strings.FieldsSeq(before) {
+		sig.in = append(sig.in, parseCellType(field))
+	}
+
+	for field := range strings.FieldsSeq(after) {
+		sig.out = append(sig.out, parseCellType(field))
+	}
+
+	return sig, true
+}
+
+// A cell on the simulated stack. Cells are shared by dup, locals etc.,
+// so a type learned for one use applies to all of them.
+type typedCell struct {
+	t cellType
+}
+
+// Result types of syscalls. Missing syscalls push unknown cells.
+var syscallTypes = map[int64]typeSignature{
+	0:  {nil, []cellType{typeInt}},
+	1:  {[]cellType{typeInt, typeInt}, []cellType{typeInt}},
+	2:  {[]cellType{typeFloat}, []cellType{typeFloat}},
+	3:  {[]cellType{typeInt}, []cellType{typeFloat}},
+	4:  {[]cellType{typeFloat}, []cellType{typeInt}},
+	10: {[]cellType{typeInt}, nil},
+	11: {nil, []cellType{typeInt}},
+	12: {[]cellType{typeAddr, typeAddr}, []cellType{typeInt}},
+	15: {[]cellType{typeAddr}, []cellType{typeInt}},
+	16: {nil, []cellType{typeInt}},
+	20: {[]cellType{typeAddr, typeInt}, nil},
+	21: {[]cellType{typeInt, typeInt}, []cellType{typeAddr, typeInt}},
+	22: {[]cellType{typeAddr}, nil},
+	23: {[]cellType{typeInt, typeAddr, typeInt}, []cellType{typeAddr, typeInt}},
+	24: {[]cellType{typeInt}, nil},
+	26: {nil, []cellType{typeInt, typeInt, typeInt, typeInt, typeInt, typeInt, typeInt}},
+}
+
+type typeChecker struct {
+	fc       *ForthCompiler
+	sigs     map[string]typeSignature
+	unknown  map[string]bool
+	pending  map[string]bool
+	globals  map[string]cellType
+	warnings []string
+}
+
+type typeFrame struct {
+	before   []*typedCell // stack after if
+	inputs   int          // number of inputs at if
+	ifBranch []*typedCell // stack at the end of the if branch
+	hasElse  bool
+}
+
+type typeSim struct {
+	tc     *typeChecker
+	word   string
+	stack  []*typedCell
+	rstack []*typedCell
+	inputs []*typedCell // cells taken from the caller, the deepest first
+	locals map[string]*typedCell
+	frames Stack[*typeFrame]
+}
+
+func newTypeChecker(fc *ForthCompiler) *typeChecker {
+	return &typeChecker{
+		fc:      fc,
+		sigs:    make(map[string]typeSignature),
+		unknown: make(map[string]bool),
+		pending: make(map[string]bool),
+		globals: make(map[string]cellType),
+	}
+}
+
+func (tc *typeChecker) warn(word, format string, args ...any) {
+	msg := fmt.Sprintf("word \"%s\": %s", word, fmt.Sprintf(format, args...))
+
+	if !slices.Contains(tc.warnings, msg) {
+		tc.warnings = append(tc.warnings, msg)
+	}
+}
+
+// Returns the type signature of word. A typed stack comment is preferred.
+func (tc *typeChecker) signature(word string) (typeSignature, bool) {
+	if comment, ok := tc.fc.effects[word]; ok {
+		if sig, ok := parseTypeSignature(comment); ok {
+			return sig, true
+		}
+	}
+
+	return tc.infer(word)
+}
+
+func (tc *typeChecker) infer(word string) (typeSignature, bool) {
+	if sig, ok := tc.sigs[word]; ok {
+		return sig, true
+	}
+
+	if tc.unknown[word] || tc.pending[word] {
+		return typeSignature{}, false
+	}
+
+	tc.pending[word] = true
+	defer delete(tc.pending, word)
+
+	sim := &typeSim{tc: tc, word: word, locals: make(map[string]*typedCell)}
+
+	// the body is checked with the declared types of the inputs
+	if comment, ok := tc.fc.effects[word]; ok {
+		if sig, ok := parseTypeSignature(comment); ok {
+			for _, t := range sig.in {
+				cell := &typedCell{t: t}
+				sim.inputs = append(sim.inputs, cell)
+				sim.stack = append(sim.stack, cell)
+			}
+		}
+	}
+
+	if !sim.run(tc.fc.defs[word].data) {
+		tc.unknown[word] = true
+		return typeSignature{}, false
+	}
+
+	var sig typeSignature
+
+	for _, cell := range sim.inputs {
+		sig.in = append(sig.in, cell.t)
+	}
+
+	for _, cell := range sim.stack {
+		sig.out = append(sig.out, cell.t)
+	}
+
+	tc.sigs[word] = sig
+	return sig, true
+}
+
+func (s *typeSim) pop() *typedCell {
+	if len(s.stack) == 0 {
+		// take a cell from the caller
+		cell := &typedCell{}
+		s.inputs = slices.Insert(s.inputs, 0, cell)
+		return cell
+	}
+
+	cell := s.stack[len(s.stack)-1]
+	s.stack = s.stack[:len(s.stack)-1]
+	return cell
+}
+
+func (s *typeSim) push(cells ...*typedCell) {
+	s.stack = append(s.stack, cells...)
+}
+
+func (s *typeSim) pushType(t cellType) {
+	s.push(&typedCell{t: t})
+}
+
+// Pops n cells, the deepest first.
+func (s *typeSim) popN(n int) []*typedCell {
+	cells := make([]*typedCell, n)
+	for i := n - 1; i >= 0; i-- {
+		cells[i] = s.pop()
+	}
+	return cells
+}
+
+// Checks that cell can be used as type want. Unknown cells learn the type.
+func (s *typeSim) require(cell *typedCell, want cellType, what string) {
+	if cell.t == typeUnknown {
+		cell.t = want
+		return
+	}
+
+	if !cell.t.compatible(want) {
+		hint := "f>i"
+		if want == typeFloat {
+			hint = "i>f"
+		}
+		s.tc.warn(s.word, "%s expects %s but gets %s, missing %s?", what, want, cell.t, hint)
+	}
+}
+
+func (s *typeSim) intArith(w string) {
+	b, a := s.pop(), s.pop()
+
+	if a.t == typeFloat && b.t == typeFloat {
+		s.tc.warn(s.word, "\"%s\" is used on floats, use \"f%s\"", w, w)
+	} else if a.t == typeFloat || b.t == typeFloat {
+		s.tc.warn(s.word, "\"%s\" mixes int and float operands, missing i>f or f>i?", w)
+	} else {
+		s.require(a, typeInt, fmt.Sprintf("\"%s\"", w))
+		s.require(b, typeInt, fmt.Sprintf("\"%s\"", w))
+	}
+
+	if (a.t == typeAddr || b.t == typeAddr) && (w == "+" || w == "-") {
+		s.pushType(typeAddr)
+	} else {
+		s.pushType(typeInt)
+	}
+}
+
+func (s *typeSim) floatArith(w string, result cellType) {
+	b, a := s.pop(), s.pop()
+
+	if !a.t.compatible(typeFloat) && !b.t.compatible(typeFloat) {
+		s.tc.warn(s.word, "\"%s\" is used on ints, use \"%s\" or i>f", w, strings.TrimPrefix(w, "f"))
+	} else if !a.t.compatible(typeFloat) || !b.t.compatible(typeFloat) {
+		s.tc.warn(s.word, "\"%s\" mixes int and float operands, missing i>f or f>i?", w)
+	} else {
+		s.require(a, typeFloat, fmt.Sprintf("\"%s\"", w))
+		s.require(b, typeFloat, fmt.Sprintf("\"%s\"", w))
+	}
+
+	s.pushType(result)
+}
+
+// Runs the primitive op of the Forth word w.
+func (s *typeSim) primitive(w, op string, prev string) bool {
+	switch op {
+	case "ADI", "SBI", "MLI", "DVI":
+		s.intArith(w)
+	case "LSI", "GRI":
+		s.intArith(w)
+		s.stack[len(s.stack)-1].t = typeInt
+	case "ADF", "SBF", "MLF", "DVF":
+		s.floatArith(w, typeFloat)
+	case "LSF", "GRF":
+		s.floatArith(w, typeInt)
+	case "PRI":
+		s.require(s.pop(), typeInt, fmt.Sprintf("\"%s\"", w))
+	case "PRF":
+		s.require(s.pop(), typeFloat, fmt.Sprintf("\"%s\"", w))
+	case "PRA":
+		s.require(s.pop(), typeInt, fmt.Sprintf("\"%s\"", w))
+	case "EQI", "AND", "OR", "XOR":
+		s.popN(2)
+		s.pushType(typeInt)
+	case "NOT":
+		s.pop()
+		s.pushType(typeInt)
+	case "INC", "DEC":
+		cell := s.pop()
+		s.require(cell, typeInt, fmt.Sprintf("\"%s\"", w))
+		s.pushType(cell.t)
+	case "RDI":
+		s.pushType(typeInt)
+	case "LV":
+		s.require(s.pop(), typeAddr, fmt.Sprintf("\"%s\"", w))
+		s.pushType(typeUnknown)
+	case "STR":
+		cells := s.popN(2)
+		s.require(cells[1], typeAddr, fmt.Sprintf("\"%s\"", w))
+	case "STP", "DRP":
+		s.pop()
+	case "DUP":
+		a := s.pop()
+		s.push(a, a)
+	case "TDP":
+		c := s.popN(2)
+		s.push(c[0], c[1], c[0], c[1])
+	case "OVR":
+		c := s.popN(2)
+		s.push(c[0], c[1], c[0])
+	case "TVR":
+		c := s.popN(4)
+		s.push(c[0], c[1], c[2], c[3], c[0], c[1])
+	case "SWP":
+		c := s.popN(2)
+		s.push(c[1], c[0])
+	case "TWP":
+		c := s.popN(4)
+		s.push(c[2], c[3], c[0], c[1])
+	case "ROT":
+		c := s.popN(3)
+		s.push(c[1], c[2], c[0])
+	case "NRT":
+		c := s.popN(3)
+		s.push(c[2], c[0], c[1])
+	case "PCK":
+		s.pop()
+		s.pushType(typeUnknown)
+	case "TR":
+		s.rstack = append(s.rstack, s.pop())
+	case "TTR":
+		s.rstack = append(s.rstack, s.popN(2)...)
+	case "FR", "RF", "TFR", "TRF":
+		n := 1
+		if op == "TFR" || op == "TRF" {
+			n = 2
+		}
+		for i := n; i > 0; i-- {
+			if len(s.rstack) < i {
+				s.pushType(typeUnknown)
+			} else {
+				s.push(s.rstack[len(s.rstack)-i])
+			}
+		}
+		if op == "FR" || op == "TFR" {
+			s.rstack = s.rstack[:max(0, len(s.rstack)-n)]
+		}
+	case "SYS":
+		n, err := strconv.ParseInt(prev, 10, 64)
+		if err != nil {
+			return false
+		}
+		s.pop()
+		sig, ok := syscallTypes[n]
+		if !ok {
+			se, ok := syscallEffects[n]
+			if !ok {
+				return false
+			}
+			sig.in = make([]cellType, se.In)
+			sig.out = make([]cellType, se.Out)
+		}
+		s.call(fmt.Sprintf("%d sys", n), sig)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// Applies the signature of a called word.
+func (s *typeSim) call(w string, sig typeSignature) {
+	args := s.popN(len(sig.in))
+
+	for i, cell := range args {
+		if cell.t == typeFloat && sig.in[i] != typeUnknown && sig.in[i] != typeFloat {
+			s.tc.warn(s.word, "float passed to \"%s\" which expects %s, missing f>i?", w, sig.in[i])
+		} else if sig.in[i] != typeUnknown {
+			s.require(cell, sig.in[i], fmt.Sprintf("\"%s\"", w))
+		}
+	}
+
+	for _, t := range sig.out {
+		s.pushType(t)
+	}
+}
+
+// Merges the stack of two branches. Cells with different types become unknown.
+func mergeStacks(a, b []*typedCell) []*typedCell {
+	if len(a) != len(b) {
+		return nil
+	}
+
+	result := make([]*typedCell, len(a))
+
+	for i := range a {
+		if a[i] == b[i] || a[i].t == b[i].t {
+			result[i] = b[i]
+		} else {
+			result[i] = &typedCell{}
+		}
+	}
+
+	return result
+}
+
+// Simulates the tokens. Returns false if the types can not be tracked.
+func (s *typeSim) run(tokens []string) bool {
+	for i := 0; i < len(tokens); i++ {
+		w := tokens[i]
+		prev := ""
+		if i > 0 {
+			prev = tokens[i-1]
+		}
+
+		switch {
+		case w == "if":
+			s.pop()
+			s.frames.Push(&typeFrame{before: slices.Clone(s.stack), inputs: len(s.inputs)})
+		case w == "else":
+			frame, ok := s.frames.Fetch()
+			if !ok {
+				return false
+			}
+			frame.ifBranch = s.stack
+			frame.hasElse = true
+			s.stack = s.restore(frame)
+		case w == "then":
+			frame, ok := s.frames.Pop()
+			if !ok {
+				return false
+			}
+			other := frame.ifBranch
+			if !frame.hasElse {
+				other = s.restore(frame)
+			}
+			// unbalanced branches are reported by the stack effect check
+			if s.stack = mergeStacks(other, s.stack); s.stack == nil {
+				return false
+			}
+		case w == "begin", w == "case":
+		case w == "while", w == "until", w == "?of":
+			s.pop()
+		case w == "of":
+			s.pop()
+		case w == "repeat", w == "again", w == "endof", w == "endcase", w == "leave", w == "done":
+		case w == "do" || w == "?do":
+			c := s.popN(2)
+			s.require(c[0], typeInt, fmt.Sprintf("\"%s\"", w))
+			s.require(c[1], typeInt, fmt.Sprintf("\"%s\"", w))
+			s.rstack = append(s.rstack, c...)
+		case w == "loop" || w == "+loop" || w == "-loop":
+			if w != "loop" {
+				s.require(s.pop(), typeInt, fmt.Sprintf("\"%s\"", w))
+			}
+			if len(s.rstack) >= 2 {
+				s.rstack = s.rstack[:len(s.rstack)-2]
+			}
+		case w == "{":
+			names := make([]string, 0, 5)
+			for i++; i < len(tokens) && tokens[i] != "}"; i++ {
+				names = append(names, tokens[i])
+			}
+			cells := s.popN(len(names))
+			for j, name := range names {
+				s.locals[name] = cells[j]
+			}
+		case w == "to" || w == "is":
+			i++
+			if i == len(tokens) {
+				return false
+			}
+			cell := s.pop()
+			name := tokens[i]
+			if local, ok := s.locals[name]; ok {
+				if !local.t.compatible(cell.t) {
+					s.tc.warn(s.word, "local \"%s\" holds %s but is assigned %s", name, local.t, cell.t)
+				} else if local.t == typeUnknown {
+					local.t = cell.t
+				}
+			} else if s.tc.fc.vars.Contains(name) {
+				if t := s.tc.globals[name]; !t.compatible(cell.t) {
+					s.tc.warn(s.word, "variable \"%s\" holds %s but is assigned %s", name, t, cell.t)
+				} else if t == typeUnknown {
+					s.tc.globals[name] = cell.t
+				}
+			}
+		case w == "char":
+			i++
+			s.pushType(typeInt)
+		case w == "send":
+			return false
+		case w == "super":
+			i++
+			if i == len(tokens) {
+				return false
+			}
+			impl, err := s.tc.fc.superMethod(s.word, tokens[i])
+			if err != nil {
+				return false
+			}
+			sig, ok := s.tc.signature(impl)
+			if !ok {
+				return false
+			}
+			s.call(impl, sig)
+		case w == "[":
+			depth := 0
+			for i++; i < len(tokens); i++ {
+				if tokens[i] == "[" {
+					depth++
+				} else if tokens[i] == "]" {
+					if depth == 0 {
+						break
+					}
+					depth--
+				}
+			}
+			s.pushType(typeAddr)
+		case isString(w):
+			switch w[0] {
+			case 'a':
+				s.pushType(typeAddr)
+			case 'g':
+				for range len([]rune(w)) - 4 + 2 {
+					s.pushType(typeInt)
+				}
+			case 's':
+				s.pushType(typeAddr)
+				s.pushType(typeInt)
+			}
+		case w == "0":
+			// 0 is also 0.0 and is used to initialize float locals
+			s.pushType(typeUnknown)
+		case isNumeric(w):
+			s.pushType(typeInt)
+		case isFloat(w):
+			s.pushType(typeFloat)
+		case s.locals[w] != nil:
+			s.push(s.locals[w])
+		case s.tc.fc.vars.Contains(w):
+			s.pushType(s.tc.globals[w])
+		case w[0] == '&':
+			s.pushType(typeAddr)
+		default:
+			if op, ok := s.tc.fc.data[w]; ok {
+				if !s.primitive(w, op, prev) {
+					return false
+				}
+			} else if def, ok := s.tc.fc.defs[w]; ok {
+				if def.ContainsAny(rstackWords) && def.Len() <= 4 {
+					// inlined words like i work on the return stack of the caller
+					if !s.run(def.data) {
+						return false
+					}
+					continue
+				}
+				sig, ok := s.tc.signature(w)
+				if !ok {
+					return false
+				}
+				s.call(w, sig)
+			} else {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Returns the stack after the if of frame. Cells taken from the caller
+// inside the branch are part of it.
+func (s *typeSim) restore(frame *typeFrame) []*typedCell {
+	taken := s.inputs[:len(s.inputs)-frame.inputs]
+	return append(slices.Clone(taken), frame.before...)
+}
+
+// Runs the int/float type lint on all words reachable from "main".
+// Returns the warnings found.
+func (fc *ForthCompiler) CheckTypes() []string {
+	tc := newTypeChecker(fc)
+	words := make([]string, 0, 50)
+
+	for word := range fc.reachable("main") {
+		words = append(words, word)
+	}
+
+	slices.Sort(words)
+
+	for _, word := range words {
+		tc.infer(word)
+	}
+
+	return tc.warnings
+}
@@ -0,0 +1,352 @@
+package goforth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The words of the test module starting an assertion. The n-th of them in
+// the source of a test is the location of the n-th assertion.
+var testAssertions = []string{"T{", "assert-eq", "assert-true", "assert-float", "output{"}
+
+// The line printed by the test module for a failed assertion.
+var testFailureLine = regexp.MustCompile(`^assertion (\d+) failed: (.*)$`)
+
+// A failed assertion of a test.
+type TestFailure struct {
+	Location SourceLocation
+	Message  string
+}
+
+// The result of running a test word.
+type TestResult struct {
+	File     string
+	Name     string
+	Location SourceLocation
+	Failures []TestFailure
+	Output   string // the output of the test without the failure messages
+	Duration time.Duration
+}
+
+func (r TestResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// Returns the files ending in "_test.fs" of paths. Directories are searched recursively.
+func FindTestFiles(paths []string) ([]string, error) {
+	files := make([]string, 0, 10)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		if err := filepath.WalkDir(path, func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && strings.HasSuffix(name, "_test.fs") {
+				files = append(files, name)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// Runs the words of file starting with "test:" in the order of their
+// definitions, each in a fresh VM. If run is not nil only the tests
+// matching it are run.
+func RunTestFile(file string, run *regexp.Regexp) ([]TestResult, error) {
+	fc := NewForthCompiler()
+
+	manifest, err := FindManifest(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+
+	fc.Manifest = manifest
+
+	if err := fc.ParseFile("core"); err != nil {
+		return nil, err
+	}
+
+	data, err := fc.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fc.Parse(string(data), file); err != nil {
+		return nil, err
+	}
+
+	tests := make([]string, 0, 10)
+
+	for word, loc := range fc.locations {
+		if loc.File == file && strings.HasPrefix(word, "test:") && fc.defs[word] != nil &&
+			(run == nil || run.MatchString(word)) {
+			tests = append(tests, word)
+		}
+	}
+
+	sort.Slice(tests, func(i, j int) bool {
+		return fc.locations[tests[i]].Line < fc.locations[tests[j]].Line
+	})
+
+	tokens := lspTokenize(string(data))
+	results := make([]TestResult, 0, len(tests))
+
+	for _, test := range tests {
+		results = append(results, fc.runTest(file, test, tokens))
+	}
+
+	return results, nil
+}
+
+func (fc *ForthCompiler) runTest(file, test string, tokens []lspToken) (result TestResult) {
+	result = TestResult{File: file, Name: test, Location: fc.locations[test]}
+	start := time.Now()
+
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	fail := func(loc SourceLocation, message string) {
+		result.Failures = append(result.Failures, TestFailure{loc, message})
+	}
+
+	var out bytes.Buffer
+
+	// every test runs in a new VM, so its data segment starts at 1
+	sysfunc := fc.Fvm.Sysfunc
+	fc.Fvm = NewForthVM()
+	fc.Fvm.Sysfunc = sysfunc
+	fc.Fvm.Out = &out
+
+	if err := fc.Parse(": main "+test+" ;", "test"); err != nil {
+		fail(result.Location, err.Error())
+		return result
+	}
+
+	if err := compileCode(fc); err != nil {
+		fail(result.Location, err.Error())
+		return result
+	}
+
+	if err := runCode(fc.Fvm, fc.ByteCode()); err != nil {
+		fail(result.Location, err.Error())
+	}
+
+	assertions := testAssertionLocations(file, test, result.Location, tokens)
+	output := make([]string, 0, 10)
+	scanner := bufio.NewScanner(&out)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := testFailureLine.FindStringSubmatch(line)
+
+		if m == nil {
+			output = append(output, line)
+			continue
+		}
+
+		loc := result.Location
+		if n, _ := strconv.Atoi(m[1]); n > 0 && n <= len(assertions) {
+			loc = assertions[n-1]
+		}
+
+		fail(loc, m[2])
+	}
+
+	// the message of an assertion failing while the output is captured is lost
+	if n := int(fc.Fvm.Vars["assert:failures"]); n > len(result.Failures) {
+		fail(result.Location, fmt.Sprintf("%d assertions failed", n-len(result.Failures)))
+	}
+
+	if fc.Fvm.ExitStatus != 0 {
+		fail(result.Location, fmt.Sprintf("exit status: %d", fc.Fvm.ExitStatus))
+	}
+
+	result.Output = strings.Join(output, "\n")
+
+	return result
+}
+
+// Preprocesses and compiles main. A panic of the compiler, e.g. of a
+// constant-folded division by zero, is returned as error.
+func compileCode(fc *ForthCompiler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if err := fc.Preprocess(); err != nil {
+		return err
+	}
+
+	return fc.Compile()
+}
+
+// Runs code on fvm. A runtime error of the VM, e.g. a stack underflow, is returned.
+func runCode(fvm *ForthVM, code string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	fvm.Run(code)
+
+	return nil
+}
+
+// Returns the locations of the assertions in the definition of test.
+func testAssertionLocations(file, test string, loc SourceLocation, tokens []lspToken) []SourceLocation {
+	locations := make([]SourceLocation, 0, 10)
+
+	start := slices.IndexFunc(tokens, func(t lspToken) bool {
+		return t.def && t.text == test && t.line == loc.Line-1
+	})
+
+	if start < 0 {
+		return locations
+	}
+
+	for _, t := range tokens[start+1:] {
+		if t.text == ";" {
+			break
+		}
+		if slices.Contains(testAssertions, t.text) {
+			locations = append(locations, SourceLocation{File: file, Line: t.line + 1})
+		}
+	}
+
+	return locations
+}
+
+// Writes the results in the Test Anything Protocol.
+func WriteTAP(w io.Writer, results []TestResult) error {
+	fmt.Fprintf(w, "TAP version 13\n1..%d\n", len(results))
+
+	for n, result := range results {
+		if result.Passed() {
+			fmt.Fprintf(w, "ok %d - %s %s\n", n+1, result.File, result.Name)
+			continue
+		}
+
+		fmt.Fprintf(w, "not ok %d - %s %s\n", n+1, result.File, result.Name)
+
+		for _, failure := range result.Failures {
+			fmt.Fprintf(w, "# %s:%d: %s\n", failure.Location.File, failure.Location.Line, failure.Message)
+		}
+
+		if result.Output != "" {
+			for _, line := range strings.Split(result.Output, "\n") {
+				fmt.Fprintf(w, "# %s\n", line)
+			}
+		}
+	}
+
+	return nil
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string         `xml:"name,attr"`
+	ClassName string         `xml:"classname,attr"`
+	Time      string         `xml:"time,attr"`
+	Failures  []junitFailure `xml:"failure"`
+	SystemOut string         `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+	duration  time.Duration
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+// Writes the results as JUnit XML. Every file is a test suite.
+func WriteJUnit(w io.Writer, results []TestResult) error {
+	var suites junitTestSuites
+
+	for _, result := range results {
+		n := len(suites.Suites) - 1
+
+		if n < 0 || suites.Suites[n].Name != result.File {
+			suites.Suites = append(suites.Suites, junitTestSuite{Name: result.File})
+			n++
+		}
+
+		suite := &suites.Suites[n]
+		tc := junitTestCase{
+			Name:      result.Name,
+			ClassName: result.File,
+			Time:      fmt.Sprintf("%.3f", result.Duration.Seconds()),
+			SystemOut: result.Output,
+		}
+
+		for _, failure := range result.Failures {
+			tc.Failures = append(tc.Failures, junitFailure{
+				Message: failure.Message,
+				Text:    fmt.Sprintf("%s:%d: %s", failure.Location.File, failure.Location.Line, failure.Message),
+			})
+		}
+
+		suite.Tests++
+		suite.duration += result.Duration
+		suite.Time = fmt.Sprintf("%.3f", suite.duration.Seconds())
+		if !result.Passed() {
+			suite.Failures++
+		}
+
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,36 @@
+package goforth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunTestFilePanic(t *testing.T) {
+	// the constant-folded division panics in the compiler
+	file := filepath.Join(t.TempDir(), "div_test.fs")
+	source := `use test
+: test:div 0 0 / drop ;
+: test:add 1 2 + 3 assert-eq ;
+`
+	if err := os.WriteFile(file, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := RunTestFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+
+	if results[0].Passed() || results[0].Location.Line != 2 {
+		t.Errorf("test:div: got %+v, want a failure in line 2", results[0])
+	}
+
+	if !results[1].Passed() {
+		t.Errorf("test:add: got %+v, want it to pass", results[1])
+	}
+}
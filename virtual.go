@@ -0,0 +1,316 @@
+package goforth
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Virtual methods. A class declares methods and the interfaces it
+// implements in its body:
+//
+//	: interface drawable draw ;
+//	: class shape x y method area implements drawable ;
+//	: shape:area ( self -- n ) drop 0 ;
+//	: class square extends shape side ;
+//	: override square:area ( self -- n ) square:getSide dup * ;
+//
+// The objects of such a class have a vtable slot in the cell before their
+// fields, which is set by :init. "obj send area" calls the implementation
+// of area of the class of obj, "super area" in a word of a class calls the
+// implementation of its base class. The implementation of a method is the
+// word class:method of the class or of the nearest base class defining it.
+//
+// Every method name is a selector, i.e. an index into the vtables, which
+// are placed at the start of the data segment by Preprocess and filled when
+// the program starts. Selectors a class has no implementation for call a
+// word reporting the missing method.
+
+// A class defined by ": class".
+type classInfo struct {
+	name       string   // the name used in the definition
+	base       string   // the base class or ""
+	methods    []string // the methods declared by the class
+	interfaces []string // the interfaces implemented by the class
+	virtual    bool     // the objects have a vtable slot
+	table      string   // the word pushing the address of the vtable
+	meta       string   // the word pushing the address of the metadata
+	fields     []classField
+}
+
+// Handles the members "method name" and "implements interface" of the
+// class clazz and returns the remaining fields.
+func (fc *ForthCompiler) classMembers(clazz string, info *classInfo, values []string) ([]string, error) {
+	fields := make([]string, 0, len(values))
+
+	for i := 0; i < len(values); i++ {
+		kind := values[i]
+		if kind != "method" && kind != "implements" {
+			fields = append(fields, kind)
+			continue
+		}
+
+		if i+1 == len(values) {
+			return nil, fmt.Errorf("%s: missing name", kind)
+		}
+
+		i++
+		name := values[i]
+
+		if kind == "implements" {
+			iface := fc.resolveInterface(name)
+			if _, ok := fc.interfaces[iface]; !ok {
+				return nil, fmt.Errorf("class \"%s\": unknown interface \"%s\"", clazz, name)
+			}
+			info.interfaces = append(info.interfaces, iface)
+			continue
+		}
+
+		if !isValidWord(name) || strings.ContainsAny(name, ":.") {
+			return nil, fmt.Errorf("class \"%s\": invalid method name \"%s\"", clazz, name)
+		}
+
+		if info.base != "" && slices.Contains(fc.methodsOf(info.base), name) {
+			return nil, fmt.Errorf("class \"%s\": method \"%s\" is already declared by a base class, use override", clazz, name)
+		}
+
+		if !slices.Contains(info.methods, name) {
+			info.methods = append(info.methods, name)
+		}
+	}
+
+	info.virtual = len(info.methods) > 0 || len(info.interfaces) > 0 || fc.isVirtual(info.base)
+
+	return fields, nil
+}
+
+// Handles ": interface name method ... ;".
+func (fc *ForthCompiler) defineInterface(def *Stack[string]) error {
+	if def.Len() == 0 {
+		return fmt.Errorf("an interface must have a name")
+	}
+
+	name := fc.qualify(def.data[0])
+	methods := make([]string, 0, def.Len()-1)
+
+	for _, method := range def.data[1:] {
+		if strings.ContainsAny(method, ":.") {
+			return fmt.Errorf("interface \"%s\": invalid method name \"%s\"", def.data[0], method)
+		}
+		if !slices.Contains(methods, method) {
+			methods = append(methods, method)
+		}
+	}
+
+	fc.interfaces[name] = methods
+
+	return nil
+}
+
+// Returns the name of the interface name refers to.
+func (fc *ForthCompiler) resolveInterface(name string) string {
+	scope := fc.scope()
+
+	if word, err := fc.resolveQualified(scope, name); err == nil && word != name {
+		return word
+	}
+
+	if _, ok := fc.interfaces[fc.qualify(name)]; ok {
+		return fc.qualify(name)
+	}
+
+	return name
+}
+
+// Reports whether the objects of clazz have a vtable slot.
+func (fc *ForthCompiler) isVirtual(clazz string) bool {
+	info := fc.classes[clazz]
+	return info != nil && info.virtual
+}
+
+// Returns the methods of clazz including the methods of its base classes
+// and interfaces.
+func (fc *ForthCompiler) methodsOf(clazz string) []string {
+	var methods []string
+
+	for c := clazz; fc.classes[c] != nil; c = fc.classes[c].base {
+		methods = append(methods, fc.classes[c].methods...)
+		for _, iface := range fc.classes[c].interfaces {
+			methods = append(methods, fc.interfaces[iface]...)
+		}
+	}
+
+	slices.Sort(methods)
+
+	return slices.Compact(methods)
+}
+
+// Returns the word implementing method for clazz or "".
+func (fc *ForthCompiler) resolveMethod(clazz, method string) string {
+	for c := clazz; c != ""; {
+		if word := c + ":" + method; fc.defs[word] != nil {
+			return word
+		}
+		info := fc.classes[c]
+		if info == nil {
+			break
+		}
+		c = info.base
+	}
+
+	return ""
+}
+
+// Returns the class of word, if it is a word like class:method.
+func (fc *ForthCompiler) classOf(word string) string {
+	i := strings.LastIndex(word, ":")
+	if i <= 0 {
+		return ""
+	}
+
+	if _, ok := fc.classes[word[:i]]; !ok {
+		return ""
+	}
+
+	return word[:i]
+}
+
+// Returns the implementation of method of the base class of the class of
+// word, which is called by "super method" in word.
+func (fc *ForthCompiler) superMethod(word, method string) (string, error) {
+	clazz := fc.classOf(word)
+	if clazz == "" {
+		return "", fmt.Errorf("super: \"%s\" is not a word of a class", word)
+	}
+
+	base := fc.classes[clazz].base
+	impl := ""
+	if base != "" {
+		impl = fc.resolveMethod(base, method)
+	}
+
+	if impl == "" {
+		return "", fmt.Errorf("super: the base class of \"%s\" has no implementation of \"%s\"", clazz, method)
+	}
+
+	return impl, nil
+}
+
+// Checks ": override class:method" before the word is defined.
+func (fc *ForthCompiler) checkOverride(name string) error {
+	i := strings.LastIndex(name, ":")
+	if i <= 0 {
+		return fmt.Errorf("override: \"%s\" should be class:method", name)
+	}
+
+	clazz, method := fc.resolveClass(name[:i]), name[i+1:]
+
+	if _, ok := fc.classes[clazz]; !ok {
+		return fmt.Errorf("override: unknown class \"%s\"", name[:i])
+	}
+
+	if !slices.Contains(fc.methodsOf(clazz), method) {
+		return fmt.Errorf("override: class \"%s\" has no method \"%s\"", name[:i], method)
+	}
+
+	return nil
+}
+
+// Returns the tokens compiled for "send method" or "super method" in word.
+func (fc *ForthCompiler) methodTokens(word, kind, method string) ([]string, error) {
+	if kind == "super" {
+		impl, err := fc.superMethod(word, method)
+		if err != nil {
+			return nil, err
+		}
+		return []string{impl}, nil
+	}
+
+	selector, ok := fc.selectors[method]
+	if !ok {
+		return nil, fmt.Errorf("send: unknown method \"%s\"", method)
+	}
+
+	return []string{"dup", "dec", "@", strconv.Itoa(selector), "+", "@", "exec"}, nil
+}
+
+// Assigns the selectors of the methods, checks the interfaces, places the
+// vtables and the metadata at the start of the data segment and builds the
+// code filling the vtables.
+func (fc *ForthCompiler) layoutClasses() error {
+	clear(fc.selectors)
+	clear(fc.implementations)
+	fc.vtables = fc.vtables[:0]
+	fc.segment = fc.segment[:0]
+	fc.base = fc.segmentBase()
+
+	classes := make([]string, 0, len(fc.classes))
+	methods := make([]string, 0, 10)
+
+	for _, clazz := range slices.Sorted(maps.Keys(fc.classes)) {
+		if fc.isVirtual(clazz) && fc.defs[fc.classes[clazz].table] != nil {
+			classes = append(classes, clazz)
+			methods = append(methods, fc.methodsOf(clazz)...)
+		}
+	}
+
+	slices.Sort(methods)
+	methods = slices.Compact(methods)
+
+	for i, method := range methods {
+		fc.selectors[method] = i
+	}
+
+	for _, clazz := range classes {
+		info := fc.classes[clazz]
+		addr := int(fc.base) + len(fc.segment)
+		fc.defs[info.table] = &Stack[string]{data: []string{strconv.Itoa(addr)}}
+		fc.segment = append(fc.segment, make([]int64, len(methods))...)
+		own := fc.methodsOf(clazz)
+
+		for c := clazz; fc.classes[c] != nil; c = fc.classes[c].base {
+			for _, iface := range fc.classes[c].interfaces {
+				for _, method := range fc.interfaces[iface] {
+					if fc.resolveMethod(clazz, method) == "" {
+						return fmt.Errorf("class \"%s\" does not implement \"%s\" of interface \"%s\"", clazz, method, iface)
+					}
+				}
+			}
+		}
+
+		for i, method := range methods {
+			impl := ""
+			if slices.Contains(own, method) {
+				impl = fc.resolveMethod(clazz, method)
+			}
+
+			if impl == "" {
+				impl = fc.missingMethod(method)
+			} else if !slices.Contains(fc.implementations[method], impl) {
+				fc.implementations[method] = append(fc.implementations[method], impl)
+			}
+
+			fc.vtables = append(fc.vtables, "&"+impl, strconv.Itoa(addr+i), "!")
+		}
+	}
+
+	fc.layoutClassTables()
+
+	return nil
+}
+
+// Returns the word called by "send method" for objects without an
+// implementation of method.
+func (fc *ForthCompiler) missingMethod(method string) string {
+	word := "send>" + method
+
+	if fc.defs[word] == nil {
+		fc.defs[word] = &Stack[string]{data: []string{
+			fmt.Sprintf(".( method %s is not implemented)", method), "10", "emit", "1", "quit",
+		}}
+	}
+
+	return word
+}
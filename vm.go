@@ -12,6 +12,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -30,8 +31,12 @@ type ForthVM struct {
 	l_len      int
 	Sysfunc    func(*ForthVM, int64)
 	Out        io.Writer
+	captures   []io.Writer // the writers replaced by "capture"
+	input      []byte      // the start of a code point not completed by "read"
+	heap       heapState
 	CodeData   *Code
 	ExitStatus int
+	MaxSteps   int64 // Run panics after so many commands, 0 is no limit
 }
 
 func NewForthVM() *ForthVM {
@@ -260,7 +265,19 @@ func (fvm *ForthVM) Grf() {
 }
 
 func (fvm *ForthVM) Pra() {
-	fmt.Fprintf(fvm.Out, "%c", fvm.Pop())
+	fvm.writeRune(fvm.Pop())
+}
+
+// Writes the code point c encoded in UTF-8. Invalid code points are
+// written as U+FFFD.
+func (fvm *ForthVM) writeRune(c int64) {
+	r := utf8.RuneError
+	if c >= 0 && c <= utf8.MaxRune {
+		r = rune(c)
+	}
+
+	var buf [utf8.UTFMax]byte
+	fvm.Out.Write(utf8.AppendRune(buf[:0], r))
 }
 
 func (fvm *ForthVM) Rdi() {
@@ -483,11 +500,11 @@ func (fvm *ForthVM) GetString() string {
 	var builder strings.Builder
 
 	for i := int64(0); i < length; i++ {
-		err := builder.WriteByte(byte(fvm.Mem[data+i]))
-
-		if err != nil {
-			log.Fatal(err)
+		c := fvm.Mem[data+i]
+		if c < 0 || c > utf8.MaxRune {
+			c = utf8.RuneError
 		}
+		builder.WriteRune(rune(c))
 	}
 
 	return builder.String()
@@ -496,13 +513,13 @@ func (fvm *ForthVM) GetString() string {
 // Push str to the fvm stack
 func (fvm *ForthVM) StringToStack(str string) {
 	fvm.Push(0)
-	length := int64(len(str))
+	runes := []rune(str)
 
-	for i := length - 1; i >= 0; i-- {
-		fvm.Push(int64(str[i]))
+	for i := len(runes) - 1; i >= 0; i-- {
+		fvm.Push(int64(runes[i]))
 	}
 
-	fvm.Push(length)
+	fvm.Push(int64(len(runes)))
 }
 
 func (fvm *ForthVM) Sys() {
@@ -575,10 +592,22 @@ func (fvm *ForthVM) Sys() {
 		nbytes := fvm.Pop()
 		buf := make([]byte, nbytes)
 		if n, err := os.Stdin.Read(buf); err != nil {
+			fvm.input = fvm.input[:0]
 			fvm.StringToStack("")
 		} else {
-			str := string(buf[:n])
-			fvm.StringToStack(str)
+			// an incomplete code point at the end is completed by the next read
+			data := append(fvm.input, buf[:n]...)
+			end := len(data)
+			for start := end - 1; start >= max(end-utf8.UTFMax, 0); start-- {
+				if utf8.RuneStart(data[start]) {
+					if !utf8.FullRune(data[start:]) {
+						end = start
+					}
+					break
+				}
+			}
+			fvm.input = append(fvm.input[:0:0], data[end:]...)
+			fvm.StringToStack(string(data[:end]))
 		}
 	case 9:
 		ShowByteCode = fvm.Pop() != 0
@@ -643,6 +672,54 @@ func (fvm *ForthVM) Sys() {
 		n := fvm.Pop()
 		arg := os.Args[n]
 		fvm.StringToStack(arg)
+	case 18:
+		// capture
+		fvm.captures = append(fvm.captures, fvm.Out)
+		fvm.Out = &bytes.Buffer{}
+	case 19:
+		// captured
+		buf, ok := fvm.Out.(*bytes.Buffer)
+		if !ok || len(fvm.captures) == 0 {
+			log.Fatalf("ERROR: sys() - \"captured\" without \"capture\"\n")
+		}
+		fvm.Out = fvm.captures[len(fvm.captures)-1]
+		fvm.captures = fvm.captures[:len(fvm.captures)-1]
+		fvm.StringToStack(buf.String())
+	case 20:
+		// addr len type
+		n := fvm.Pop()
+		addr := fvm.Pop()
+		for _, c := range fvm.Mem[addr : addr+n] {
+			fvm.writeRune(c)
+		}
+	case 21:
+		// here n allocate
+		n := fvm.Pop()
+		addr, here := fvm.allocate(n, fvm.Pop())
+		fvm.Push(addr)
+		fvm.Push(here)
+	case 22:
+		// addr free
+		fvm.free(fvm.Pop())
+	case 23:
+		// here addr n resize
+		n := fvm.Pop()
+		addr := fvm.Pop()
+		addr, here := fvm.resize(addr, n, fvm.Pop())
+		fvm.Push(addr)
+		fvm.Push(here)
+	case 24:
+		// here gc
+		fvm.collect(fvm.Pop())
+	case 25:
+		// bool gc-auto
+		fvm.heap.auto = fvm.Pop() != 0
+	case 26:
+		// heap-info
+		fvm.heapStats()
+	case 27:
+		// heap-end
+		fvm.Push(fvm.heapEnd())
 	default:
 		if fvm.Sysfunc != nil {
 			fvm.Sysfunc(fvm, syscall)
@@ -706,6 +783,7 @@ const (
 	LCL
 	LCLR
 	CALL
+	TAIL // tail call
 	REF
 	EXC
 	PCK
@@ -772,6 +850,7 @@ var CellName = map[Opcode]string{
 	LCL:  "LCL",
 	LCLR: "LCLR",
 	CALL: "CALL",
+	TAIL: "TAIL",
 	REF:  "REF",
 	EXC:  "EXC",
 	PCK:  "PCK",
@@ -798,7 +877,7 @@ func (c Cell) String() string {
 	switch c.cmd {
 	case L:
 		return fmt.Sprintf("%s %d", CellName[c.cmd], c.arg)
-	case LDEF, LSET, CALL, JIN, JMP, NOP, REF, LCL, GDEF, GSET, GBL:
+	case LDEF, LSET, CALL, TAIL, JIN, JMP, NOP, REF, LCL, GDEF, GSET, GBL:
 		return fmt.Sprintf("%s %s", CellName[c.cmd], c.argStr)
 	case LF:
 		return fmt.Sprintf("%s %f", CellName[c.cmd], c.argf)
@@ -954,6 +1033,8 @@ func parseCode(codeStr string) *Code {
 			cells = append(cells, Cell{cmd: LCLR})
 		case "CALL":
 			cells = append(cells, Cell{cmd: CALL, argStr: scmd[1]})
+		case "TAIL":
+			cells = append(cells, Cell{cmd: TAIL, argStr: scmd[1]})
 		case "REF":
 			cells = append(cells, Cell{cmd: REF, argStr: scmd[1]})
 		case "EXC":
@@ -1013,6 +1094,9 @@ func (fvm *ForthVM) Run(codeStr string) {
 
 	for progPtr := fvm.CodeData.PosMain + 1; !done; progPtr++ {
 		numCmds++
+		if numCmds == fvm.MaxSteps {
+			panic(fmt.Sprintf("the program does not stop after %d steps", numCmds))
+		}
 		command := &fvm.CodeData.cells[progPtr]
 
 		switch command.cmd {
@@ -1122,6 +1206,8 @@ func (fvm *ForthVM) Run(codeStr string) {
 		case CALL:
 			fvm.Rpush(int64(progPtr))
 			progPtr = fvm.CodeData.labels[command.argStr]
+		case TAIL:
+			progPtr = fvm.CodeData.labels[command.argStr]
 		case REF:
 			fvm.Push(int64(fvm.CodeData.labels[command.argStr]))
 		case EXC:
@@ -1270,6 +1356,8 @@ func (fvm *ForthVM) RunStep() (bool, error) {
 	case CALL:
 		fvm.Rpush(int64(fvm.CodeData.ProgPtr))
 		fvm.CodeData.ProgPtr = fvm.CodeData.labels[fvm.CodeData.Command.argStr]
+	case TAIL:
+		fvm.CodeData.ProgPtr = fvm.CodeData.labels[fvm.CodeData.Command.argStr]
 	case REF:
 		fvm.Push(int64(fvm.CodeData.labels[fvm.CodeData.Command.argStr]))
 	case EXC:
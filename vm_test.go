@@ -0,0 +1,78 @@
+package goforth
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// Runs the script with the core words in the VM and returns its output.
+func runVM(t *testing.T, script string) string {
+	t.Helper()
+
+	fc := NewForthCompiler()
+	if err := fc.ParseFile("core"); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	fc.Fvm.Out = &out
+
+	if err := fc.Run(script); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+// Compiles the script with the core words to C and returns the output of
+// the binary. The test is skipped without a C compiler.
+func runC(t *testing.T, script string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath(CCompiler); err != nil {
+		t.Skipf("no C compiler: %v", err)
+	}
+
+	code, binary, current := CCodeName, CBinaryName, CCurrentDir
+	t.Cleanup(func() { CCodeName, CBinaryName, CCurrentDir = code, binary, current })
+
+	dir := t.TempDir()
+	CBinaryName = filepath.Join(dir, "main")
+	CCodeName = CBinaryName + ".c"
+	CCurrentDir = true
+
+	fc := NewForthCompiler()
+	if err := fc.ParseFile("core"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fc.CompileScript(script); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(CBinaryName).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func TestCapture(t *testing.T) {
+	script := `: main
+  capture 1 . capture ." inner" 2 . captured captured
+  ." outer:" print ." |rest:" print ." |" cr
+  capture 3.5 f. captured print
+;`
+	want := "outer:1|rest:inner2|\n3.500000"
+
+	if got := runVM(t, script); got != want {
+		t.Errorf("VM: got %q, want %q", got, want)
+	}
+
+	if got := runC(t, script); got != want {
+		t.Errorf("C: got %q, want %q", got, want)
+	}
+}